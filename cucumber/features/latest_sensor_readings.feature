@@ -12,6 +12,7 @@ Feature: Retrieve latest sensor readings
 
   @sad
   Scenario: Retrieve latest readings with no sensors in the account
+    Given I have an account "account3" in the database
     When I retrieve the latest sensor readings for account "account3"
     Then the result should be a 200
     And the response should be equal to "latest_sensor_readings_empty"
@@ -29,3 +30,8 @@ Feature: Retrieve latest sensor readings
     When I retrieve the latest sensor readings for account "account6"
     Then the result should be a 200
     And the response should be equal to "latest_sensor_readings_no_readings"
+
+  @sad
+  Scenario: Retrieve latest readings for a missing account
+    When I retrieve the latest sensor readings for account "account404"
+    Then the result should be a 404
@@ -13,3 +13,9 @@ Feature: List sensors
     When I retrieve the list of sensors for account "account1"
     Then the result should be a 200
     And the response should be equal to "sensors_with_location"
+
+  @sad
+  Scenario: Retrieve sensors for a suspended account
+    Given I have a suspended account "account7" in the database
+    When I retrieve the list of sensors for account "account7"
+    Then the result should be a 403
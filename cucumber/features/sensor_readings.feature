@@ -5,6 +5,7 @@ Feature: Sensor Readings API
 
   @happy
   Scenario: Query for sensor readings
+    Given I have one sensor "sensor5" in the database for account "account5"
     When I query for sensor readings without time ranges for account "account5" and sensor "sensor5"  
     Then the result should be a 200
     And the response is GZIP-compressed
@@ -46,3 +47,10 @@ Feature: Sensor Readings API
     Then the result should be a 200
     And the response should be equal to "query_for_readings_last_2_months_with_1_month_activity"
     And the response is GZIP-compressed
+
+  @sad
+  Scenario: Query for readings of a sensor in another account
+    Given I have one sensor "1" in the database for account "account1"
+    And there are multiple readings for the current month with account "account1" and sensor "1"
+    When I query for sensor readings without time ranges for account "account2" and sensor "1"
+    Then the result should be a 404
@@ -30,6 +30,14 @@ Given(/^I have two sensors without a readings table in the database for account
   delete_sensor_readings_table(Time.now)
 end
 
+Given(/^I have an account "([^"]*)" in the database$/) do |account_id|
+  put_account_record(account_id)
+end
+
+Given(/^I have a suspended account "([^"]*)" in the database$/) do |account_id|
+  put_account_record(account_id, "suspended")
+end
+
 Given(/^I have one sensor "(.*)" in the database for account "(.*)"$/) do |sensor_id, account_id|
   put_sensor_record(account_id, sensor_id, "active")
 end
@@ -125,8 +125,30 @@ def startup
       attribute_definitions: [{
                                   attribute_name: "id",
                                   attribute_type: "S",
+                              },
+                              {
+                                  attribute_name: "account_id",
+                                  attribute_type: "S",
                               }],
       table_name: "relays",
+      global_secondary_indexes: [
+        {
+          index_name: "account_id-index", # required
+          key_schema: [ # required
+            {
+              attribute_name: "account_id", # required
+              key_type: "HASH", # required, accepts HASH, RANGE
+            }
+          ],
+          projection: { # required
+            projection_type: "ALL",
+          },
+          provisioned_throughput: {
+              read_capacity_units: 1,
+              write_capacity_units: 1,
+          }
+        },
+      ],
       key_schema: [{
                        attribute_name: "id",
                        key_type: "HASH",
@@ -144,6 +166,14 @@ def startup
                               {
                                   attribute_name: "account_id",
                                   attribute_type: "S",
+                              },
+                              {
+                                  attribute_name: "name",
+                                  attribute_type: "S",
+                              },
+                              {
+                                  attribute_name: "state",
+                                  attribute_type: "S",
                               }],
       table_name: "sensors",
       global_secondary_indexes: [
@@ -163,6 +193,46 @@ def startup
               write_capacity_units: 1,
           }
         },
+        {
+          index_name: "account_id-name-index", # required
+          key_schema: [ # required
+            {
+              attribute_name: "account_id", # required
+              key_type: "HASH", # required, accepts HASH, RANGE
+            },
+            {
+              attribute_name: "name", # required
+              key_type: "RANGE", # required, accepts HASH, RANGE
+            }
+          ],
+          projection: { # required
+            projection_type: "ALL",
+          },
+          provisioned_throughput: {
+              read_capacity_units: 1,
+              write_capacity_units: 1,
+          }
+        },
+        {
+          index_name: "account_id-state-index", # required
+          key_schema: [ # required
+            {
+              attribute_name: "account_id", # required
+              key_type: "HASH", # required, accepts HASH, RANGE
+            },
+            {
+              attribute_name: "state", # required
+              key_type: "RANGE", # required, accepts HASH, RANGE
+            }
+          ],
+          projection: { # required
+            projection_type: "ALL",
+          },
+          provisioned_throughput: {
+              read_capacity_units: 1,
+              write_capacity_units: 1,
+          }
+        },
       ],
       key_schema: [{
                        attribute_name: "id",
@@ -17,7 +17,19 @@ def get_fixture_file_as_string(filename)
   File.read(File.join(CUCUMBER_BASE, 'fixtures', filename))
 end
 
+def put_account_record(account_id, state="active")
+  ddb = get_dynamo_client
+  ddb.put_item(table_name: "accounts",
+               item: {
+                 "id" => account_id,
+                 "name" => "Account X",
+                 "state" => state,
+                }
+              )
+end
+
 def put_sensor_record(account_id, sensor_id, state, latitude=nil, longitude=nil)
+  put_account_record(account_id)
   ddb = get_dynamo_client
   if latitude && longitude
     ddb.put_item(table_name: "sensors",
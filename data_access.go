@@ -3,6 +3,7 @@ package main // import "github.com/skidder/streammarker-data-access"
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/skidder/streammarker-data-access/db"
 
@@ -20,6 +21,9 @@ const (
 	defaultInfluxDBUsername = "streammarker"
 	defaultInfluxDBAddress  = "http://127.0.0.1:8086"
 	defaultInfluxDBName     = "streammarker_measurements"
+	defaultInfluxDBTimeout  = time.Minute
+
+	defaultSensorRestoreWindow = 30 * 24 * time.Hour
 )
 
 func main() {
@@ -31,7 +35,7 @@ func main() {
 	mainServer.Use(negroni.NewRecovery())
 	mainServer.Use(negroni.NewLogger())
 	mainServer.Use(negroni.HandlerFunc(tokenVerification.Run))
-	mainServer.Use(gzip.Gzip(gzip.DefaultCompression))
+	mainServer.Use(handlers.SkipCompressionForExports(gzip.Gzip(gzip.DefaultCompression)))
 
 	// Create external service connections
 	s := session.New()
@@ -39,7 +43,13 @@ func main() {
 	geoLookup := geo.NewGoogleGeoLookup(os.Getenv("GOOGLE_API_KEY"))
 	geoLookup.Initialize()
 	deviceDatabase := db.NewDeviceDatabase(dynamoDBConnection, geoLookup)
-	measurementsDatabase, err := createMeasurementsDatabaseConnection(deviceDatabase)
+	accountDatabase := db.NewAccountDatabase(dynamoDBConnection)
+	measurementRegistry, err := loadMeasurementRegistry()
+	if err != nil {
+		fmt.Printf("Error loading measurement types: %s\n", err.Error())
+		return
+	}
+	measurementsDatabase, err := createMeasurementsDatabaseConnection(deviceDatabase, measurementRegistry)
 	if err != nil {
 		fmt.Printf("Error connecting to InfluxDB: %s\n", err.Error())
 		return
@@ -47,8 +57,11 @@ func main() {
 
 	// Initialize HTTP service handlers
 	router := mux.NewRouter()
-	handlers.InitializeRouterForSensorsDataRetrieval(router, deviceDatabase, measurementsDatabase)
-	handlers.InitializeRouterForSensorHandler(router, deviceDatabase)
+	handlers.InitializeRouterForSensorsDataRetrieval(router, deviceDatabase, measurementsDatabase, accountDatabase)
+	handlers.InitializeRouterForSensorHandler(router, deviceDatabase, accountDatabase, measurementsDatabase, sensorRestoreWindow())
+	handlers.InitializeRouterForRelayHandler(router, deviceDatabase, accountDatabase, measurementsDatabase)
+	handlers.InitializeRouterForAccountHandler(router, accountDatabase)
+	handlers.InitializeRouterForMeasurementTypesHandler(router, measurementRegistry)
 	mainServer.UseHandler(router)
 	go mainServer.Run(":3000")
 
@@ -69,20 +82,53 @@ func createDynamoDBConnection(s *session.Session) *dynamodb.DynamoDB {
 	return dynamodb.New(s, config)
 }
 
-func createMeasurementsDatabaseConnection(deviceManager db.DeviceManager) (db.MeasurementsDatabase, error) {
+func createMeasurementsDatabaseConnection(deviceManager db.DeviceManager, registry *db.MeasurementRegistry) (db.MeasurementsDatabase, error) {
+	influxDBAddress := os.Getenv("STREAMMARKER_INFLUXDB_ADDRESS")
+	if influxDBAddress == "" {
+		influxDBAddress = defaultInfluxDBAddress
+	}
+
+	influxDBTimeout := defaultInfluxDBTimeout
+	if timeout, err := time.ParseDuration(os.Getenv("STREAMMARKER_INFLUXDB_TIMEOUT")); err == nil && timeout > 0 {
+		influxDBTimeout = timeout
+	}
+
+	switch influxDBVersion := os.Getenv("STREAMMARKER_INFLUXDB_VERSION"); influxDBVersion {
+	case "", "1":
+	case "2":
+		// InfluxDB 2.x authorizes with an API token for a bucket in an organization
+		influxDBBucket := os.Getenv("STREAMMARKER_INFLUXDB_BUCKET")
+		if influxDBBucket == "" {
+			influxDBBucket = defaultInfluxDBName
+		}
+		return db.NewFluxDAO(influxDBAddress, os.Getenv("STREAMMARKER_INFLUXDB_ORG"), influxDBBucket, os.Getenv("STREAMMARKER_INFLUXDB_TOKEN"), influxDBTimeout, deviceManager, registry)
+	default:
+		return nil, fmt.Errorf("Unsupported InfluxDB version: %s", influxDBVersion)
+	}
+
 	influxDBUsername := os.Getenv("STREAMMARKER_INFLUXDB_USERNAME")
 	if influxDBUsername == "" {
 		influxDBUsername = defaultInfluxDBUsername
 	}
 	influxDBPassword := os.Getenv("STREAMMARKER_INFLUXDB_PASSWORD")
-	influxDBAddress := os.Getenv("STREAMMARKER_INFLUXDB_ADDRESS")
-	if influxDBAddress == "" {
-		influxDBAddress = defaultInfluxDBAddress
-	}
 
 	influxDBName := os.Getenv("STREAMMARKER_INFLUXDB_NAME")
 	if influxDBName == "" {
 		influxDBName = defaultInfluxDBName
 	}
-	return db.NewInfluxDAO(influxDBAddress, influxDBUsername, influxDBPassword, influxDBName, deviceManager)
+	return db.NewInfluxDAO(influxDBAddress, influxDBUsername, influxDBPassword, influxDBName, influxDBTimeout, deviceManager, registry)
+}
+
+func loadMeasurementRegistry() (*db.MeasurementRegistry, error) {
+	if path := os.Getenv("STREAMMARKER_MEASUREMENT_TYPES_FILE"); path != "" {
+		return db.LoadMeasurementRegistry(path)
+	}
+	return db.DefaultMeasurementRegistry(), nil
+}
+
+func sensorRestoreWindow() time.Duration {
+	if window, err := time.ParseDuration(os.Getenv("STREAMMARKER_SENSOR_RESTORE_WINDOW")); err == nil {
+		return window
+	}
+	return defaultSensorRestoreWindow
 }
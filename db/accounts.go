@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// AccountStateActive is the state of an account in good standing
+	AccountStateActive = "active"
+	// AccountStateSuspended is the state of an account whose devices may not be accessed
+	AccountStateSuspended = "suspended"
+)
+
+var (
+	// ErrAccountNotFound is returned when an account does not exist
+	ErrAccountNotFound = errors.New("Account not found")
+	// ErrAccountSuspended is returned when an account exists but has been suspended
+	ErrAccountSuspended = errors.New("Account is suspended")
+)
+
+// accountDatabase can be used to read and write account data
+type accountDatabase struct {
+	dynamoDBService *dynamodb.DynamoDB
+}
+
+// AccountManager provides functions for creating, updating and retrieving accounts
+type AccountManager interface {
+	GetAccount(string) (*Account, error)
+	CreateAccount(*Account) (*Account, error)
+	UpdateAccount(string, *Account) (*Account, error)
+}
+
+// NewAccountDatabase constructs a new AccountManager backed by DynamoDB
+func NewAccountDatabase(dynamoDBService *dynamodb.DynamoDB) AccountManager {
+	return &accountDatabase{dynamoDBService: dynamoDBService}
+}
+
+// GetAccount returns account record for the given ID
+func (a *accountDatabase) GetAccount(accountID string) (*Account, error) {
+	params := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(accountID),
+			},
+		},
+		TableName: aws.String("accounts"),
+		AttributesToGet: []*string{
+			aws.String("name"),
+			aws.String("state"),
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+
+	resp, err := a.dynamoDBService.GetItem(params)
+	if err == nil {
+		if resp.Item != nil {
+			account := &Account{
+				ID:    accountID,
+				Name:  *resp.Item["name"].S,
+				State: *resp.Item["state"].S,
+			}
+			return account, nil
+		}
+		return nil, ErrAccountNotFound
+	}
+	return nil, err
+}
+
+// CreateAccount creates a new account database record, failing if the ID is already taken
+func (a *accountDatabase) CreateAccount(account *Account) (*Account, error) {
+	if account.State == "" {
+		account.State = AccountStateActive
+	}
+	params := &dynamodb.PutItemInput{
+		TableName: aws.String("accounts"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(account.ID),
+			},
+			"name": {
+				S: aws.String(account.Name),
+			},
+			"state": {
+				S: aws.String(account.State),
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+
+	_, err := a.dynamoDBService.PutItem(params)
+	if err == nil {
+		return a.GetAccount(account.ID)
+	}
+	if isConditionalCheckFailed(err) {
+		return nil, ErrAlreadyExists
+	}
+	return nil, err
+}
+
+// UpdateAccount updates account database record
+func (a *accountDatabase) UpdateAccount(accountID string, accountUpdates *Account) (*Account, error) {
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(accountID),
+			},
+		},
+		TableName:           aws.String("accounts"),
+		UpdateExpression:    aws.String("SET #name = :name, #state = :state"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name":  aws.String("name"),
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name": {
+				S: aws.String(accountUpdates.Name),
+			},
+			":state": {
+				S: aws.String(accountUpdates.State),
+			},
+		},
+	}
+
+	_, err := a.dynamoDBService.UpdateItem(params)
+	if err == nil {
+		return a.GetAccount(accountID)
+	}
+	if isConditionalCheckFailed(err) {
+		return nil, ErrAccountNotFound
+	}
+	return nil, err
+}
+
+// CheckAccountActive returns an error if the account is missing or suspended
+func CheckAccountActive(accountManager AccountManager, accountID string) error {
+	account, err := accountManager.GetAccount(accountID)
+	if err != nil {
+		return err
+	}
+	if account.State == AccountStateSuspended {
+		return ErrAccountSuspended
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor can't be decoded or
+// belongs to a different listing
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// indexCursor identifies a position within a query of a DynamoDB index
+type indexCursor struct {
+	Index string            `json:"i"`
+	Key   map[string]string `json:"k"`
+}
+
+// encodeCursor renders the last evaluated key of an index query as an opaque
+// cursor. The index keys used for listings only have string attributes.
+func encodeCursor(indexName string, lastEvaluatedKey map[string]*dynamodb.AttributeValue) string {
+	c := indexCursor{Index: indexName, Key: make(map[string]string)}
+	for name, value := range lastEvaluatedKey {
+		c.Key[name] = aws.StringValue(value.S)
+	}
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor converts a cursor back into an exclusive start key, checking
+// that it was issued for a query of the same index within the given account
+func decodeCursor(cursor string, indexName string, accountID string) (map[string]*dynamodb.AttributeValue, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c indexCursor
+	if err = json.Unmarshal(decoded, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Index != indexName || c.Key["account_id"] != accountID || c.Key["id"] == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	startKey := make(map[string]*dynamodb.AttributeValue)
+	for name, value := range c.Key {
+		startKey[name] = &dynamodb.AttributeValue{
+			S: aws.String(value),
+		}
+	}
+	return startKey, nil
+}
+
+// readingsCursor identifies the last reading returned by a readings query
+type readingsCursor struct {
+	SensorID   string `json:"s"`
+	Descending bool   `json:"d"`
+	Time       int64  `json:"t"`
+}
+
+// encodeReadingsCursor renders the time of the last reading of a page as an
+// opaque cursor
+func encodeReadingsCursor(sensorID string, descending bool, last time.Time) string {
+	encoded, _ := json.Marshal(readingsCursor{sensorID, descending, last.UnixNano()})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeReadingsCursor returns the time of the last reading of the previous
+// page, checking the cursor was issued for the same sensor and order
+func decodeReadingsCursor(cursor string, sensorID string, descending bool) (time.Time, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, ErrInvalidCursor
+	}
+	var c readingsCursor
+	if err = json.Unmarshal(decoded, &c); err != nil {
+		return time.Time{}, ErrInvalidCursor
+	}
+	if c.SensorID != sensorID || c.Descending != descending || c.Time == 0 {
+		return time.Time{}, ErrInvalidCursor
+	}
+	return time.Unix(0, c.Time), nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	lastEvaluatedKey := map[string]*dynamodb.AttributeValue{
+		"id":         {S: aws.String("sensor1")},
+		"account_id": {S: aws.String("account1")},
+	}
+
+	startKey, err := decodeCursor(encodeCursor("account_id-index", lastEvaluatedKey), "account_id-index", "account1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "sensor1", *startKey["id"].S)
+	assert.Equal(t, "account1", *startKey["account_id"].S)
+}
+
+func TestDecodeCursorForOtherAccount(t *testing.T) {
+	lastEvaluatedKey := map[string]*dynamodb.AttributeValue{
+		"id":         {S: aws.String("sensor1")},
+		"account_id": {S: aws.String("account1")},
+	}
+
+	_, err := decodeCursor(encodeCursor("account_id-index", lastEvaluatedKey), "account_id-index", "account2")
+
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestDecodeCursorGarbage(t *testing.T) {
+	_, err := decodeCursor("not a cursor!", "account_id-index", "account1")
+
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestDecodeCursorForOtherIndex(t *testing.T) {
+	lastEvaluatedKey := map[string]*dynamodb.AttributeValue{
+		"id":         {S: aws.String("sensor1")},
+		"account_id": {S: aws.String("account1")},
+		"name":       {S: aws.String("Tomatoes")},
+	}
+
+	_, err := decodeCursor(encodeCursor("account_id-name-index", lastEvaluatedKey), "account_id-state-index", "account1")
+
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestReadingsCursorRoundTrip(t *testing.T) {
+	last := time.Date(2016, 5, 1, 0, 0, 1, 500, time.UTC)
+	decoded, err := decodeReadingsCursor(encodeReadingsCursor("sensor1", true, last), "sensor1", true)
+	assert.NoError(t, err)
+	assert.True(t, last.Equal(decoded))
+}
+
+func TestDecodeReadingsCursorForOtherSensorOrOrder(t *testing.T) {
+	cursor := encodeReadingsCursor("sensor1", true, time.Unix(1462060800, 0))
+	_, err := decodeReadingsCursor(cursor, "sensor2", true)
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = decodeReadingsCursor(cursor, "sensor1", false)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DailySummaryDateFormat is the layout of the dates of daily summaries
+const DailySummaryDateFormat = "2006-01-02"
+
+// DailySummary has the minimum, mean and maximum of each measurement of a
+// sensor over one calendar day in the sensor's time zone
+type DailySummary struct {
+	Date         string                     `json:"date"`
+	StartTime    int64                      `json:"start_time"`
+	EndTime      int64                      `json:"end_time"`
+	Measurements []*DailyMeasurementSummary `json:"measurements"`
+}
+
+// DailyMeasurementSummary summarizes a measurement over a day
+type DailyMeasurementSummary struct {
+	Name string  `json:"name"`
+	Unit string  `json:"unit"`
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	Max  float64 `json:"max"`
+}
+
+// GetDailySummaries summarizes the measurements of a sensor for each calendar
+// day from firstDay to lastDay inclusive, in the location of firstDay. Days
+// run from local midnight to midnight, so are 23 or 25 hours long across
+// daylight saving transitions.
+func (i *InfluxDAO) GetDailySummaries(accountID, sensorID string, firstDay, lastDay time.Time) ([]*DailySummary, error) {
+	summaries := dailySummaryDays(firstDay, lastDay)
+	if len(summaries) == 0 {
+		return summaries, nil
+	}
+	queries := make([]*influxQuery, len(summaries))
+	for k, summary := range summaries {
+		queries[k] = newInfluxQuery(fmt.Sprintf("SELECT min(*), mean(*), max(*) FROM %s", quoteIdentifier(sensorMeasurementsTableName))).
+			whereTagEquals("sensor_id", sensorID).
+			whereTagEquals("account_id", accountID).
+			whereTimeWithin(fmt.Sprintf("day%d", k), time.Unix(summary.StartTime, 0), time.Unix(summary.EndTime, 0))
+	}
+
+	res, err := i.queryDB(batchInfluxQueries(queries...))
+	if err != nil {
+		return nil, err
+	}
+	for k, result := range res {
+		if k >= len(summaries) || len(result.Series) == 0 || len(result.Series[0].Values) == 0 {
+			continue
+		}
+		summaries[k].Measurements = i.dailyMeasurementSummaries(result.Series[0].Columns, result.Series[0].Values[0])
+	}
+	return summaries, nil
+}
+
+// dailyMeasurementSummaries gathers the min_, mean_ and max_ columns of each
+// measurement into a summary
+func (i *InfluxDAO) dailyMeasurementSummaries(columns []string, values []interface{}) []*DailyMeasurementSummary {
+	measurements := make([]*DailyMeasurementSummary, 0)
+	byName := make(map[string]*DailyMeasurementSummary)
+	for k, column := range columns {
+		if k >= len(values) {
+			break
+		}
+		var aggregate, name string
+		for _, prefix := range []string{AggregateMin, AggregateMean, AggregateMax} {
+			if strings.HasPrefix(column, prefix+"_") {
+				aggregate, name = prefix, strings.TrimPrefix(column, prefix+"_")
+				break
+			}
+		}
+		if aggregate == "" {
+			continue
+		}
+		measurement, ok := i.registry.measurementFromColumn(name, values[k])
+		if !ok {
+			continue
+		}
+
+		summary, ok := byName[name]
+		if !ok {
+			summary = &DailyMeasurementSummary{Name: name, Unit: measurement.Unit}
+			byName[name] = summary
+			measurements = append(measurements, summary)
+		}
+		switch aggregate {
+		case AggregateMin:
+			summary.Min = measurement.Value
+		case AggregateMean:
+			summary.Mean = measurement.Value
+		case AggregateMax:
+			summary.Max = measurement.Value
+		}
+	}
+	return measurements
+}
+
+// GetDailySummaries summarizes the measurements of a sensor for each calendar
+// day from firstDay to lastDay inclusive, in the location of firstDay. Days
+// run from local midnight to midnight, so are 23 or 25 hours long across
+// daylight saving transitions. Every day is summarized by a single query.
+func (f *FluxDAO) GetDailySummaries(accountID, sensorID string, firstDay, lastDay time.Time) ([]*DailySummary, error) {
+	summaries := dailySummaryDays(firstDay, lastDay)
+	if len(summaries) == 0 {
+		return summaries, nil
+	}
+
+	data := newFluxQuery(f.bucket, time.Unix(summaries[0].StartTime, 0), time.Unix(summaries[len(summaries)-1].EndTime, 0)).
+		whereTagEquals("account_id", accountID).
+		whereTagEquals("sensor_id", sensorID).
+		whereNumeric().
+		pipe("toFloat()")
+	days := make([]string, len(summaries))
+	for k, summary := range summaries {
+		days[k] = fmt.Sprintf(`data |> range(start: %s, stop: %s) |> set(key: "day", value: "%d")`,
+			fluxTime(time.Unix(summary.StartTime, 0)), fluxTime(time.Unix(summary.EndTime, 0)), k)
+	}
+	rows, err := f.queryRows(data.script(
+		"data = "+data.pipeline(),
+		"days = "+fluxUnion(days)+`
+  |> group(columns: ["day", "_field"])`,
+		fluxUnion([]string{
+			`days |> min() |> set(key: "aggregate", value: "min")`,
+			`days |> mean() |> set(key: "aggregate", value: "mean")`,
+			`days |> max() |> set(key: "aggregate", value: "max")`,
+		})))
+	if err != nil {
+		return nil, err
+	}
+
+	byDay := make([]map[string]*DailyMeasurementSummary, len(summaries))
+	for _, row := range rows {
+		for _, values := range row.Values {
+			day, err := strconv.Atoi(fmt.Sprint(rowColumn(row, values, "day")))
+			if err != nil || day < 0 || day >= len(summaries) {
+				continue
+			}
+			name, _ := rowColumn(row, values, "_field").(string)
+			measurement, ok := f.registry.measurementFromColumn(name, rowColumn(row, values, "_value"))
+			if !ok {
+				continue
+			}
+
+			if byDay[day] == nil {
+				byDay[day] = make(map[string]*DailyMeasurementSummary)
+			}
+			summary, ok := byDay[day][name]
+			if !ok {
+				summary = &DailyMeasurementSummary{Name: name, Unit: measurement.Unit}
+				byDay[day][name] = summary
+				summaries[day].Measurements = append(summaries[day].Measurements, summary)
+			}
+			switch rowColumn(row, values, "aggregate") {
+			case AggregateMin:
+				summary.Min = measurement.Value
+			case AggregateMean:
+				summary.Mean = measurement.Value
+			case AggregateMax:
+				summary.Max = measurement.Value
+			}
+		}
+	}
+	for _, summary := range summaries {
+		measurements := summary.Measurements
+		sort.Slice(measurements, func(a, b int) bool { return measurements[a].Name < measurements[b].Name })
+	}
+	return summaries, nil
+}
+
+// dailySummaryDays lists the calendar days from firstDay to lastDay inclusive,
+// in the location of firstDay, each without measurements
+func dailySummaryDays(firstDay, lastDay time.Time) []*DailySummary {
+	summaries := make([]*DailySummary, 0)
+	lastDay = localMidnight(lastDay.In(firstDay.Location()))
+	for day := localMidnight(firstDay); !day.After(lastDay); day = localMidnight(day.AddDate(0, 0, 1)) {
+		next := localMidnight(day.AddDate(0, 0, 1))
+		summaries = append(summaries, &DailySummary{
+			Date:         day.Format(DailySummaryDateFormat),
+			StartTime:    day.Unix(),
+			EndTime:      next.Unix(),
+			Measurements: make([]*DailyMeasurementSummary, 0),
+		})
+	}
+	return summaries
+}
+
+// localMidnight returns the start of the calendar day of t in its location
+func localMidnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
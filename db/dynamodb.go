@@ -1,11 +1,15 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/mholt/binding"
 
@@ -14,10 +18,52 @@ import (
 
 const (
 	tableTimestampFormat = "2006-01"
+
+	conditionalCheckFailedErrorCode = "ConditionalCheckFailedException"
+
+	defaultSampleFrequency = 1
+	defaultSensorPageSize  = 100
+
+	// AnyVersion can be given as the expected version to update a record unconditionally
+	AnyVersion int64 = -1
+
+	// SensorStateActive is the state of a sensor that is producing readings
+	SensorStateActive = "active"
+	// SensorStateInactive is the state of a sensor that is not producing readings
+	SensorStateInactive = "inactive"
+
+	// RelayStateActive is the state of a relay that is in service
+	RelayStateActive = "active"
+	// RelayStateInactive is the state of a relay that is temporarily out of service
+	RelayStateInactive = "inactive"
+	// RelayStateDecommissioned is the state of a relay that has been permanently retired
+	RelayStateDecommissioned = "decommissioned"
 )
 
 var (
 	dynamoPutAction = "PUT"
+	dynamoAddAction = "ADD"
+
+	// ErrAlreadyExists is returned when creating a record whose ID is already taken
+	ErrAlreadyExists = errors.New("Record already exists")
+	// ErrSensorNotFound is returned when a sensor doesn't exist
+	ErrSensorNotFound = errors.New("Sensor not found")
+	// ErrRelayNotFound is returned when a relay doesn't exist
+	ErrRelayNotFound = errors.New("Relay not found")
+	// ErrRelayDecommissioned is returned when updating a relay that has been
+	// permanently retired
+	ErrRelayDecommissioned = errors.New("Relay is decommissioned")
+	// ErrSensorDeleted is returned when deleting a sensor that is already deleted
+	ErrSensorDeleted = errors.New("Sensor is already deleted")
+	// ErrSensorNotDeleted is returned when restoring a sensor that isn't deleted
+	ErrSensorNotDeleted = errors.New("Sensor is not deleted")
+	// ErrRestoreWindowExpired is returned when restoring a sensor deleted too long ago
+	ErrRestoreWindowExpired = errors.New("Sensor restore window has expired")
+	// ErrInvalidSort is returned when listing sensors in an unsupported order
+	ErrInvalidSort = errors.New("Invalid sort order")
+	// ErrVersionMismatch is returned when a conditional update finds the record
+	// has been modified since the expected version was read
+	ErrVersionMismatch = errors.New("Record version does not match")
 )
 
 // Database can be used to read and write sensor & relay data
@@ -29,9 +75,18 @@ type deviceDatabase struct {
 // DeviceManager provides functions for updating and retrieving sensor and relay devices
 type DeviceManager interface {
 	GetRelay(string) (*Relay, error)
+	GetRelays(string, string) ([]*Relay, error)
+	CreateRelay(*Relay) (*Relay, error)
+	UpdateRelay(string, *Relay) (*Relay, error)
+	DeleteRelay(string) (*Relay, error)
 	GetSensor(string) (*Sensor, error)
-	GetSensors(string, string) ([]*Sensor, error)
-	UpdateSensor(string, *Sensor) (*Sensor, error)
+	GetSensors(string, string, bool) ([]*Sensor, error)
+	ListSensors(string, *SensorListOptions) (*SensorPage, error)
+	CreateSensor(*Sensor) (*Sensor, error)
+	UpdateSensor(string, *Sensor, int64) (*Sensor, error)
+	PatchSensor(string, *SensorPatch, int64) (*Sensor, error)
+	DeleteSensor(string) (*Sensor, error)
+	RestoreSensor(string, time.Duration) (*Sensor, error)
 }
 
 // NewDeviceDatabase constructs a new Database instance
@@ -67,13 +122,236 @@ func (d *deviceDatabase) GetRelay(relayID string) (*Relay, error) {
 			}
 			return relay, nil
 		}
-		return nil, fmt.Errorf("Relay not found: %s", relayID)
+		return nil, ErrRelayNotFound
+	}
+	return nil, err
+}
+
+// GetRelays returns all relays for an account, optionally only those in a
+// given state. The state filter is applied by DynamoDB, and queries are
+// repeated until the account's relays are exhausted.
+func (d *deviceDatabase) GetRelays(accountID string, state string) ([]*Relay, error) {
+	params := buildRelayListQuery(accountID, state)
+	var relays []*Relay
+	for {
+		resp, err := d.dynamoDBService.Query(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, relayRecord := range resp.Items {
+			relays = append(relays, &Relay{
+				ID:        *relayRecord["id"].S,
+				AccountID: accountID,
+				Name:      *relayRecord["name"].S,
+				State:     *relayRecord["state"].S,
+			})
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return relays, nil
+		}
+		params.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// buildRelayListQuery builds the query for an account's relays, filtering by
+// state if one is given
+func buildRelayListQuery(accountID string, state string) *dynamodb.QueryInput {
+	params := &dynamodb.QueryInput{
+		TableName:              aws.String("relays"),
+		Select:                 aws.String("ALL_PROJECTED_ATTRIBUTES"),
+		IndexName:              aws.String("account_id-index"),
+		KeyConditionExpression: aws.String("#account_id = :account_id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#account_id": aws.String("account_id"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":account_id": {
+				S: aws.String(accountID),
+			},
+		},
+	}
+	if state != "" {
+		params.ExpressionAttributeNames["#state"] = aws.String("state")
+		params.ExpressionAttributeValues[":state"] = &dynamodb.AttributeValue{
+			S: aws.String(state),
+		}
+		params.FilterExpression = aws.String("#state = :state")
+	}
+	return params
+}
+
+// CreateRelay creates a new relay database record, failing if the ID is already taken
+func (d *deviceDatabase) CreateRelay(relay *Relay) (*Relay, error) {
+	if relay.State == "" {
+		relay.State = RelayStateActive
+	}
+	params := &dynamodb.PutItemInput{
+		TableName: aws.String("relays"),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(relay.ID),
+			},
+			"account_id": {
+				S: aws.String(relay.AccountID),
+			},
+			"name": {
+				S: aws.String(relay.Name),
+			},
+			"state": {
+				S: aws.String(relay.State),
+			},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+
+	_, err := d.dynamoDBService.PutItem(params)
+	if err == nil {
+		return d.GetRelay(relay.ID)
+	}
+	if isConditionalCheckFailed(err) {
+		return nil, ErrAlreadyExists
+	}
+	return nil, err
+}
+
+// UpdateRelay updates relay database record, failing if the relay doesn't
+// exist or has been decommissioned
+func (d *deviceDatabase) UpdateRelay(relayID string, relayUpdates *Relay) (*Relay, error) {
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(relayID),
+			},
+		},
+		TableName:           aws.String("relays"),
+		UpdateExpression:    aws.String("SET #name = :name, #state = :state"),
+		ConditionExpression: aws.String("attribute_exists(id) AND #state <> :decommissioned"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name":  aws.String("name"),
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name": {
+				S: aws.String(relayUpdates.Name),
+			},
+			":state": {
+				S: aws.String(relayUpdates.State),
+			},
+			":decommissioned": {
+				S: aws.String(RelayStateDecommissioned),
+			},
+		},
+	}
+
+	_, err := d.dynamoDBService.UpdateItem(params)
+	if err == nil {
+		return d.GetRelay(relayID)
+	}
+	if isConditionalCheckFailed(err) {
+		// the relay is either missing or decommissioned
+		if _, err = d.GetRelay(relayID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRelayDecommissioned
+	}
+	return nil, err
+}
+
+// DeleteRelay decommissions a relay. The record is retained so readings relayed
+// through it can still be attributed.
+func (d *deviceDatabase) DeleteRelay(relayID string) (*Relay, error) {
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(relayID),
+			},
+		},
+		TableName:           aws.String("relays"),
+		UpdateExpression:    aws.String("SET #state = :state"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":state": {
+				S: aws.String(RelayStateDecommissioned),
+			},
+		},
+	}
+
+	_, err := d.dynamoDBService.UpdateItem(params)
+	if err == nil {
+		return d.GetRelay(relayID)
+	}
+	if isConditionalCheckFailed(err) {
+		return nil, ErrRelayNotFound
+	}
+	return nil, err
+}
+
+// CreateSensor creates a new sensor database record with a generated ID
+func (d *deviceDatabase) CreateSensor(sensor *Sensor) (*Sensor, error) {
+	sensorID, err := newSortableID(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sensor.ID = sensorID
+	if sensor.State == "" {
+		sensor.State = SensorStateActive
+	}
+	if sensor.SampleFrequency == 0 {
+		sensor.SampleFrequency = defaultSampleFrequency
+	}
+
+	item := map[string]*dynamodb.AttributeValue{
+		"id": {
+			S: aws.String(sensor.ID),
+		},
+		"account_id": {
+			S: aws.String(sensor.AccountID),
+		},
+		"name": {
+			S: aws.String(sensor.Name),
+		},
+		"state": {
+			S: aws.String(sensor.State),
+		},
+		"location_enabled": {
+			BOOL: aws.Bool(sensor.LocationEnabled),
+		},
+		"sample_frequency": {
+			N: aws.String(fmt.Sprintf("%d", sensor.SampleFrequency)),
+		},
+		"version": {
+			N: aws.String("1"),
+		},
+	}
+	if sensor.LocationEnabled {
+		item["latitude"] = &dynamodb.AttributeValue{
+			N: aws.String(fmt.Sprintf("%f", sensor.Latitude)),
+		}
+		item["longitude"] = &dynamodb.AttributeValue{
+			N: aws.String(fmt.Sprintf("%f", sensor.Longitude)),
+		}
+	}
+
+	params := &dynamodb.PutItemInput{
+		TableName:           aws.String("sensors"),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	if _, err = d.dynamoDBService.PutItem(params); err == nil {
+		return d.GetSensor(sensor.ID)
+	}
+	if isConditionalCheckFailed(err) {
+		return nil, ErrAlreadyExists
 	}
 	return nil, err
 }
 
-// UpdateSensor updates sensor database record
-func (d *deviceDatabase) UpdateSensor(sensorID string, sensorUpdates *Sensor) (*Sensor, error) {
+// UpdateSensor updates sensor database record. Unless the expected version is
+// AnyVersion, the update only succeeds if the record is still at that version.
+func (d *deviceDatabase) UpdateSensor(sensorID string, sensorUpdates *Sensor, expectedVersion int64) (*Sensor, error) {
 	params := &dynamodb.UpdateItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"id": {
@@ -118,6 +396,163 @@ func (d *deviceDatabase) UpdateSensor(sensorID string, sensorUpdates *Sensor) (*
 					N: aws.String(fmt.Sprintf("%d", sensorUpdates.SampleFrequency)),
 				},
 			},
+			"version": {
+				Action: &dynamoAddAction,
+				Value: &dynamodb.AttributeValue{
+					N: aws.String("1"),
+				},
+			},
+		},
+	}
+	if expectedVersion != AnyVersion {
+		expected := &dynamodb.ExpectedAttributeValue{}
+		if expectedVersion == 0 {
+			// records written before versioning was introduced have no version
+			expected.Exists = aws.Bool(false)
+		} else {
+			expected.Value = &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(expectedVersion, 10)),
+			}
+		}
+		params.Expected = map[string]*dynamodb.ExpectedAttributeValue{
+			"version": expected,
+		}
+	}
+
+	_, err := d.dynamoDBService.UpdateItem(params)
+	if err == nil {
+		return d.GetSensor(sensorID)
+	}
+	if isConditionalCheckFailed(err) {
+		return nil, ErrVersionMismatch
+	}
+	return nil, err
+}
+
+// PatchSensor updates only the sensor attributes present in the patch. Unless
+// the expected version is AnyVersion, the update only succeeds if the record is
+// still at that version.
+func (d *deviceDatabase) PatchSensor(sensorID string, patch *SensorPatch, expectedVersion int64) (*Sensor, error) {
+	updateExpression, names, values := buildSensorPatchExpression(patch)
+	conditionExpression := "attribute_exists(id)"
+	if expectedVersion != AnyVersion {
+		conditionExpression += " AND " + buildVersionCondition(expectedVersion, names, values)
+	}
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(sensorID),
+			},
+		},
+		TableName:                 aws.String("sensors"),
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String(conditionExpression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+
+	_, err := d.dynamoDBService.UpdateItem(params)
+	if err == nil {
+		return d.GetSensor(sensorID)
+	}
+	if isConditionalCheckFailed(err) {
+		if expectedVersion != AnyVersion {
+			return nil, ErrVersionMismatch
+		}
+		return nil, ErrSensorNotFound
+	}
+	return nil, err
+}
+
+// buildVersionCondition returns a condition expression requiring the record to
+// be at the expected version, adding its placeholders to names and values
+func buildVersionCondition(expectedVersion int64, names map[string]*string, values map[string]*dynamodb.AttributeValue) string {
+	names["#version"] = aws.String("version")
+	if expectedVersion == 0 {
+		// records written before versioning was introduced have no version
+		return "attribute_not_exists(#version)"
+	}
+	values[":expected_version"] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(expectedVersion, 10)),
+	}
+	return "#version = :expected_version"
+}
+
+// buildSensorPatchExpression builds a DynamoDB update expression that sets the
+// attributes present in the patch, and removes the location when it is cleared
+func buildSensorPatchExpression(patch *SensorPatch) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	names := make(map[string]*string)
+	values := make(map[string]*dynamodb.AttributeValue)
+	var setClauses, removeClauses []string
+
+	set := func(attribute string, value *dynamodb.AttributeValue) {
+		names["#"+attribute] = aws.String(attribute)
+		values[":"+attribute] = value
+		setClauses = append(setClauses, fmt.Sprintf("#%s = :%s", attribute, attribute))
+	}
+	if patch.Name != nil {
+		set("name", &dynamodb.AttributeValue{S: aws.String(*patch.Name)})
+	}
+	if patch.State != nil {
+		set("state", &dynamodb.AttributeValue{S: aws.String(*patch.State)})
+	}
+	if patch.SampleFrequency != nil {
+		set("sample_frequency", &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%d", *patch.SampleFrequency))})
+	}
+	if patch.ClearLocation {
+		set("location_enabled", &dynamodb.AttributeValue{BOOL: aws.Bool(false)})
+		for _, attribute := range []string{"latitude", "longitude"} {
+			names["#"+attribute] = aws.String(attribute)
+			removeClauses = append(removeClauses, "#"+attribute)
+		}
+	} else {
+		if patch.LocationEnabled != nil {
+			set("location_enabled", &dynamodb.AttributeValue{BOOL: aws.Bool(*patch.LocationEnabled)})
+		}
+		if patch.Latitude != nil {
+			set("latitude", &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%f", *patch.Latitude))})
+		}
+		if patch.Longitude != nil {
+			set("longitude", &dynamodb.AttributeValue{N: aws.String(fmt.Sprintf("%f", *patch.Longitude))})
+		}
+	}
+
+	var clauses []string
+	if len(setClauses) > 0 {
+		clauses = append(clauses, "SET "+strings.Join(setClauses, ", "))
+	}
+	if len(removeClauses) > 0 {
+		clauses = append(clauses, "REMOVE "+strings.Join(removeClauses, ", "))
+	}
+	names["#version"] = aws.String("version")
+	values[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+	clauses = append(clauses, "ADD #version :one")
+	return strings.Join(clauses, " "), names, values
+}
+
+// DeleteSensor soft-deletes a sensor by recording when it was deleted. The
+// record is retained so the sensor can be restored and its readings remain
+// attributable.
+func (d *deviceDatabase) DeleteSensor(sensorID string) (*Sensor, error) {
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(sensorID),
+			},
+		},
+		TableName:           aws.String("sensors"),
+		UpdateExpression:    aws.String("SET deleted_at = :now ADD #version :one"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(deleted_at)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#version": aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+			},
+			":one": {
+				N: aws.String("1"),
+			},
 		},
 	}
 
@@ -125,6 +560,52 @@ func (d *deviceDatabase) UpdateSensor(sensorID string, sensorUpdates *Sensor) (*
 	if err == nil {
 		return d.GetSensor(sensorID)
 	}
+	if isConditionalCheckFailed(err) {
+		return nil, ErrSensorDeleted
+	}
+	return nil, err
+}
+
+// RestoreSensor undoes a soft-delete, provided the sensor was deleted within the
+// retention window
+func (d *deviceDatabase) RestoreSensor(sensorID string, retention time.Duration) (*Sensor, error) {
+	params := &dynamodb.UpdateItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(sensorID),
+			},
+		},
+		TableName:           aws.String("sensors"),
+		UpdateExpression:    aws.String("REMOVE deleted_at ADD #version :one"),
+		ConditionExpression: aws.String("deleted_at >= :cutoff"),
+		ExpressionAttributeNames: map[string]*string{
+			"#version": aws.String("version"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cutoff": {
+				N: aws.String(strconv.FormatInt(time.Now().Add(-retention).Unix(), 10)),
+			},
+			":one": {
+				N: aws.String("1"),
+			},
+		},
+	}
+
+	_, err := d.dynamoDBService.UpdateItem(params)
+	if err == nil {
+		return d.GetSensor(sensorID)
+	}
+	if isConditionalCheckFailed(err) {
+		// distinguish a sensor that was never deleted from one deleted too long ago
+		sensor, getErr := d.GetSensor(sensorID)
+		if getErr != nil {
+			return nil, getErr
+		}
+		if sensor.DeletedAt == 0 {
+			return nil, ErrSensorNotDeleted
+		}
+		return nil, ErrRestoreWindowExpired
+	}
 	return nil, err
 }
 
@@ -145,6 +626,8 @@ func (d *deviceDatabase) GetSensor(sensorID string) (*Sensor, error) {
 			aws.String("latitude"),
 			aws.String("longitude"),
 			aws.String("sample_frequency"),
+			aws.String("deleted_at"),
+			aws.String("version"),
 		},
 		ConsistentRead: aws.Bool(true),
 	}
@@ -164,6 +647,12 @@ func (d *deviceDatabase) GetSensor(sensorID string) (*Sensor, error) {
 			} else {
 				sensor.SampleFrequency = 1
 			}
+			if resp.Item["deleted_at"] != nil {
+				sensor.DeletedAt, _ = strconv.ParseInt(*resp.Item["deleted_at"].N, 10, 64)
+			}
+			if resp.Item["version"] != nil {
+				sensor.Version, _ = strconv.ParseInt(*resp.Item["version"].N, 10, 64)
+			}
 
 			if resp.Item["latitude"] != nil && resp.Item["longitude"] != nil {
 				sensor.Latitude, _ = strconv.ParseFloat(*resp.Item["latitude"].N, 64)
@@ -177,60 +666,162 @@ func (d *deviceDatabase) GetSensor(sensorID string) (*Sensor, error) {
 			}
 			return sensor, nil
 		}
-		return nil, fmt.Errorf("Sensor not found: %s", sensorID)
+		return nil, ErrSensorNotFound
 	}
 	return nil, err
 }
 
-// GetSensors returns sensors for an account in a given state
-func (d *deviceDatabase) GetSensors(accountID string, state string) ([]*Sensor, error) {
-	params := &dynamodb.QueryInput{
-		TableName: aws.String("sensors"),
-		Select:    aws.String("ALL_PROJECTED_ATTRIBUTES"),
-		KeyConditions: map[string]*dynamodb.Condition{
-			"account_id": {
-				ComparisonOperator: aws.String("EQ"),
-				AttributeValueList: []*dynamodb.AttributeValue{
-					{
-						S: aws.String(accountID),
-					},
-				},
-			},
-		},
-		IndexName: aws.String("account_id-index"),
-		Limit:     aws.Int64(100),
+// GetSensors returns all sensors for an account in a given state, paging
+// through the full listing. Deleted sensors are skipped unless includeDeleted
+// is set.
+func (d *deviceDatabase) GetSensors(accountID string, state string, includeDeleted bool) ([]*Sensor, error) {
+	var sensors []*Sensor
+	options := &SensorListOptions{
+		State:          state,
+		IncludeDeleted: includeDeleted,
+		Limit:          defaultSensorPageSize,
+	}
+	for {
+		page, err := d.ListSensors(accountID, options)
+		if err != nil {
+			return nil, err
+		}
+		sensors = append(sensors, page.Sensors...)
+		if page.NextCursor == "" {
+			return sensors, nil
+		}
+		options.Cursor = page.NextCursor
+	}
+}
+
+// ListSensors returns a single page of sensors for an account. The page's
+// NextCursor can be supplied in the options to retrieve the following page.
+// Filters are applied by DynamoDB, and further queries are made until the page
+// is full or the listing is exhausted.
+func (d *deviceDatabase) ListSensors(accountID string, options *SensorListOptions) (*SensorPage, error) {
+	limit := options.Limit
+	if limit <= 0 {
+		limit = defaultSensorPageSize
+	}
+	params, err := buildSensorListQuery(accountID, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.Cursor != "" {
+		startKey, err := decodeCursor(options.Cursor, *params.IndexName, accountID)
+		if err != nil {
+			return nil, err
+		}
+		params.ExclusiveStartKey = startKey
 	}
 
-	var sensors []*Sensor
-	resp, err := d.dynamoDBService.Query(params)
-	if err == nil {
+	page := &SensorPage{}
+	for {
+		params.Limit = aws.Int64(limit - int64(len(page.Sensors)))
+		resp, err := d.dynamoDBService.Query(params)
+		if err != nil {
+			return nil, err
+		}
 		for _, sensorRecord := range resp.Items {
-			if state != "" && *sensorRecord["state"].S != state {
-				continue
-			}
+			page.Sensors = append(page.Sensors, sensorFromRecord(accountID, sensorRecord))
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return page, nil
+		}
+		if int64(len(page.Sensors)) >= limit {
+			page.NextCursor = encodeCursor(*params.IndexName, resp.LastEvaluatedKey)
+			return page, nil
+		}
+		params.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
 
-			s := &Sensor{
-				ID:              *sensorRecord["id"].S,
-				AccountID:       accountID,
-				Name:            *sensorRecord["name"].S,
-				State:           *sensorRecord["state"].S,
-				LocationEnabled: *sensorRecord["location_enabled"].BOOL,
-			}
-			if sensorRecord["sample_frequency"] != nil {
-				s.SampleFrequency, _ = strconv.ParseInt(*sensorRecord["sample_frequency"].N, 10, 64)
-			} else {
-				s.SampleFrequency = 1
-			}
+// buildSensorListQuery builds the query for an account's sensors, choosing the
+// account index whose range key provides the requested ordering. A state filter
+// becomes part of the key condition when the state index is used.
+func buildSensorListQuery(accountID string, options *SensorListOptions) (*dynamodb.QueryInput, error) {
+	sortAttribute := strings.TrimPrefix(options.Sort, "-")
+	descending := sortAttribute != options.Sort
 
-			if sensorRecord["latitude"] != nil && sensorRecord["longitude"] != nil {
-				s.Latitude, _ = strconv.ParseFloat(*sensorRecord["latitude"].N, 64)
-				s.Longitude, _ = strconv.ParseFloat(*sensorRecord["longitude"].N, 64)
-			}
-			sensors = append(sensors, s)
+	var indexName string
+	switch {
+	case sortAttribute == "name":
+		indexName = "account_id-name-index"
+	case sortAttribute == "state", sortAttribute == "" && !descending && options.State != "":
+		indexName = "account_id-state-index"
+	case sortAttribute == "" && !descending:
+		indexName = "account_id-index"
+	default:
+		return nil, ErrInvalidSort
+	}
+
+	keyCondition := "#account_id = :account_id"
+	names := map[string]*string{
+		"#account_id": aws.String("account_id"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":account_id": {
+			S: aws.String(accountID),
+		},
+	}
+	var filters []string
+	if options.State != "" {
+		names["#state"] = aws.String("state")
+		values[":state"] = &dynamodb.AttributeValue{
+			S: aws.String(options.State),
+		}
+		if indexName == "account_id-state-index" {
+			keyCondition += " AND #state = :state"
+		} else {
+			filters = append(filters, "#state = :state")
 		}
-		return sensors, nil
 	}
-	return nil, err
+	if !options.IncludeDeleted {
+		names["#deleted_at"] = aws.String("deleted_at")
+		filters = append(filters, "attribute_not_exists(#deleted_at)")
+	}
+
+	params := &dynamodb.QueryInput{
+		TableName:                 aws.String("sensors"),
+		Select:                    aws.String("ALL_PROJECTED_ATTRIBUTES"),
+		IndexName:                 aws.String(indexName),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(!descending),
+	}
+	if len(filters) > 0 {
+		params.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+	return params, nil
+}
+
+// sensorFromRecord converts a sensor record from the account index into a Sensor
+func sensorFromRecord(accountID string, sensorRecord map[string]*dynamodb.AttributeValue) *Sensor {
+	s := &Sensor{
+		ID:              *sensorRecord["id"].S,
+		AccountID:       accountID,
+		Name:            *sensorRecord["name"].S,
+		State:           *sensorRecord["state"].S,
+		LocationEnabled: *sensorRecord["location_enabled"].BOOL,
+	}
+	if sensorRecord["sample_frequency"] != nil {
+		s.SampleFrequency, _ = strconv.ParseInt(*sensorRecord["sample_frequency"].N, 10, 64)
+	} else {
+		s.SampleFrequency = 1
+	}
+
+	if sensorRecord["latitude"] != nil && sensorRecord["longitude"] != nil {
+		s.Latitude, _ = strconv.ParseFloat(*sensorRecord["latitude"].N, 64)
+		s.Longitude, _ = strconv.ParseFloat(*sensorRecord["longitude"].N, 64)
+	}
+	if sensorRecord["deleted_at"] != nil {
+		s.DeletedAt, _ = strconv.ParseInt(*sensorRecord["deleted_at"].N, 10, 64)
+	}
+	if sensorRecord["version"] != nil {
+		s.Version, _ = strconv.ParseInt(*sensorRecord["version"].N, 10, 64)
+	}
+	return s
 }
 
 // Relay has details for a StreamMarker relay
@@ -243,9 +834,10 @@ type Relay struct {
 
 // QueryForSensorReadingsResults has results for a sensor-readings query
 type QueryForSensorReadingsResults struct {
-	AccountID string            `json:"account_id"`
-	SensorID  string            `json:"sensor_id"`
-	Readings  []*MinimalReading `json:"readings"`
+	AccountID  string            `json:"account_id"`
+	SensorID   string            `json:"sensor_id"`
+	Readings   []*MinimalReading `json:"readings"`
+	NextCursor string            `json:"next_cursor,omitempty"`
 }
 
 // MinimalReading represents a single reading
@@ -257,6 +849,8 @@ type MinimalReading struct {
 // LatestSensorReadings contains the latest readings for a set of sensors
 type LatestSensorReadings struct {
 	Sensors map[string]*SensorReading `json:"sensors"`
+	// Partial is set when the readings of some sensors couldn't be retrieved
+	Partial bool `json:"partial,omitempty"`
 }
 
 // SensorReading has details for a single reading
@@ -267,6 +861,8 @@ type SensorReading struct {
 	State        string        `json:"state"`
 	Timestamp    int64         `json:"timestamp"`
 	Measurements []Measurement `json:"measurements"`
+	// Error describes why the reading couldn't be retrieved, if it couldn't
+	Error string `json:"error,omitempty"`
 }
 
 // Sensor represents a sensor capable of producing measurements
@@ -281,6 +877,37 @@ type Sensor struct {
 	TimeZoneID      string  `json:"timezone_id,omitempty"`
 	TimeZoneName    string  `json:"timezone_name,omitempty"`
 	SampleFrequency int64   `json:"sample_frequency,omitempty"`
+	DeletedAt       int64   `json:"deleted_at,omitempty"`
+	Version         int64   `json:"-"`
+}
+
+// SensorListOptions narrows, orders and pages a listing of an account's
+// sensors. Sort may be "name" or "state", prefixed with "-" for descending
+// order; sensors are unordered when it is empty.
+type SensorListOptions struct {
+	State          string
+	IncludeDeleted bool
+	Sort           string
+	Limit          int64
+	Cursor         string
+}
+
+// SensorPage is a single page of an account's sensors
+type SensorPage struct {
+	Sensors    []*Sensor
+	NextCursor string
+}
+
+// SensorPatch has a partial set of sensor updates. Fields that are nil are left
+// unchanged; ClearLocation removes the sensor's coordinates and disables location.
+type SensorPatch struct {
+	Name            *string  `json:"name"`
+	State           *string  `json:"state"`
+	LocationEnabled *bool    `json:"location_enabled"`
+	Latitude        *float64 `json:"latitude"`
+	Longitude       *float64 `json:"longitude"`
+	SampleFrequency *int64   `json:"sample_frequency"`
+	ClearLocation   bool     `json:"clear_location"`
 }
 
 // Account has account details
@@ -290,11 +917,13 @@ type Account struct {
 	State string `json:"state"`
 }
 
-// Measurement represents a single measurement's details
+// Measurement represents a single measurement's details. The timestamp is only
+// set when it isn't given by an enclosing reading.
 type Measurement struct {
-	Name  string  `json:"name"`
-	Value float64 `json:"value"`
-	Unit  string  `json:"unit"`
+	Name      string  `json:"name"`
+	Value     float64 `json:"value"`
+	Unit      string  `json:"unit"`
+	Timestamp int64   `json:"timestamp,omitempty"`
 }
 
 // MinMaxMeasurement has the minimum and maximum values for a measurement
@@ -304,8 +933,116 @@ type MinMaxMeasurement struct {
 	Max  Measurement `json:"max"`
 }
 
-// FieldMap binds Sensor value for JSON mapping
+// FieldMap binds Account value for JSON mapping. The ID is taken from the
+// request path rather than the body.
+func (a *Account) FieldMap(req *http.Request) binding.FieldMap {
+	if req.Method == "POST" {
+		return binding.FieldMap{
+			&a.Name: binding.Field{
+				Form:     "name",
+				Required: true,
+			},
+			&a.State: "state",
+		}
+	}
+	return binding.FieldMap{
+		&a.Name: binding.Field{
+			Form:     "name",
+			Required: true,
+		},
+		&a.State: binding.Field{
+			Form:     "state",
+			Required: true,
+		},
+	}
+}
+
+// Validate ensures the account state is one of the known states
+func (a *Account) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	switch a.State {
+	case "", AccountStateActive, AccountStateSuspended:
+	default:
+		errs = append(errs, binding.Error{
+			FieldNames:     []string{"state"},
+			Classification: "StateError",
+			Message:        fmt.Sprintf("Unknown account state: %s", a.State),
+		})
+	}
+	return errs
+}
+
+// FieldMap binds Relay value for JSON mapping. The ID and account are only
+// accepted when the relay is being created.
+func (r *Relay) FieldMap(req *http.Request) binding.FieldMap {
+	if req.Method == "POST" {
+		return binding.FieldMap{
+			&r.ID: binding.Field{
+				Form:     "id",
+				Required: true,
+			},
+			&r.AccountID: binding.Field{
+				Form:     "account_id",
+				Required: true,
+			},
+			&r.Name: binding.Field{
+				Form:     "name",
+				Required: true,
+			},
+			&r.State: "state",
+		}
+	}
+	return binding.FieldMap{
+		&r.Name: binding.Field{
+			Form:     "name",
+			Required: true,
+		},
+		&r.State: binding.Field{
+			Form:     "state",
+			Required: true,
+		},
+	}
+}
+
+// Validate ensures the relay state is one of the known states. Relays can only
+// be decommissioned by deleting them, not by updating their state.
+func (r *Relay) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	switch r.State {
+	case "", RelayStateActive, RelayStateInactive:
+	case RelayStateDecommissioned:
+		if req.Method != "POST" {
+			errs = append(errs, binding.Error{
+				FieldNames:     []string{"state"},
+				Classification: "StateError",
+				Message:        "Relays are decommissioned by deleting them",
+			})
+		}
+	default:
+		errs = append(errs, binding.Error{
+			FieldNames:     []string{"state"},
+			Classification: "StateError",
+			Message:        fmt.Sprintf("Unknown relay state: %s", r.State),
+		})
+	}
+	return errs
+}
+
+// FieldMap binds Sensor value for JSON mapping. The account is only accepted
+// when the sensor is being created, and defaults to the caller's account.
 func (s *Sensor) FieldMap(req *http.Request) binding.FieldMap {
+	if req.Method == "POST" {
+		return binding.FieldMap{
+			&s.AccountID: "account_id",
+			&s.Name: binding.Field{
+				Form:     "name",
+				Required: true,
+			},
+			&s.State:           "state",
+			&s.LocationEnabled: "location_enabled",
+			&s.Latitude:        "latitude",
+			&s.Longitude:       "longitude",
+			&s.SampleFrequency: "sample_frequency",
+		}
+	}
 	return binding.FieldMap{
 		&s.Name:            "name",
 		&s.State:           "state",
@@ -315,3 +1052,64 @@ func (s *Sensor) FieldMap(req *http.Request) binding.FieldMap {
 		&s.SampleFrequency: "sample_frequency",
 	}
 }
+
+// Validate ensures the sensor state is one of the known states
+func (s *Sensor) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	return validateSensorState(s.State, errs)
+}
+
+// FieldMap binds SensorPatch value for JSON mapping. No fields are required.
+func (p *SensorPatch) FieldMap(req *http.Request) binding.FieldMap {
+	return binding.FieldMap{
+		&p.Name:            "name",
+		&p.State:           "state",
+		&p.LocationEnabled: "location_enabled",
+		&p.Latitude:        "latitude",
+		&p.Longitude:       "longitude",
+		&p.SampleFrequency: "sample_frequency",
+		&p.ClearLocation:   "clear_location",
+	}
+}
+
+// Validate ensures the patch changes something, doesn't both set and clear the
+// location, and only sets a known state
+func (p *SensorPatch) Validate(req *http.Request, errs binding.Errors) binding.Errors {
+	if p.State != nil {
+		errs = validateSensorState(*p.State, errs)
+	}
+	if p.ClearLocation && (p.Latitude != nil || p.Longitude != nil || (p.LocationEnabled != nil && *p.LocationEnabled)) {
+		errs = append(errs, binding.Error{
+			FieldNames:     []string{"clear_location", "location_enabled", "latitude", "longitude"},
+			Classification: "LocationError",
+			Message:        "Location cannot be both set and cleared",
+		})
+	}
+	if p.Name == nil && p.State == nil && p.LocationEnabled == nil && p.Latitude == nil &&
+		p.Longitude == nil && p.SampleFrequency == nil && !p.ClearLocation {
+		errs = append(errs, binding.Error{
+			Classification: "EmptyPatchError",
+			Message:        "No sensor fields were supplied",
+		})
+	}
+	return errs
+}
+
+func validateSensorState(state string, errs binding.Errors) binding.Errors {
+	switch state {
+	case "", SensorStateActive, SensorStateInactive:
+	default:
+		errs = append(errs, binding.Error{
+			FieldNames:     []string{"state"},
+			Classification: "StateError",
+			Message:        fmt.Sprintf("Unknown sensor state: %s", state),
+		})
+	}
+	return errs
+}
+
+func isConditionalCheckFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == conditionalCheckFailedErrorCode
+	}
+	return false
+}
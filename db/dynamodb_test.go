@@ -0,0 +1,115 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildSensorPatchExpressionOnlySetsPresentFields(t *testing.T) {
+	patch := &SensorPatch{Name: aws.String("Tomatoes")}
+
+	expression, names, values := buildSensorPatchExpression(patch)
+
+	assert.Equal(t, "SET #name = :name ADD #version :one", expression)
+	assert.Len(t, names, 2)
+	assert.Equal(t, "name", *names["#name"])
+	assert.Len(t, values, 2)
+	assert.Equal(t, "Tomatoes", *values[":name"].S)
+}
+
+func TestBuildSensorPatchExpressionSetsLocation(t *testing.T) {
+	latitude, longitude := 38.09, -122.18
+	patch := &SensorPatch{LocationEnabled: aws.Bool(true), Latitude: &latitude, Longitude: &longitude}
+
+	expression, _, values := buildSensorPatchExpression(patch)
+
+	assert.Equal(t, "SET #location_enabled = :location_enabled, #latitude = :latitude, #longitude = :longitude ADD #version :one", expression)
+	assert.True(t, *values[":location_enabled"].BOOL)
+	assert.Equal(t, "38.090000", *values[":latitude"].N)
+	assert.Equal(t, "-122.180000", *values[":longitude"].N)
+}
+
+func TestBuildSensorPatchExpressionClearsLocation(t *testing.T) {
+	patch := &SensorPatch{State: aws.String("inactive"), ClearLocation: true}
+
+	expression, names, values := buildSensorPatchExpression(patch)
+
+	assert.Equal(t, "SET #state = :state, #location_enabled = :location_enabled REMOVE #latitude, #longitude ADD #version :one", expression)
+	assert.Equal(t, "latitude", *names["#latitude"])
+	assert.Equal(t, "longitude", *names["#longitude"])
+	assert.False(t, *values[":location_enabled"].BOOL)
+	assert.NotContains(t, values, ":latitude")
+}
+
+func TestBuildVersionCondition(t *testing.T) {
+	names := make(map[string]*string)
+	values := make(map[string]*dynamodb.AttributeValue)
+
+	assert.Equal(t, "#version = :expected_version", buildVersionCondition(3, names, values))
+	assert.Equal(t, "version", *names["#version"])
+	assert.Equal(t, "3", *values[":expected_version"].N)
+}
+
+func TestBuildVersionConditionForUnversionedRecord(t *testing.T) {
+	names := make(map[string]*string)
+	values := make(map[string]*dynamodb.AttributeValue)
+
+	assert.Equal(t, "attribute_not_exists(#version)", buildVersionCondition(0, names, values))
+	assert.Empty(t, values)
+}
+
+func TestBuildSensorListQueryDefault(t *testing.T) {
+	params, err := buildSensorListQuery("account1", &SensorListOptions{})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "account_id-index", *params.IndexName)
+	assert.Equal(t, "#account_id = :account_id", *params.KeyConditionExpression)
+	assert.Equal(t, "attribute_not_exists(#deleted_at)", *params.FilterExpression)
+	assert.True(t, *params.ScanIndexForward)
+}
+
+func TestBuildSensorListQueryStateUsesKeyCondition(t *testing.T) {
+	params, err := buildSensorListQuery("account1", &SensorListOptions{State: "active", IncludeDeleted: true})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "account_id-state-index", *params.IndexName)
+	assert.Equal(t, "#account_id = :account_id AND #state = :state", *params.KeyConditionExpression)
+	assert.Nil(t, params.FilterExpression)
+	assert.Equal(t, "active", *params.ExpressionAttributeValues[":state"].S)
+}
+
+func TestBuildSensorListQueryNameDescendingFiltersState(t *testing.T) {
+	params, err := buildSensorListQuery("account1", &SensorListOptions{State: "active", Sort: "-name"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "account_id-name-index", *params.IndexName)
+	assert.Equal(t, "#account_id = :account_id", *params.KeyConditionExpression)
+	assert.Equal(t, "#state = :state AND attribute_not_exists(#deleted_at)", *params.FilterExpression)
+	assert.False(t, *params.ScanIndexForward)
+}
+
+func TestBuildSensorListQueryInvalidSort(t *testing.T) {
+	for _, sort := range []string{"id", "-", "timestamp"} {
+		_, err := buildSensorListQuery("account1", &SensorListOptions{Sort: sort})
+		assert.Equal(t, ErrInvalidSort, err, sort)
+	}
+}
+
+func TestBuildRelayListQuery(t *testing.T) {
+	params := buildRelayListQuery("account1", "")
+
+	assert.Equal(t, "account_id-index", *params.IndexName)
+	assert.Equal(t, "#account_id = :account_id", *params.KeyConditionExpression)
+	assert.Nil(t, params.FilterExpression)
+	assert.Nil(t, params.Limit)
+}
+
+func TestBuildRelayListQueryFiltersState(t *testing.T) {
+	params := buildRelayListQuery("account1", "active")
+
+	assert.Equal(t, "#state = :state", *params.FilterExpression)
+	assert.Equal(t, "active", *params.ExpressionAttributeValues[":state"].S)
+}
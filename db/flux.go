@@ -0,0 +1,355 @@
+package db
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+var (
+	// fluxMinTime and fluxMaxTime bound queries and deletes of every point
+	fluxMinTime = time.Unix(0, 0)
+	fluxMaxTime = time.Unix(0, math.MaxInt64)
+)
+
+// fluxQuery builds a Flux query of the sensor measurements in a bucket, one
+// stage of the pipeline at a time. Values are written as escaped string
+// literals, as Flux has no bound parameters.
+type fluxQuery struct {
+	imports []string
+	stages  []string
+}
+
+// newFluxQuery starts a query for the sensor measurements in a bucket from
+// start up to but not including stop
+func newFluxQuery(bucket string, start time.Time, stop time.Time) *fluxQuery {
+	q := &fluxQuery{}
+	q.stages = append(q.stages,
+		fmt.Sprintf("from(bucket: %s)", fluxString(bucket)),
+		fmt.Sprintf("range(start: %s, stop: %s)", fluxTime(start), fluxTime(stop)),
+		fmt.Sprintf("filter(fn: (r) => r._measurement == %s)", fluxString(sensorMeasurementsTableName)))
+	return q
+}
+
+// use imports a Flux package needed by a stage of the query
+func (q *fluxQuery) use(pkg string) *fluxQuery {
+	for _, imported := range q.imports {
+		if imported == pkg {
+			return q
+		}
+	}
+	q.imports = append(q.imports, pkg)
+	return q
+}
+
+// pipe adds a stage to the pipeline
+func (q *fluxQuery) pipe(format string, args ...interface{}) *fluxQuery {
+	q.stages = append(q.stages, fmt.Sprintf(format, args...))
+	return q
+}
+
+// whereTagEquals restricts the query to points whose tag has the given value
+func (q *fluxQuery) whereTagEquals(tag string, value string) *fluxQuery {
+	return q.whereTagIn(tag, []string{value})
+}
+
+// whereTagIn restricts the query to points whose tag has any of the given
+// values
+func (q *fluxQuery) whereTagIn(tag string, values []string) *fluxQuery {
+	comparisons := make([]string, len(values))
+	for k, value := range values {
+		comparisons[k] = fmt.Sprintf("r[%s] == %s", fluxString(tag), fluxString(value))
+	}
+	return q.pipe("filter(fn: (r) => %s)", strings.Join(comparisons, " or "))
+}
+
+// whereFieldIn restricts the query to the given fields, or leaves all of them
+// if none are given
+func (q *fluxQuery) whereFieldIn(fields []string) *fluxQuery {
+	if len(fields) == 0 {
+		return q
+	}
+	comparisons := make([]string, len(fields))
+	for k, field := range fields {
+		comparisons[k] = "r._field == " + fluxString(field)
+	}
+	return q.pipe("filter(fn: (r) => %s)", strings.Join(comparisons, " or "))
+}
+
+// whereNumeric drops the points of boolean and string fields
+func (q *fluxQuery) whereNumeric() *fluxQuery {
+	return q.use("types").
+		pipe("filter(fn: (r) => types.isNumeric(v: r._value))")
+}
+
+// whereTime compares the time of points against t, with nanosecond precision
+func (q *fluxQuery) whereTime(operator string, t time.Time) *fluxQuery {
+	return q.pipe("filter(fn: (r) => r._time %s %s)", operator, fluxTime(t))
+}
+
+// aggregateWindow combines the points of each field into windows of the given
+// interval, timestamped with the start of the window like InfluxQL's GROUP BY
+// time. Fill is none, null, previous, linear or a number.
+func (q *fluxQuery) aggregateWindow(interval time.Duration, aggregate string, fill string) *fluxQuery {
+	if aggregate != AggregateFirst && aggregate != AggregateLast {
+		q.whereNumeric()
+	}
+	fillValue, err := strconv.ParseFloat(fill, 64)
+	isNumber := fill != "" && err == nil
+	if isNumber {
+		// the fill value has to have the same type as the field
+		q.pipe("toFloat()")
+	}
+	every := fmt.Sprintf("%ds", int64(interval/time.Second))
+	createEmpty := fill != "none" && fill != "linear"
+	q.pipe("aggregateWindow(every: %s, fn: %s, createEmpty: %t, timeSrc: \"_start\")", every, aggregate, createEmpty)
+
+	switch {
+	case fill == "previous":
+		q.pipe("fill(usePrevious: true)")
+	case fill == "linear":
+		q.use("interpolate").
+			pipe("interpolate.linear(every: %s)", every)
+	case isNumber:
+		q.pipe("fill(value: %s)", fluxFloat(fillValue))
+	}
+	return q
+}
+
+// pivotBySensor turns the points of each field into columns of one row per
+// time, returning a table for each sensor
+func (q *fluxQuery) pivotBySensor() *fluxQuery {
+	return q.pipe(`pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`).
+		pipe(`group(columns: ["sensor_id"])`)
+}
+
+// orderByTimeDesc returns the newest points first
+func (q *fluxQuery) orderByTimeDesc() *fluxQuery {
+	return q.pipe(`sort(columns: ["_time"], desc: true)`)
+}
+
+// orderByTimeAsc returns the oldest points first
+func (q *fluxQuery) orderByTimeAsc() *fluxQuery {
+	return q.pipe(`sort(columns: ["_time"])`)
+}
+
+// limit caps the number of rows returned from each table
+func (q *fluxQuery) limit(n int) *fluxQuery {
+	return q.pipe("limit(n: %d)", n)
+}
+
+// pipeline renders the stages of the query as one expression
+func (q *fluxQuery) pipeline() string {
+	return strings.Join(q.stages, "\n  |> ")
+}
+
+// script renders the query with its imports, followed by any statements that
+// use the pipeline, which can be named with an assignment
+func (q *fluxQuery) script(statements ...string) string {
+	lines := make([]string, 0, len(q.imports)+len(statements)+1)
+	for _, pkg := range q.imports {
+		lines = append(lines, "import "+fluxString(pkg))
+	}
+	if len(statements) == 0 {
+		return strings.Join(append(lines, q.pipeline()), "\n")
+	}
+	return strings.Join(append(lines, statements...), "\n")
+}
+
+// fluxUnion combines the tables of several streams. Flux needs at least two
+// streams to union, so a single stream is left as it is.
+func fluxUnion(streams []string) string {
+	if len(streams) == 1 {
+		return streams[0]
+	}
+	return "union(tables: [\n  " + strings.Join(streams, ",\n  ") + ",\n])"
+}
+
+// fluxString quotes a value as a Flux string literal, escaping the characters
+// that would end the string or start an interpolation
+func fluxString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`).Replace(value) + `"`
+}
+
+// fluxTime renders a time as a Flux date literal
+func fluxTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// fluxFloat renders a number as a Flux float literal, which needs a decimal
+// point to not be read as an integer
+func fluxFloat(value float64) string {
+	literal := strconv.FormatFloat(value, 'f', -1, 64)
+	if !strings.Contains(literal, ".") {
+		literal += ".0"
+	}
+	return literal
+}
+
+// fluxSystemColumns are the columns of Flux results that aren't needed once
+// rows are read, as they repeat the bucket and query rather than the points
+var fluxSystemColumns = map[string]bool{
+	"":             true,
+	"result":       true,
+	"table":        true,
+	"_start":       true,
+	"_stop":        true,
+	"_measurement": true,
+}
+
+// fluxTable describes the columns of a table of Flux results, named as they
+// would be by InfluxQL
+type fluxTable struct {
+	id      string
+	columns []string
+	tags    map[string]string
+}
+
+// readAnnotatedCSV reads Flux results in annotated CSV, passing each row to the
+// handler as it's read along with the table it belongs to. Values are typed as
+// the InfluxDB 1.x client would return them: numbers as json.Number, times as
+// RFC3339 strings, and booleans and strings as themselves.
+func readAnnotatedCSV(r io.Reader, handle func(table *fluxTable, values []interface{}) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	var datatypes, groups, defaults, header []string
+	var table *fluxTable
+	var keep []int
+	expectHeader := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(record[0], "#") {
+			switch record[0] {
+			case "#datatype":
+				datatypes = append(datatypes[:0], record...)
+			case "#group":
+				groups = append(groups[:0], record...)
+			case "#default":
+				defaults = append(defaults[:0], record...)
+			}
+			expectHeader = true
+			continue
+		}
+		if expectHeader {
+			header = append(header[:0], record...)
+			expectHeader = false
+			table = nil
+			if len(header) > 1 && header[1] == "error" {
+				// errors during a query are returned as a table of their own
+				return readFluxError(reader)
+			}
+			continue
+		}
+
+		raw := func(k int) string {
+			if k < len(record) && record[k] != "" {
+				return record[k]
+			} else if k < len(defaults) {
+				return defaults[k]
+			}
+			return ""
+		}
+		tableID := ""
+		for k, column := range header {
+			if column == "table" {
+				tableID = raw(k)
+			}
+		}
+		if table == nil || table.id != tableID {
+			table = &fluxTable{id: tableID, tags: make(map[string]string)}
+			keep = keep[:0]
+			for k, column := range header {
+				if fluxSystemColumns[column] {
+					continue
+				}
+				if k < len(groups) && groups[k] == "true" {
+					table.tags[column] = raw(k)
+				}
+				if column == "_time" {
+					column = "time"
+				}
+				table.columns = append(table.columns, column)
+				keep = append(keep, k)
+			}
+		}
+
+		values := make([]interface{}, len(keep))
+		for n, k := range keep {
+			datatype := ""
+			if k < len(datatypes) {
+				datatype = datatypes[k]
+			}
+			values[n] = fluxValue(datatype, raw(k))
+		}
+		if err = handle(table, values); err != nil {
+			return err
+		}
+	}
+}
+
+// readFluxError reads the message from the table of a failed query
+func readFluxError(reader *csv.Reader) error {
+	record, err := reader.Read()
+	if err != nil || len(record) < 2 || record[1] == "" {
+		return errors.New("Flux query failed")
+	}
+	return errors.New(record[1])
+}
+
+// fluxValue converts a value of annotated CSV from its data type
+func fluxValue(datatype string, raw string) interface{} {
+	if raw == "" && datatype != "string" {
+		return nil
+	}
+	switch datatype {
+	case "double", "long", "unsignedLong":
+		return json.Number(raw)
+	case "boolean":
+		return raw == "true"
+	}
+	return raw
+}
+
+// readFluxRows reads every table of Flux results into a row, in the order the
+// tables were returned
+func readFluxRows(r io.Reader) ([]*models.Row, error) {
+	rows := make([]*models.Row, 0)
+	var last *fluxTable
+	err := readAnnotatedCSV(r, func(table *fluxTable, values []interface{}) error {
+		if table != last {
+			rows = append(rows, &models.Row{Tags: table.tags, Columns: table.columns})
+			last = table
+		}
+		row := rows[len(rows)-1]
+		row.Values = append(row.Values, values)
+		return nil
+	})
+	return rows, err
+}
+
+// rowColumn returns the value of a named column of a row, or nil if the row
+// doesn't have it
+func rowColumn(row *models.Row, values []interface{}, name string) interface{} {
+	for k, column := range row.Columns {
+		if column == name && k < len(values) {
+			return values[k]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFluxQueryQuotesTagValues(t *testing.T) {
+	script := newFluxQuery("streammarker_measurements", time.Unix(0, 0), time.Unix(60, 0)).
+		whereTagEquals("account_id", "account1").
+		whereTagIn("sensor_id", []string{hostileSensorID, `sensor" or true or "`, "${token}"}).
+		script()
+
+	assert.Equal(t, `from(bucket: "streammarker_measurements")
+  |> range(start: 1970-01-01T00:00:00Z, stop: 1970-01-01T00:01:00Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "1' or account_id = 'account2" or r["sensor_id"] == "sensor\" or true or \"" or r["sensor_id"] == "\${token}")`, script)
+}
+
+func TestFluxQueryAggregateWindow(t *testing.T) {
+	q := newFluxQuery("streammarker_measurements", time.Unix(0, 0), time.Unix(60, 0)).
+		aggregateWindow(time.Hour, AggregateMean, "0")
+	assert.Equal(t, []string{"types"}, q.imports)
+	assert.Equal(t, []string{
+		"filter(fn: (r) => types.isNumeric(v: r._value))",
+		"toFloat()",
+		`aggregateWindow(every: 3600s, fn: mean, createEmpty: true, timeSrc: "_start")`,
+		"fill(value: 0.0)",
+	}, q.stages[3:])
+
+	q = newFluxQuery("streammarker_measurements", time.Unix(0, 0), time.Unix(60, 0)).
+		aggregateWindow(time.Minute, AggregateLast, "linear")
+	assert.Equal(t, []string{"interpolate"}, q.imports)
+	assert.Equal(t, []string{
+		`aggregateWindow(every: 60s, fn: last, createEmpty: false, timeSrc: "_start")`,
+		"interpolate.linear(every: 60s)",
+	}, q.stages[3:])
+	assert.True(t, strings.HasPrefix(q.script(), "import \"interpolate\"\nfrom("))
+}
+
+const annotatedCSV = `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,string,string,string,double,boolean
+#group,false,false,true,true,false,true,true,true,false,false
+#default,_result,,,,,,,,,
+,result,table,_start,_stop,_time,_measurement,account_id,sensor_id,temperature,door_open
+,,0,2016-05-01T00:00:00Z,2016-05-02T00:00:00Z,2016-05-01T00:00:00Z,sensor_measurements,account1,sensor1,21.5,true
+,,0,2016-05-01T00:00:00Z,2016-05-02T00:00:00Z,2016-05-01T01:00:00Z,sensor_measurements,account1,sensor1,,false
+,,1,2016-05-01T00:00:00Z,2016-05-02T00:00:00Z,2016-05-01T00:30:00Z,sensor_measurements,account1,sensor2,19,
+
+#datatype,string,long,string,double
+#group,false,false,true,false
+#default,_result,,,
+,result,table,_field,_value
+,,2,humidity,40
+`
+
+func TestReadAnnotatedCSV(t *testing.T) {
+	rows, err := readFluxRows(strings.NewReader(annotatedCSV))
+
+	assert.Nil(t, err)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, []string{"time", "account_id", "sensor_id", "temperature", "door_open"}, rows[0].Columns)
+	assert.Equal(t, map[string]string{"account_id": "account1", "sensor_id": "sensor1"}, rows[0].Tags)
+	assert.Equal(t, [][]interface{}{
+		{"2016-05-01T00:00:00Z", "account1", "sensor1", json.Number("21.5"), true},
+		{"2016-05-01T01:00:00Z", "account1", "sensor1", nil, false},
+	}, rows[0].Values)
+	assert.Equal(t, "sensor2", rows[1].Tags["sensor_id"])
+	assert.Equal(t, []interface{}{"2016-05-01T00:30:00Z", "account1", "sensor2", json.Number("19"), nil}, rows[1].Values[0])
+	assert.Equal(t, []string{"_field", "_value"}, rows[2].Columns)
+	assert.Equal(t, []interface{}{"humidity", json.Number("40")}, rows[2].Values[0])
+}
+
+func TestReadAnnotatedCSVError(t *testing.T) {
+	_, err := readFluxRows(strings.NewReader(`#datatype,string,string
+#group,true,true
+#default,,
+,error,reference
+,"type error: unsupported input type for mean aggregate: boolean",
+`))
+
+	assert.EqualError(t, err, "type error: unsupported input type for mean aggregate: boolean")
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+)
+
+// crockfordAlphabet is the Crockford base32 alphabet, whose characters sort in
+// the same order as the values they encode
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newSortableID generates a 26-character unique ID in the ULID layout: a 48-bit
+// millisecond timestamp followed by 80 random bits. IDs generated later sort
+// lexically after earlier ones.
+func newSortableID(t time.Time) (string, error) {
+	var raw [16]byte
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		raw[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := io.ReadFull(rand.Reader, raw[6:]); err != nil {
+		return "", err
+	}
+	return encodeCrockford(raw), nil
+}
+
+// encodeCrockford encodes 128 bits as 26 base32 characters, most significant first
+func encodeCrockford(raw [16]byte) string {
+	var out [26]byte
+	// the 128-bit value is left-padded to 130 bits so it splits into 5-bit groups
+	for i := 0; i < 26; i++ {
+		bitOffset := i*5 - 2
+		var v byte
+		for b := 0; b < 5; b++ {
+			bit := bitOffset + b
+			if bit < 0 {
+				continue
+			}
+			if raw[bit/8]&(0x80>>uint(bit%8)) != 0 {
+				v |= 0x10 >> uint(b)
+			}
+		}
+		out[i] = crockfordAlphabet[v]
+	}
+	return string(out[:])
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSortableIDIsSortable(t *testing.T) {
+	now := time.Now()
+	first, err := newSortableID(now)
+	assert.NoError(t, err)
+	second, err := newSortableID(now.Add(time.Millisecond))
+	assert.NoError(t, err)
+
+	assert.Len(t, first, 26)
+	assert.True(t, first < second, "expected %s to sort before %s", first, second)
+}
+
+func TestNewSortableIDIsUnique(t *testing.T) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id, err := newSortableID(now)
+		assert.NoError(t, err)
+		assert.False(t, seen[id], "duplicate ID generated: %s", id)
+		seen[id] = true
+	}
+}
+
+func TestEncodeCrockford(t *testing.T) {
+	var raw [16]byte
+	assert.Equal(t, "00000000000000000000000000", encodeCrockford(raw))
+
+	for i := range raw {
+		raw[i] = 0xff
+	}
+	assert.Equal(t, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ", encodeCrockford(raw))
+
+	raw = [16]byte{15: 0x01}
+	assert.Equal(t, "00000000000000000000000001", encodeCrockford(raw))
+}
@@ -1,9 +1,14 @@
 package db
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
@@ -12,12 +17,161 @@ import (
 
 const (
 	sensorMeasurementsTableName = "sensor_measurements"
+	// SensorMeasurementsName is the InfluxDB measurement sensor readings are
+	// written to
+	SensorMeasurementsName = sensorMeasurementsTableName
+
+	// DefaultReadingsPageSize is the number of readings returned by a query
+	// that doesn't give a limit
+	DefaultReadingsPageSize = 1000
+	// MaxReadingsPageSize is the most readings a query may return at once
+	MaxReadingsPageSize = 10000
+
+	// maxSensorsPerReadingsQuery limits how many sensors' readings are
+	// requested in one query
+	maxSensorsPerReadingsQuery = 50
+
+	// maxPointsPerWrite limits how many readings are sent to InfluxDB in one
+	// write request
+	maxPointsPerWrite = 5000
+
+	// readingsChunkSize is the number of points InfluxDB returns in each chunk
+	// of a streamed readings query
+	readingsChunkSize = 10000
+
+	// maxConcurrentSensorQueries limits the queries in flight when sensors
+	// have to be queried individually
+	maxConcurrentSensorQueries = 8
+
+	// AggregateMean averages the measurements in each interval
+	AggregateMean = "mean"
+	// AggregateMin takes the smallest measurement in each interval
+	AggregateMin = "min"
+	// AggregateMax takes the largest measurement in each interval
+	AggregateMax = "max"
+	// AggregateFirst takes the earliest measurement in each interval
+	AggregateFirst = "first"
+	// AggregateLast takes the latest measurement in each interval
+	AggregateLast = "last"
+)
+
+var (
+	// ErrInvalidAggregation is returned when querying readings with an
+	// unsupported interval, aggregate or fill
+	ErrInvalidAggregation = errors.New("Invalid readings aggregation")
+	// ErrInvalidReading is returned when writing a reading without a timestamp
+	// or measurements, or with a value that doesn't match its measurement type
+	ErrInvalidReading = errors.New("Invalid reading")
+
+	readingsAggregates = map[string]bool{
+		AggregateMean:  true,
+		AggregateMin:   true,
+		AggregateMax:   true,
+		AggregateFirst: true,
+		AggregateLast:  true,
+	}
+	readingsFills = map[string]bool{
+		"none":     true,
+		"null":     true,
+		"previous": true,
+		"linear":   true,
+	}
+	// fillValuePattern matches the decimal numbers accepted as fill values,
+	// which are written into queries as they are given
+	fillValuePattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
 )
 
 // MeasurementsDatabase provides functions for retrieving sensor measurements
 type MeasurementsDatabase interface {
-	GetLastSensorReadings(string, string) (*LatestSensorReadings, error)
-	QueryForSensorReadings(string, string, int64, int64) (*QueryForSensorReadingsResults, error)
+	GetLastSensorReadings(string, string, bool, []string) (*LatestSensorReadings, error)
+	QueryForSensorReadings(string, string, int64, int64, *ReadingsQueryOptions) (*QueryForSensorReadingsResults, error)
+	QueryForMultipleSensorReadings(string, []string, int64, int64, *ReadingsQueryOptions) (map[string]*QueryForSensorReadingsResults, error)
+	GetSensorExtremes(string, string, int64, int64) ([]*MinMaxMeasurement, error)
+	GetDailySummaries(string, string, time.Time, time.Time) ([]*DailySummary, error)
+	DeleteSensorReadings(string, string) error
+	WriteSensorReadings(string, string, []*MinimalReading) error
+	WriteSensorPoints([]*SensorPoint) error
+	StreamSensorReadings(string, string, int64, int64, *ReadingsQueryOptions, ReadingsWriter) error
+}
+
+// ReadingsWriter receives sensor readings as they are streamed from the
+// database
+type ReadingsWriter interface {
+	// WriteColumns is called once, before any readings, with the measurements
+	// the readings may include
+	WriteColumns([]*MeasurementColumn) error
+	WriteReading(*MinimalReading) error
+	// Flush is called after each chunk of readings, so they can be passed on
+	// before the rest have been read
+	Flush() error
+}
+
+// MeasurementColumn names a measurement included in streamed readings
+type MeasurementColumn struct {
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+}
+
+// ReadingsQueryOptions controls how readings are returned when querying for
+// sensor readings
+type ReadingsQueryOptions struct {
+	// Interval groups readings into buckets of this duration, returning one
+	// reading per bucket. Zero returns every reading.
+	Interval time.Duration
+	// Aggregate is the function combining the measurements in each bucket
+	Aggregate string
+	// Fill is how buckets without readings are filled: none omits them, null
+	// returns them without measurements, and previous, linear or a number
+	// fill in their values
+	Fill string
+	// Limit is the most readings to return, up to MaxReadingsPageSize. Zero
+	// returns DefaultReadingsPageSize readings.
+	Limit int64
+	// Ascending returns the oldest readings first rather than the newest
+	Ascending bool
+	// Cursor continues a previous query from its NextCursor
+	Cursor string
+	// Measurements limits the readings to the named measurements. Empty
+	// returns every measurement.
+	Measurements []string
+}
+
+// pageSize returns the number of readings to return, applying the default
+// and maximum page sizes
+func (o *ReadingsQueryOptions) pageSize() int64 {
+	if o.Limit <= 0 {
+		return DefaultReadingsPageSize
+	} else if o.Limit > MaxReadingsPageSize {
+		return MaxReadingsPageSize
+	}
+	return o.Limit
+}
+
+// Validate checks the options are supported, returning ErrInvalidAggregation
+// if they aren't
+func (o *ReadingsQueryOptions) Validate() error {
+	if o.Interval == 0 {
+		if o.Aggregate != "" || o.Fill != "" {
+			return ErrInvalidAggregation
+		}
+		return nil
+	}
+	if o.Interval < time.Second || o.Interval%time.Second != 0 || !readingsAggregates[o.Aggregate] {
+		return ErrInvalidAggregation
+	}
+	if o.Fill != "" && !readingsFills[o.Fill] && !isFillValue(o.Fill) {
+		return ErrInvalidAggregation
+	}
+	return nil
+}
+
+// isFillValue reports whether a fill is a finite decimal number
+func isFillValue(fill string) bool {
+	if !fillValuePattern.MatchString(fill) {
+		return false
+	}
+	value, err := strconv.ParseFloat(fill, 64)
+	return err == nil && !math.IsNaN(value) && !math.IsInf(value, 0)
 }
 
 // InfluxDAO represents a DAO capable of interacting with InfluxDB
@@ -25,27 +179,60 @@ type InfluxDAO struct {
 	c             client.Client
 	databaseName  string
 	deviceManager DeviceManager
+	registry      *MeasurementRegistry
 }
 
-// NewInfluxDAO creates a new DAO for interacting with InfluxDB
-func NewInfluxDAO(address string, username string, password string, databaseName string, deviceManager DeviceManager) (*InfluxDAO, error) {
+// NewInfluxDAO creates a new DAO for interacting with InfluxDB. Requests,
+// including reading their responses, fail if they take longer than the
+// timeout.
+func NewInfluxDAO(address string, username string, password string, databaseName string, timeout time.Duration, deviceManager DeviceManager, registry *MeasurementRegistry) (*InfluxDAO, error) {
 	c, err := client.NewHTTPClient(client.HTTPConfig{
 		Addr:     address,
 		Username: username,
 		Password: password,
+		Timeout:  timeout,
 	})
-	return &InfluxDAO{c, databaseName, deviceManager}, err
+	return NewInfluxDAOWithClient(c, databaseName, deviceManager, registry), err
+}
+
+// NewInfluxDAOWithClient creates a new DAO that uses an existing InfluxDB client
+func NewInfluxDAOWithClient(c client.Client, databaseName string, deviceManager DeviceManager, registry *MeasurementRegistry) *InfluxDAO {
+	return &InfluxDAO{c, databaseName, deviceManager, registry}
 }
 
-// GetLastSensorReadings returns the latest sensor readings for the given account
-func (i *InfluxDAO) GetLastSensorReadings(accountID string, state string) (*LatestSensorReadings, error) {
+// GetLastSensorReadings returns the latest sensor readings for the given
+// account, fetching the last point of every sensor in a single query. If that
+// query fails the sensors are queried individually, and any sensors whose
+// readings still can't be retrieved are returned with an error and the
+// results marked as partial. If every sensor fails, the error of the account
+// query is returned instead. Measurements limits the readings to the named
+// measurements, or returns all of them if empty.
+func (i *InfluxDAO) GetLastSensorReadings(accountID string, state string, includeDeleted bool, measurements []string) (*LatestSensorReadings, error) {
 	var sensors []*Sensor
 	var err error
-	if sensors, err = i.deviceManager.GetSensors(accountID, state); err != nil {
+	if sensors, err = i.deviceManager.GetSensors(accountID, state, includeDeleted); err != nil {
 		return nil, err
 	}
 
-	latestReadings := &LatestSensorReadings{make(map[string]*SensorReading)}
+	if len(sensors) == 0 {
+		return &LatestSensorReadings{Sensors: make(map[string]*SensorReading)}, nil
+	}
+	lastRows, err := i.getLastReadingsForAccount(accountID, measurements)
+	rowErrors := make(map[string]error)
+	if err != nil {
+		lastRows, rowErrors = i.getLastReadingsForSensors(sensors, measurements)
+		if len(rowErrors) == len(sensors) {
+			return nil, err
+		}
+	}
+
+	return latestSensorReadings(i.registry, sensors, lastRows, rowErrors), nil
+}
+
+// latestSensorReadings pairs each sensor with its last point, or with the
+// error of its query, marking the results partial if any sensor failed
+func latestSensorReadings(registry *MeasurementRegistry, sensors []*Sensor, lastRows map[string]*models.Row, rowErrors map[string]error) *LatestSensorReadings {
+	latestReadings := &LatestSensorReadings{Sensors: make(map[string]*SensorReading)}
 	for _, sensor := range sensors {
 		reading := &SensorReading{
 			SensorID:  sensor.ID,
@@ -54,65 +241,77 @@ func (i *InfluxDAO) GetLastSensorReadings(accountID string, state string) (*Late
 			State:     sensor.State,
 		}
 
-		series, err := i.getLastReadingForSensor(sensor.ID, sensor.AccountID)
-		if err != nil {
-			return latestReadings, err
-		}
-
-		if series != nil {
-			reading.Measurements = make([]Measurement, 0)
-			for key, value := range series.Columns {
-				if strings.Contains(value, "time") {
-					var timestamp time.Time
-					timestamp, err = time.Parse(time.RFC3339, series.Values[0][key].(string))
-					if err != nil {
-						return latestReadings, err
-					}
-					reading.Timestamp = timestamp.Unix()
-				} else if strings.Contains(value, "temperature") {
-					var temperatureValue float64
-					temperatureValue, err = series.Values[0][key].(json.Number).Float64()
-					if err == nil {
-						reading.Measurements = append(reading.Measurements, Measurement{
-							Name:  value,
-							Unit:  "Celsius",
-							Value: temperatureValue,
-						})
-					}
-				} else if strings.Contains(value, "humidity") {
-					var humidityValue float64
-					humidityValue, err = series.Values[0][key].(json.Number).Float64()
-					if err == nil {
-						reading.Measurements = append(reading.Measurements, Measurement{
-							Name:  value,
-							Unit:  "%",
-							Value: humidityValue,
-						})
-					}
-				} else if strings.Contains(value, "soil_moisture") {
-					var soilMoistureValue float64
-					soilMoistureValue, err = series.Values[0][key].(json.Number).Float64()
-					if err == nil {
-						reading.Measurements = append(reading.Measurements, Measurement{
-							Name:  value,
-							Unit:  "VWC",
-							Value: soilMoistureValue,
-						})
-					}
-				}
+		if rowErr, ok := rowErrors[sensor.ID]; ok {
+			reading.Error = rowErr.Error()
+		} else if series, ok := lastRows[sensor.ID]; ok {
+			if rowErr = readLastRow(registry, reading, series); rowErr != nil {
+				reading.Error = rowErr.Error()
 			}
 		}
+		if reading.Error != "" {
+			reading.Measurements = nil
+			latestReadings.Partial = true
+		}
 		latestReadings.Sensors[reading.SensorID] = reading
 	}
 
-	return latestReadings, err
+	return latestReadings
+}
+
+// readLastRow sets the timestamp and measurements of a reading from the last
+// point of a sensor's series
+func readLastRow(registry *MeasurementRegistry, reading *SensorReading, series *models.Row) error {
+	reading.Measurements = make([]Measurement, 0)
+	for key, value := range series.Columns {
+		if key >= len(series.Values[0]) {
+			return fmt.Errorf("Series for sensor %s is missing column %s", reading.SensorID, value)
+		}
+		if value == "time" {
+			timeValue, ok := series.Values[0][key].(string)
+			if !ok {
+				return fmt.Errorf("Series for sensor %s has an invalid time", reading.SensorID)
+			}
+			timestamp, err := time.Parse(time.RFC3339, timeValue)
+			if err != nil {
+				return err
+			}
+			reading.Timestamp = timestamp.Unix()
+		} else if measurement, ok := registry.measurementFromColumn(value, series.Values[0][key]); ok {
+			reading.Measurements = append(reading.Measurements, measurement)
+		}
+	}
+	return nil
 }
 
 // QueryForSensorReadings returns sensor readings within an account
-func (i *InfluxDAO) QueryForSensorReadings(accountID, sensorID string, startTime, endTime int64) (*QueryForSensorReadingsResults, error) {
-	results := &QueryForSensorReadingsResults{accountID, sensorID, make([]*MinimalReading, 0)}
+func (i *InfluxDAO) QueryForSensorReadings(accountID, sensorID string, startTime, endTime int64, options *ReadingsQueryOptions) (*QueryForSensorReadingsResults, error) {
+	if options == nil {
+		options = &ReadingsQueryOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	results := &QueryForSensorReadingsResults{AccountID: accountID, SensorID: sensorID, Readings: make([]*MinimalReading, 0)}
+	limit := options.pageSize()
 
-	res, err := i.queryDB(fmt.Sprintf("SELECT * from %s where sensor_id = '%s' and account_id = '%s' and time >= '%s' and time <= '%s' order by time desc", sensorMeasurementsTableName, sensorID, accountID, time.Unix(startTime, 0).Format(time.RFC3339), time.Unix(endTime, 0).Format(time.RFC3339)))
+	query, columnPrefix := selectSensorReadings(accountID, []string{sensorID}, startTime, endTime, options)
+	query.limit(int(limit))
+	if options.Cursor != "" {
+		last, err := decodeReadingsCursor(options.Cursor, sensorID, !options.Ascending)
+		if err != nil {
+			return nil, err
+		}
+		// the time bucket of the cursor was on the previous page, and points
+		// after it would otherwise be grouped into that bucket again
+		if options.Ascending && options.Interval > 0 {
+			query.whereTime(">=", "cursor_time", last.Add(options.Interval))
+		} else if options.Ascending {
+			query.whereTime(">", "cursor_time", last)
+		} else {
+			query.whereTime("<", "cursor_time", last)
+		}
+	}
+	res, err := i.queryDB(query)
 	if err != nil {
 		return nil, err
 	}
@@ -120,77 +319,510 @@ func (i *InfluxDAO) QueryForSensorReadings(accountID, sensorID string, startTime
 		return results, nil
 	}
 
-	row := res[0].Series[0]
+	err = appendPageOfReadings(i.registry, results, &res[0].Series[0], columnPrefix, limit, !options.Ascending)
+	return results, err
+}
+
+// QueryForMultipleSensorReadings returns the readings of several sensors in an
+// account within the same time range, keyed by sensor ID. The sensors are
+// queried in batches of maxSensorsPerReadingsQuery, and the limit applies to
+// each sensor. The results can't be paged: the cursor of the options is not
+// used, and no next cursor is returned.
+func (i *InfluxDAO) QueryForMultipleSensorReadings(accountID string, sensorIDs []string, startTime, endTime int64, options *ReadingsQueryOptions) (map[string]*QueryForSensorReadingsResults, error) {
+	if options == nil {
+		options = &ReadingsQueryOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	sensorResults := make(map[string]*QueryForSensorReadingsResults)
+	for _, sensorID := range sensorIDs {
+		sensorResults[sensorID] = &QueryForSensorReadingsResults{AccountID: accountID, SensorID: sensorID, Readings: make([]*MinimalReading, 0)}
+	}
+	limit := options.pageSize()
+
+	for batchStart := 0; batchStart < len(sensorIDs); batchStart += maxSensorsPerReadingsQuery {
+		batchEnd := batchStart + maxSensorsPerReadingsQuery
+		if batchEnd > len(sensorIDs) {
+			batchEnd = len(sensorIDs)
+		}
+		// LIMIT applies to each series, so to each sensor when grouped by it
+		query, columnPrefix := selectSensorReadings(accountID, sensorIDs[batchStart:batchEnd], startTime, endTime, options)
+		res, err := i.queryDB(query.
+			groupByTag("sensor_id").
+			limit(int(limit)))
+		if err != nil {
+			return nil, err
+		}
+		if len(res) != 1 {
+			continue
+		}
+		for k := range res[0].Series {
+			row := &res[0].Series[k]
+			results, ok := sensorResults[row.Tags["sensor_id"]]
+			if !ok {
+				continue
+			}
+			if _, err = appendReadings(i.registry, results, row, columnPrefix); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sensorResults, nil
+}
+
+// appendPageOfReadings adds the readings in a row to the results of a single
+// sensor query, setting the cursor for the next page if the page is full
+func appendPageOfReadings(registry *MeasurementRegistry, results *QueryForSensorReadingsResults, row *models.Row, columnPrefix string, limit int64, descending bool) error {
+	last, err := appendReadings(registry, results, row, columnPrefix)
+	if err == nil && int64(len(results.Readings)) == limit {
+		results.NextCursor = encodeReadingsCursor(results.SensorID, descending, last)
+	}
+	return err
+}
 
+// appendReadings adds the readings in a row to the results of a sensor,
+// returning the full-precision time of the last one
+func appendReadings(registry *MeasurementRegistry, results *QueryForSensorReadingsResults, row *models.Row, columnPrefix string) (time.Time, error) {
+	var last time.Time
 	for _, rowValues := range row.Values {
-		rowReading := &MinimalReading{
-			Measurements: make([]Measurement, 0),
-		}
-		for k, v := range rowValues {
-			valueName := row.Columns[k]
-			if strings.Contains(valueName, "time") {
-				var timestamp time.Time
-				timestamp, err = time.Parse(time.RFC3339, v.(string))
-				if err != nil {
-					return results, err
-				}
-				rowReading.Timestamp = timestamp.Unix()
-			} else if strings.Contains(valueName, "temperature") {
-				var temperatureValue float64
-				temperatureValue, err = v.(json.Number).Float64()
-				if err == nil {
-					rowReading.Measurements = append(rowReading.Measurements, Measurement{
-						Name:  valueName,
-						Unit:  "Celsius",
-						Value: temperatureValue,
-					})
-				}
-			} else if strings.Contains(valueName, "humidity") {
-				var humidityValue float64
-				humidityValue, err = v.(json.Number).Float64()
-				if err == nil {
-					rowReading.Measurements = append(rowReading.Measurements, Measurement{
-						Name:  valueName,
-						Unit:  "%",
-						Value: humidityValue,
-					})
+		reading, readingTime, err := readingFromValues(registry, row.Columns, rowValues, columnPrefix)
+		if err != nil {
+			return last, err
+		}
+		results.Readings = append(results.Readings, reading)
+		last = readingTime
+	}
+	return last, nil
+}
+
+// StreamSensorReadings writes every sensor reading within a time range to the
+// writer as InfluxDB returns them in chunks, without holding more than one
+// chunk in memory. The limit and cursor of the options are not used.
+func (i *InfluxDAO) StreamSensorReadings(accountID, sensorID string, startTime, endTime int64, options *ReadingsQueryOptions, w ReadingsWriter) error {
+	if options == nil {
+		options = &ReadingsQueryOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	query, columnPrefix := selectSensorReadings(accountID, []string{sensorID}, startTime, endTime, options)
+	q := query.build(i.databaseName)
+	q.Chunked = true
+	q.ChunkSize = readingsChunkSize
+	response, err := i.c.QueryAsChunk(q)
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+
+	columnsWritten := false
+	for {
+		chunk, err := response.NextResponse()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err = chunk.Error(); err != nil {
+			return err
+		}
+		for _, result := range chunk.Results {
+			for _, row := range result.Series {
+				if !columnsWritten {
+					if err = w.WriteColumns(measurementColumns(i.registry, row.Columns, columnPrefix)); err != nil {
+						return err
+					}
+					columnsWritten = true
 				}
-			} else if strings.Contains(valueName, "soil_moisture") {
-				var soilMoistureValue float64
-				soilMoistureValue, err = v.(json.Number).Float64()
-				if err == nil {
-					rowReading.Measurements = append(rowReading.Measurements, Measurement{
-						Name:  valueName,
-						Unit:  "VWC",
-						Value: soilMoistureValue,
-					})
+				for _, rowValues := range row.Values {
+					reading, _, err := readingFromValues(i.registry, row.Columns, rowValues, columnPrefix)
+					if err != nil {
+						return err
+					}
+					if err = w.WriteReading(reading); err != nil {
+						return err
+					}
 				}
 			}
 		}
-		results.Readings = append(results.Readings, rowReading)
+		if err = w.Flush(); err != nil {
+			return err
+		}
 	}
-	return results, err
+	if !columnsWritten {
+		return w.WriteColumns(make([]*MeasurementColumn, 0))
+	}
+	return nil
+}
+
+// readingFromValues converts the values of one row of a readings query to a
+// reading, returning the full-precision time of the row as well
+func readingFromValues(registry *MeasurementRegistry, columns []string, values []interface{}, columnPrefix string) (*MinimalReading, time.Time, error) {
+	var timestamp time.Time
+	reading := &MinimalReading{
+		Measurements: make([]Measurement, 0),
+	}
+	for k, v := range values {
+		if k >= len(columns) {
+			break
+		}
+		if columns[k] == "time" {
+			timeValue, ok := v.(string)
+			if !ok {
+				return nil, timestamp, fmt.Errorf("Reading has an invalid time: %v", v)
+			}
+			var err error
+			if timestamp, err = time.Parse(time.RFC3339Nano, timeValue); err != nil {
+				return nil, timestamp, err
+			}
+			reading.Timestamp = timestamp.Unix()
+		} else if measurement, ok := registry.measurementFromColumn(strings.TrimPrefix(columns[k], columnPrefix), v); ok {
+			reading.Measurements = append(reading.Measurements, measurement)
+		}
+	}
+	return reading, timestamp, nil
 }
 
-func (i *InfluxDAO) getLastReadingForSensor(sensorID string, accountID string) (*models.Row, error) {
-	res, err := i.queryDB(fmt.Sprintf("SELECT * from %s where sensor_id = '%s' and account_id = '%s' order by time desc limit 1", sensorMeasurementsTableName, sensorID, accountID))
+// measurementColumns names the measurements in the columns of a readings
+// query, with the units of their measurement types
+func measurementColumns(registry *MeasurementRegistry, columns []string, columnPrefix string) []*MeasurementColumn {
+	measurementColumns := make([]*MeasurementColumn, 0, len(columns))
+	for _, column := range columns {
+		if measurementTagColumns[column] {
+			continue
+		}
+		measurementColumn := &MeasurementColumn{Name: strings.TrimPrefix(column, columnPrefix)}
+		if t := registry.Lookup(measurementColumn.Name); t != nil {
+			measurementColumn.Unit = t.Unit
+		}
+		measurementColumns = append(measurementColumns, measurementColumn)
+	}
+	return measurementColumns
+}
+
+// GetSensorExtremes returns the smallest and largest value of each numeric
+// measurement of a sensor within a time range, with the time each occurred
+func (i *InfluxDAO) GetSensorExtremes(accountID, sensorID string, startTime, endTime int64) ([]*MinMaxMeasurement, error) {
+	extremes := make([]*MinMaxMeasurement, 0)
+	fields, err := i.getNumericFields()
+	if err != nil || len(fields) == 0 {
+		return extremes, err
+	}
+
+	// one min and one max selector per field, all sent in a single request
+	queries := make([]*influxQuery, 0, 2*len(fields))
+	for _, field := range fields {
+		for _, selector := range []string{AggregateMin, AggregateMax} {
+			queries = append(queries, newInfluxQuery(fmt.Sprintf("SELECT %s(%s) FROM %s", selector, quoteIdentifier(field), quoteIdentifier(sensorMeasurementsTableName))).
+				whereTagEquals("sensor_id", sensorID).
+				whereTagEquals("account_id", accountID).
+				whereTimeBetween(time.Unix(startTime, 0), time.Unix(endTime, 0)))
+		}
+	}
+	res, err := i.queryDB(batchInfluxQueries(queries...))
 	if err != nil {
 		return nil, err
 	}
-	if len(res) != 1 || res[0].Series == nil {
+
+	for k, field := range fields {
+		if 2*k+1 >= len(res) {
+			break
+		}
+		min, okMin, err := selectorMeasurement(i.registry, field, res[2*k])
+		if err != nil {
+			return nil, err
+		}
+		max, okMax, err := selectorMeasurement(i.registry, field, res[2*k+1])
+		if err != nil {
+			return nil, err
+		}
+		if okMin && okMax {
+			extremes = append(extremes, &MinMaxMeasurement{Name: field, Min: min, Max: max})
+		}
+	}
+	return extremes, nil
+}
+
+// getNumericFields lists the float and integer fields of sensor measurements
+func (i *InfluxDAO) getNumericFields() ([]string, error) {
+	res, err := i.queryDB(newInfluxQuery("SHOW FIELD KEYS FROM " + quoteIdentifier(sensorMeasurementsTableName)))
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, 0)
+	if len(res) != 1 || len(res[0].Series) == 0 {
+		return fields, nil
+	}
+	for _, values := range res[0].Series[0].Values {
+		if len(values) < 2 {
+			continue
+		}
+		fieldKey, _ := values[0].(string)
+		fieldType, _ := values[1].(string)
+		if fieldKey != "" && (fieldType == "float" || fieldType == "integer") {
+			fields = append(fields, fieldKey)
+		}
+	}
+	return fields, nil
+}
+
+// selectorMeasurement reads the point chosen by a selector such as min or max,
+// returning false if the field had no points
+func selectorMeasurement(registry *MeasurementRegistry, field string, result client.Result) (Measurement, bool, error) {
+	if len(result.Series) == 0 || len(result.Series[0].Values) == 0 || len(result.Series[0].Values[0]) < 2 {
+		return Measurement{}, false, nil
+	}
+	values := result.Series[0].Values[0]
+	measurement, ok := registry.measurementFromColumn(field, values[1])
+	if !ok {
+		return measurement, false, nil
+	}
+	timeValue, ok := values[0].(string)
+	if !ok {
+		return measurement, false, fmt.Errorf("Extreme of %s has an invalid time: %v", field, values[0])
+	}
+	timestamp, err := time.Parse(time.RFC3339, timeValue)
+	if err != nil {
+		return measurement, false, err
+	}
+	measurement.Timestamp = timestamp.Unix()
+	return measurement, true, nil
+}
+
+// DeleteSensorReadings purges all readings recorded for a sensor
+func (i *InfluxDAO) DeleteSensorReadings(accountID, sensorID string) error {
+	_, err := i.queryDB(newInfluxQuery("DROP SERIES FROM "+quoteIdentifier(sensorMeasurementsTableName)).
+		whereTagEquals("sensor_id", sensorID).
+		whereTagEquals("account_id", accountID))
+	return err
+}
+
+// WriteSensorReadings records readings of a sensor, tagged with its account
+// and sensor IDs. Every reading is checked before any are written, returning
+// ErrInvalidReading if one can't be stored.
+func (i *InfluxDAO) WriteSensorReadings(accountID, sensorID string, readings []*MinimalReading) error {
+	points, err := sensorPointsFromReadings(i.registry, accountID, sensorID, readings)
+	if err != nil {
+		return err
+	}
+	return i.WriteSensorPoints(points)
+}
+
+// sensorPointsFromReadings converts readings of a sensor to points tagged with
+// its account and sensor IDs, returning ErrInvalidReading if a reading has no
+// timestamp or a measurement that can't be stored in the unit of its type
+func sensorPointsFromReadings(registry *MeasurementRegistry, accountID, sensorID string, readings []*MinimalReading) ([]*SensorPoint, error) {
+	tags := map[string]string{"account_id": accountID, "sensor_id": sensorID}
+	points := make([]*SensorPoint, 0, len(readings))
+	for _, reading := range readings {
+		if reading == nil || reading.Timestamp <= 0 {
+			return nil, ErrInvalidReading
+		}
+		fields := make(map[string]interface{}, len(reading.Measurements))
+		for _, measurement := range reading.Measurements {
+			value, ok := registry.fieldValue(measurement)
+			if !ok {
+				return nil, ErrInvalidReading
+			}
+			fields[measurement.Name] = value
+		}
+		points = append(points, &SensorPoint{sensorMeasurementsTableName, tags, fields, time.Unix(reading.Timestamp, 0)})
+	}
+	return points, nil
+}
+
+// WriteSensorPoints records points in the sensor measurements, converting each
+// field to the value type of its measurement. Every point must be tagged with
+// an account and sensor ID, and is checked before any are written, returning
+// ErrInvalidReading if one can't be stored. The points are then written in
+// batches of maxPointsPerWrite.
+func (i *InfluxDAO) WriteSensorPoints(points []*SensorPoint) error {
+	clientPoints, err := newClientPoints(i.registry, points)
+	if err != nil {
+		return err
+	}
+
+	for batchStart := 0; batchStart < len(clientPoints); batchStart += maxPointsPerWrite {
+		batchEnd := batchStart + maxPointsPerWrite
+		if batchEnd > len(clientPoints) {
+			batchEnd = len(clientPoints)
+		}
+		batch, err := client.NewBatchPoints(client.BatchPointsConfig{Database: i.databaseName, Precision: "ns"})
+		if err != nil {
+			return err
+		}
+		batch.AddPoints(clientPoints[batchStart:batchEnd])
+		if err = i.c.Write(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newClientPoints checks points can be stored in the sensor measurements and
+// converts each field to the value type of its measurement, returning
+// ErrInvalidReading if a point isn't tagged with an account and sensor ID or
+// has a field that doesn't match its measurement type
+func newClientPoints(registry *MeasurementRegistry, points []*SensorPoint) ([]*client.Point, error) {
+	clientPoints := make([]*client.Point, 0, len(points))
+	for _, p := range points {
+		if p.Measurement != sensorMeasurementsTableName || p.Tags["account_id"] == "" || p.Tags["sensor_id"] == "" || len(p.Fields) == 0 {
+			return nil, ErrInvalidReading
+		}
+		fields := make(map[string]interface{}, len(p.Fields))
+		for name, value := range p.Fields {
+			fieldValue, ok := registry.typedFieldValue(name, value)
+			if !ok {
+				return nil, ErrInvalidReading
+			}
+			fields[name] = fieldValue
+		}
+		clientPoint, err := client.NewPoint(sensorMeasurementsTableName, p.Tags, fields, p.Time)
+		if err != nil {
+			return nil, err
+		}
+		clientPoints = append(clientPoints, clientPoint)
+	}
+	return clientPoints, nil
+}
+
+// getLastReadingsForAccount returns the last point of each sensor in an
+// account, keyed by sensor ID
+func (i *InfluxDAO) getLastReadingsForAccount(accountID string, measurements []string) (map[string]*models.Row, error) {
+	res, err := i.queryDB(newInfluxQuery(fmt.Sprintf("SELECT %s FROM %s", fieldProjection(measurements), quoteIdentifier(sensorMeasurementsTableName))).
+		whereTagEquals("account_id", accountID).
+		groupByTag("sensor_id").
+		orderByTimeDesc().
+		limit(1))
+	if err != nil {
+		return nil, err
+	}
+
+	lastRows := make(map[string]*models.Row)
+	if len(res) != 1 {
 		// the query returned no rows, must be empty
-		return nil, nil
+		return lastRows, nil
 	}
-	return &res[0].Series[0], err
+	for k := range res[0].Series {
+		row := &res[0].Series[k]
+		if sensorID, ok := row.Tags["sensor_id"]; ok && len(row.Values) > 0 {
+			lastRows[sensorID] = row
+		}
+	}
+	return lastRows, nil
 }
 
-// queryDB convenience function to query the database
-func (i *InfluxDAO) queryDB(cmd string) (res []client.Result, err error) {
-	q := client.Query{
-		Command:  cmd,
-		Database: i.databaseName,
+// getLastReadingsForSensors queries the last point of each sensor separately,
+// a few at a time, returning the points found and the errors of any sensors
+// whose queries failed
+func (i *InfluxDAO) getLastReadingsForSensors(sensors []*Sensor, measurements []string) (map[string]*models.Row, map[string]error) {
+	return lastRowsForSensors(sensors, func(sensor *Sensor) (*models.Row, error) {
+		res, err := i.queryDB(selectSensorMeasurements(sensor.AccountID, sensor.ID, measurements).
+			orderByTimeDesc().
+			limit(1))
+		if err != nil || len(res) != 1 || len(res[0].Series) == 0 || len(res[0].Series[0].Values) == 0 {
+			return nil, err
+		}
+		return &res[0].Series[0], nil
+	})
+}
+
+// lastRowsForSensors runs a query for the last point of each sensor, at most
+// maxConcurrentSensorQueries at a time, returning the points found and the
+// errors of any sensors whose queries failed
+func lastRowsForSensors(sensors []*Sensor, queryLastRow func(*Sensor) (*models.Row, error)) (map[string]*models.Row, map[string]error) {
+	lastRows := make(map[string]*models.Row)
+	rowErrors := make(map[string]error)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, maxConcurrentSensorQueries)
+	for _, sensor := range sensors {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(sensor *Sensor) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			row, err := queryLastRow(sensor)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				rowErrors[sensor.ID] = err
+			} else if row != nil {
+				lastRows[sensor.ID] = row
+			}
+		}(sensor)
+	}
+	wg.Wait()
+	return lastRows, rowErrors
+}
+
+// selectSensorReadings builds the query for the readings of one or more
+// sensors within a time range, returning the prefix of the measurement columns
+// of aggregated readings
+func selectSensorReadings(accountID string, sensorIDs []string, startTime, endTime int64, options *ReadingsQueryOptions) (*influxQuery, string) {
+	projection := fieldProjection(options.Measurements)
+	columnPrefix := ""
+	if options.Interval > 0 {
+		projection = aggregateProjection(options.Aggregate, options.Measurements)
+		// aggregated columns are named after the function, e.g. mean_temperature
+		columnPrefix = options.Aggregate + "_"
+	}
+	query := newInfluxQuery(fmt.Sprintf("SELECT %s FROM %s", projection, quoteIdentifier(sensorMeasurementsTableName))).
+		whereTagIn("sensor_id", sensorIDs).
+		whereTagEquals("account_id", accountID).
+		whereTimeBetween(time.Unix(startTime, 0), time.Unix(endTime, 0))
+	if options.Interval > 0 {
+		query.groupByTime(options.Interval).
+			fillWith(options.Fill)
+	}
+	if options.Ascending {
+		query.orderByTimeAsc()
+	} else {
+		query.orderByTimeDesc()
 	}
-	if response, err := i.c.Query(q); err == nil {
+	return query, columnPrefix
+}
+
+// selectSensorMeasurements starts a query for the given measurements of a
+// sensor, or all of them if none are given
+func selectSensorMeasurements(accountID, sensorID string, measurements []string) *influxQuery {
+	return newInfluxQuery(fmt.Sprintf("SELECT %s FROM %s", fieldProjection(measurements), quoteIdentifier(sensorMeasurementsTableName))).
+		whereTagEquals("sensor_id", sensorID).
+		whereTagEquals("account_id", accountID)
+}
+
+// aggregateProjection applies an aggregate function to the given fields, or
+// all of them if none are given. Either way the columns are named after the
+// function, e.g. mean_temperature.
+func aggregateProjection(aggregate string, measurements []string) string {
+	if len(measurements) == 0 {
+		return aggregate + "(*)"
+	}
+	fields := make([]string, len(measurements))
+	for k, measurement := range measurements {
+		fields[k] = fmt.Sprintf("%s(%s) AS %s", aggregate, quoteIdentifier(measurement), quoteIdentifier(aggregate+"_"+measurement))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// fieldProjection lists the fields to select, or * for all of them
+func fieldProjection(measurements []string) string {
+	if len(measurements) == 0 {
+		return "*"
+	}
+	fields := make([]string, len(measurements))
+	for k, measurement := range measurements {
+		fields[k] = quoteIdentifier(measurement)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// queryDB convenience function to query the database
+func (i *InfluxDAO) queryDB(query *influxQuery) (res []client.Result, err error) {
+	if response, err := i.c.Query(query.build(i.databaseName)); err == nil {
 		if response.Error() != nil {
 			return res, response.Error()
 		}
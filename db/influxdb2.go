@@ -0,0 +1,489 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// FluxDAO represents a DAO capable of interacting with InfluxDB 2.x, querying
+// the sensor measurements in a bucket with Flux over the v2 HTTP API
+type FluxDAO struct {
+	httpClient    *http.Client
+	address       string
+	org           string
+	bucket        string
+	token         string
+	deviceManager DeviceManager
+	registry      *MeasurementRegistry
+}
+
+// fluxQueryRequest is the body of a request to the v2 query API
+type fluxQueryRequest struct {
+	Query   string      `json:"query"`
+	Type    string      `json:"type"`
+	Dialect fluxDialect `json:"dialect"`
+}
+
+// fluxDialect asks for query results in annotated CSV
+type fluxDialect struct {
+	Header      bool     `json:"header"`
+	Annotations []string `json:"annotations"`
+	Delimiter   string   `json:"delimiter"`
+}
+
+// fluxDeleteRequest is the body of a request to the v2 delete API
+type fluxDeleteRequest struct {
+	Start     string `json:"start"`
+	Stop      string `json:"stop"`
+	Predicate string `json:"predicate"`
+}
+
+// fluxAPIError is the body of an unsuccessful response from the v2 API
+type fluxAPIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewFluxDAO creates a new DAO for interacting with InfluxDB 2.x, using an API
+// token with access to the bucket in the organization. Requests, including
+// reading their responses, fail if they take longer than the timeout.
+func NewFluxDAO(address string, org string, bucket string, token string, timeout time.Duration, deviceManager DeviceManager, registry *MeasurementRegistry) (*FluxDAO, error) {
+	u, err := url.Parse(address)
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = fmt.Errorf("Unsupported protocol scheme: %s", u.Scheme)
+	}
+	return NewFluxDAOWithClient(&http.Client{Timeout: timeout}, address, org, bucket, token, deviceManager, registry), err
+}
+
+// NewFluxDAOWithClient creates a new DAO that sends requests to InfluxDB 2.x
+// with an existing HTTP client
+func NewFluxDAOWithClient(httpClient *http.Client, address string, org string, bucket string, token string, deviceManager DeviceManager, registry *MeasurementRegistry) *FluxDAO {
+	return &FluxDAO{httpClient, strings.TrimRight(address, "/"), org, bucket, token, deviceManager, registry}
+}
+
+// GetLastSensorReadings returns the latest sensor readings for the given
+// account, fetching the last point of every sensor in a single query. If that
+// query fails the sensors are queried individually, and any sensors whose
+// readings still can't be retrieved are returned with an error and the
+// results marked as partial. If every sensor fails, the error of the account
+// query is returned instead. Measurements limits the readings to the named
+// measurements, or returns all of them if empty.
+func (f *FluxDAO) GetLastSensorReadings(accountID string, state string, includeDeleted bool, measurements []string) (*LatestSensorReadings, error) {
+	var sensors []*Sensor
+	var err error
+	if sensors, err = f.deviceManager.GetSensors(accountID, state, includeDeleted); err != nil {
+		return nil, err
+	}
+
+	if len(sensors) == 0 {
+		return &LatestSensorReadings{Sensors: make(map[string]*SensorReading)}, nil
+	}
+	lastRows, err := f.getLastReadingsForAccount(accountID, measurements)
+	rowErrors := make(map[string]error)
+	if err != nil {
+		lastRows, rowErrors = lastRowsForSensors(sensors, func(sensor *Sensor) (*models.Row, error) {
+			rows, err := f.queryRows(f.selectLastReadings(sensor.AccountID, measurements).
+				whereTagEquals("sensor_id", sensor.ID).
+				pivotBySensor().
+				orderByTimeDesc().
+				limit(1).
+				script())
+			if err != nil || len(rows) == 0 || len(rows[0].Values) == 0 {
+				return nil, err
+			}
+			return rows[0], nil
+		})
+		if len(rowErrors) == len(sensors) {
+			return nil, err
+		}
+	}
+
+	return latestSensorReadings(f.registry, sensors, lastRows, rowErrors), nil
+}
+
+// getLastReadingsForAccount returns the last point of each sensor in an
+// account, keyed by sensor ID
+func (f *FluxDAO) getLastReadingsForAccount(accountID string, measurements []string) (map[string]*models.Row, error) {
+	rows, err := f.queryRows(f.selectLastReadings(accountID, measurements).
+		pivotBySensor().
+		orderByTimeDesc().
+		limit(1).
+		script())
+	if err != nil {
+		return nil, err
+	}
+
+	lastRows := make(map[string]*models.Row)
+	for _, row := range rows {
+		if sensorID, ok := row.Tags["sensor_id"]; ok && len(row.Values) > 0 {
+			lastRows[sensorID] = row
+		}
+	}
+	return lastRows, nil
+}
+
+// selectLastReadings starts a query for the last point of each field of the
+// sensors in an account, for the given measurements or all of them if none are
+// given
+func (f *FluxDAO) selectLastReadings(accountID string, measurements []string) *fluxQuery {
+	return newFluxQuery(f.bucket, fluxMinTime, fluxMaxTime).
+		whereTagEquals("account_id", accountID).
+		whereFieldIn(measurements).
+		pipe("last()")
+}
+
+// QueryForSensorReadings returns sensor readings within an account
+func (f *FluxDAO) QueryForSensorReadings(accountID, sensorID string, startTime, endTime int64, options *ReadingsQueryOptions) (*QueryForSensorReadingsResults, error) {
+	if options == nil {
+		options = &ReadingsQueryOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	results := &QueryForSensorReadingsResults{AccountID: accountID, SensorID: sensorID, Readings: make([]*MinimalReading, 0)}
+	limit := options.pageSize()
+
+	start, stop := readingsRange(startTime, endTime)
+	if options.Cursor != "" {
+		last, err := decodeReadingsCursor(options.Cursor, sensorID, !options.Ascending)
+		if err != nil {
+			return nil, err
+		}
+		// narrowing the range rather than filtering keeps aggregation windows
+		// aligned with the previous page
+		if !options.Ascending {
+			stop = last
+		} else if options.Interval > 0 {
+			start = last.Add(options.Interval)
+		} else {
+			start = last.Add(time.Nanosecond)
+		}
+	}
+	if !stop.After(start) {
+		return results, nil
+	}
+	rows, err := f.queryRows(f.selectSensorReadings(accountID, []string{sensorID}, start, stop, options).
+		limit(int(limit)).
+		script())
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return results, nil
+	}
+
+	err = appendPageOfReadings(f.registry, results, rows[0], "", limit, !options.Ascending)
+	return results, err
+}
+
+// QueryForMultipleSensorReadings returns the readings of several sensors in an
+// account within the same time range, keyed by sensor ID. The sensors are
+// queried in batches of maxSensorsPerReadingsQuery, and the limit applies to
+// each sensor. The results can't be paged: the cursor of the options is not
+// used, and no next cursor is returned.
+func (f *FluxDAO) QueryForMultipleSensorReadings(accountID string, sensorIDs []string, startTime, endTime int64, options *ReadingsQueryOptions) (map[string]*QueryForSensorReadingsResults, error) {
+	if options == nil {
+		options = &ReadingsQueryOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	sensorResults := make(map[string]*QueryForSensorReadingsResults)
+	for _, sensorID := range sensorIDs {
+		sensorResults[sensorID] = &QueryForSensorReadingsResults{AccountID: accountID, SensorID: sensorID, Readings: make([]*MinimalReading, 0)}
+	}
+	limit := options.pageSize()
+	start, stop := readingsRange(startTime, endTime)
+	if !stop.After(start) {
+		return sensorResults, nil
+	}
+
+	for batchStart := 0; batchStart < len(sensorIDs); batchStart += maxSensorsPerReadingsQuery {
+		batchEnd := batchStart + maxSensorsPerReadingsQuery
+		if batchEnd > len(sensorIDs) {
+			batchEnd = len(sensorIDs)
+		}
+		// the readings are pivoted into a table per sensor, which limit applies to
+		rows, err := f.queryRows(f.selectSensorReadings(accountID, sensorIDs[batchStart:batchEnd], start, stop, options).
+			limit(int(limit)).
+			script())
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			results, ok := sensorResults[row.Tags["sensor_id"]]
+			if !ok {
+				continue
+			}
+			if _, err = appendReadings(f.registry, results, row, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sensorResults, nil
+}
+
+// StreamSensorReadings writes every sensor reading within a time range to the
+// writer as InfluxDB returns them, without holding the results in memory. The
+// limit and cursor of the options are not used.
+func (f *FluxDAO) StreamSensorReadings(accountID, sensorID string, startTime, endTime int64, options *ReadingsQueryOptions, w ReadingsWriter) error {
+	if options == nil {
+		options = &ReadingsQueryOptions{}
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	// Flux responses aren't chunked, so the readings are flushed in chunks of
+	// the size InfluxQL streams them in
+	columnsWritten := false
+	readingsWritten := 0
+	start, stop := readingsRange(startTime, endTime)
+	if stop.After(start) {
+		query := f.selectSensorReadings(accountID, []string{sensorID}, start, stop, options)
+		err := f.query(query.script(), func(r io.Reader) error {
+			return readAnnotatedCSV(r, func(table *fluxTable, values []interface{}) error {
+				if !columnsWritten {
+					if err := w.WriteColumns(measurementColumns(f.registry, table.columns, "")); err != nil {
+						return err
+					}
+					columnsWritten = true
+				}
+				reading, _, err := readingFromValues(f.registry, table.columns, values, "")
+				if err != nil {
+					return err
+				}
+				if err = w.WriteReading(reading); err != nil {
+					return err
+				}
+				if readingsWritten++; readingsWritten%readingsChunkSize == 0 {
+					return w.Flush()
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !columnsWritten {
+		return w.WriteColumns(make([]*MeasurementColumn, 0))
+	}
+	return nil
+}
+
+// selectSensorReadings builds the query for the readings of one or more
+// sensors from start up to but not including stop, with a table of readings
+// for each sensor. Aggregated measurements keep the names of their fields.
+func (f *FluxDAO) selectSensorReadings(accountID string, sensorIDs []string, start, stop time.Time, options *ReadingsQueryOptions) *fluxQuery {
+	query := newFluxQuery(f.bucket, start, stop).
+		whereTagEquals("account_id", accountID).
+		whereTagIn("sensor_id", sensorIDs).
+		whereFieldIn(options.Measurements)
+	if options.Interval > 0 {
+		query.aggregateWindow(options.Interval, options.Aggregate, options.Fill)
+	}
+	query.pivotBySensor()
+	if options.Ascending {
+		query.orderByTimeAsc()
+	} else {
+		query.orderByTimeDesc()
+	}
+	return query
+}
+
+// GetSensorExtremes returns the smallest and largest value of each numeric
+// measurement of a sensor within a time range
+func (f *FluxDAO) GetSensorExtremes(accountID, sensorID string, startTime, endTime int64) ([]*MinMaxMeasurement, error) {
+	extremes := make([]*MinMaxMeasurement, 0)
+	start, stop := readingsRange(startTime, endTime)
+	if !stop.After(start) {
+		return extremes, nil
+	}
+
+	data := newFluxQuery(f.bucket, start, stop).
+		whereTagEquals("account_id", accountID).
+		whereTagEquals("sensor_id", sensorID).
+		whereNumeric().
+		pipe(`group(columns: ["_field"])`)
+	rows, err := f.queryRows(data.script(
+		"data = "+data.pipeline(),
+		fluxUnion([]string{
+			`data |> min() |> set(key: "selector", value: "min")`,
+			`data |> max() |> set(key: "selector", value: "max")`,
+		})))
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*MinMaxMeasurement)
+	for _, row := range rows {
+		for _, values := range row.Values {
+			field, _ := rowColumn(row, values, "_field").(string)
+			measurement, ok := f.registry.measurementFromColumn(field, rowColumn(row, values, "_value"))
+			if !ok {
+				continue
+			}
+			timeValue, _ := rowColumn(row, values, "time").(string)
+			timestamp, err := time.Parse(time.RFC3339, timeValue)
+			if err != nil {
+				return nil, err
+			}
+			measurement.Timestamp = timestamp.Unix()
+
+			extreme, ok := byName[field]
+			if !ok {
+				extreme = &MinMaxMeasurement{Name: field}
+				byName[field] = extreme
+			}
+			switch rowColumn(row, values, "selector") {
+			case AggregateMin:
+				extreme.Min = measurement
+			case AggregateMax:
+				extreme.Max = measurement
+			}
+		}
+	}
+	for _, extreme := range byName {
+		if extreme.Min.Name != "" && extreme.Max.Name != "" {
+			extremes = append(extremes, extreme)
+		}
+	}
+	sort.Slice(extremes, func(a, b int) bool { return extremes[a].Name < extremes[b].Name })
+	return extremes, nil
+}
+
+// DeleteSensorReadings purges all readings recorded for a sensor
+func (f *FluxDAO) DeleteSensorReadings(accountID, sensorID string) error {
+	body, err := json.Marshal(&fluxDeleteRequest{
+		Start: fluxTime(fluxMinTime),
+		Stop:  fluxTime(fluxMaxTime),
+		// delete predicates quote values the way InfluxQL quotes identifiers
+		Predicate: fmt.Sprintf("_measurement=%s AND sensor_id=%s AND account_id=%s",
+			quoteIdentifier(sensorMeasurementsTableName), quoteIdentifier(sensorID), quoteIdentifier(accountID)),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := f.post("delete", url.Values{"bucket": {f.bucket}}, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// WriteSensorReadings records readings of a sensor, tagged with its account
+// and sensor IDs. Every reading is checked before any are written, returning
+// ErrInvalidReading if one can't be stored.
+func (f *FluxDAO) WriteSensorReadings(accountID, sensorID string, readings []*MinimalReading) error {
+	points, err := sensorPointsFromReadings(f.registry, accountID, sensorID, readings)
+	if err != nil {
+		return err
+	}
+	return f.WriteSensorPoints(points)
+}
+
+// WriteSensorPoints records points in the sensor measurements, converting each
+// field to the value type of its measurement. Every point must be tagged with
+// an account and sensor ID, and is checked before any are written, returning
+// ErrInvalidReading if one can't be stored. The points are then written in
+// batches of maxPointsPerWrite.
+func (f *FluxDAO) WriteSensorPoints(points []*SensorPoint) error {
+	clientPoints, err := newClientPoints(f.registry, points)
+	if err != nil {
+		return err
+	}
+
+	for batchStart := 0; batchStart < len(clientPoints); batchStart += maxPointsPerWrite {
+		batchEnd := batchStart + maxPointsPerWrite
+		if batchEnd > len(clientPoints) {
+			batchEnd = len(clientPoints)
+		}
+		var lines bytes.Buffer
+		for _, p := range clientPoints[batchStart:batchEnd] {
+			lines.WriteString(p.String())
+			lines.WriteByte('\n')
+		}
+		resp, err := f.post("write", url.Values{"bucket": {f.bucket}, "precision": {"ns"}}, "text/plain; charset=utf-8", &lines)
+		if err != nil {
+			return err
+		}
+		if err = resp.Body.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryRows runs a Flux query, returning each table of the results as a row
+func (f *FluxDAO) queryRows(script string) (rows []*models.Row, err error) {
+	err = f.query(script, func(r io.Reader) error {
+		rows, err = readFluxRows(r)
+		return err
+	})
+	return rows, err
+}
+
+// query runs a Flux query, passing the annotated CSV of the results to read as
+// it arrives
+func (f *FluxDAO) query(script string, read func(io.Reader) error) error {
+	body, err := json.Marshal(&fluxQueryRequest{
+		Query: script,
+		Type:  "flux",
+		Dialect: fluxDialect{
+			Header:      true,
+			Annotations: []string{"datatype", "group", "default"},
+			Delimiter:   ",",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := f.post("query", url.Values{}, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return read(resp.Body)
+}
+
+// post sends a request to an endpoint of the v2 API for the organization,
+// returning an error with the message of any unsuccessful response
+func (f *FluxDAO) post(endpoint string, params url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	params.Set("org", f.org)
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v2/%s?%s", f.address, endpoint, params.Encode()), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Token "+f.token)
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var apiError fluxAPIError
+		if json.NewDecoder(resp.Body).Decode(&apiError) != nil || apiError.Message == "" {
+			return nil, fmt.Errorf("InfluxDB returned %s", resp.Status)
+		}
+		return nil, fmt.Errorf("InfluxDB returned %s: %s", resp.Status, apiError.Message)
+	}
+	return resp, nil
+}
+
+// readingsRange converts the inclusive time range of a readings query in
+// seconds to the half-open range Flux queries
+func readingsRange(startTime, endTime int64) (time.Time, time.Time) {
+	return time.Unix(startTime, 0), time.Unix(endTime+1, 0)
+}
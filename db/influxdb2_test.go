@@ -0,0 +1,658 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fluxExchange is a Flux query the FluxDAO is expected to send, with the
+// annotated CSV InfluxDB answers it with. Answers starting with { are sent as
+// errors of the v2 API.
+type fluxExchange struct {
+	query  string
+	answer string
+}
+
+// fluxStandIn is a local stand-in for the InfluxDB 2.x API. Each Flux query
+// must be exactly the query of one of the expected exchanges, which are
+// answered once each in any order, so concurrent queries can be expected.
+// Queries are answered by answer instead, if set. Writes and deletes are
+// recorded.
+type fluxStandIn struct {
+	*httptest.Server
+	t         *testing.T
+	exchanges []fluxExchange
+	answer    func(query string) string
+	mutex     sync.Mutex
+	queries   []string
+	writes    []string
+	deletes   []fluxDeleteRequest
+}
+
+func newFluxStandIn(t *testing.T, exchanges ...fluxExchange) *fluxStandIn {
+	s := &fluxStandIn{t: t, exchanges: exchanges}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts the stand-in down, failing the test if any expected query
+// wasn't sent
+func (s *fluxStandIn) Close() {
+	s.Server.Close()
+	for _, exchange := range s.exchanges {
+		s.t.Errorf("Expected query was not sent:\n%s", exchange.query)
+	}
+}
+
+func (s *fluxStandIn) serveHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Token token1" || req.URL.Query().Get("org") != "org1" {
+		resp.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(resp, `{"code":"unauthorized","message":"unauthorized access"}`)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch req.URL.Path {
+	case "/api/v2/query":
+		var query fluxQueryRequest
+		json.NewDecoder(req.Body).Decode(&query)
+		s.queries = append(s.queries, query.Query)
+		answer := s.answerQuery(query.Query)
+		if strings.HasPrefix(answer, "{") {
+			resp.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(resp, answer)
+	case "/api/v2/write":
+		body, _ := ioutil.ReadAll(req.Body)
+		s.writes = append(s.writes, req.URL.Query().Get("bucket")+"?precision="+req.URL.Query().Get("precision")+"\n"+string(body))
+		resp.WriteHeader(http.StatusNoContent)
+	case "/api/v2/delete":
+		var deleteRequest fluxDeleteRequest
+		json.NewDecoder(req.Body).Decode(&deleteRequest)
+		s.deletes = append(s.deletes, deleteRequest)
+		resp.WriteHeader(http.StatusNoContent)
+	default:
+		resp.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// answerQuery answers a query with its exchange, which is then used up
+func (s *fluxStandIn) answerQuery(query string) string {
+	if s.answer != nil {
+		return s.answer(query)
+	}
+	for k, exchange := range s.exchanges {
+		if exchange.query == query {
+			s.exchanges = append(s.exchanges[:k], s.exchanges[k+1:]...)
+			return exchange.answer
+		}
+	}
+	s.t.Errorf("Unexpected query:\n%s", query)
+	return `{"code":"invalid","message":"unexpected query"}`
+}
+
+func (s *fluxStandIn) newDAO(deviceManager DeviceManager) *FluxDAO {
+	return NewFluxDAOWithClient(s.Client(), s.URL+"/", "org1", "streammarker_measurements", "token1", deviceManager, DefaultMeasurementRegistry())
+}
+
+// lastReadingsCSV answers a query for the last readings of the benchmark
+// sensors, with a table for each sensor the query names or for every sensor
+// if it names none
+func lastReadingsCSV(query string) string {
+	lines := []string{
+		"#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,string,string,double",
+		"#group,false,false,true,true,false,true,true,false",
+		"#default,_result,,,,,,,",
+		",result,table,_start,_stop,_time,account_id,sensor_id,temperature",
+	}
+	for k := 0; k < benchmarkSensorCount; k++ {
+		sensorID := fmt.Sprintf("sensor%d", k)
+		if strings.Contains(query, `r["sensor_id"]`) && !strings.Contains(query, fluxString(sensorID)) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(",,%d,1970-01-01T00:00:00Z,2016-05-02T00:00:00Z,2016-05-01T00:00:00Z,account1,%s,21.5", k, sensorID))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func newBenchmarkFluxDAO(t *testing.T) (*FluxDAO, *fluxStandIn) {
+	deviceManager := &sensorListDeviceManager{}
+	for k := 0; k < benchmarkSensorCount; k++ {
+		deviceManager.sensors = append(deviceManager.sensors, &Sensor{ID: fmt.Sprintf("sensor%d", k), AccountID: "account1", State: SensorStateActive})
+	}
+	s := newFluxStandIn(t)
+	s.answer = lastReadingsCSV
+	return s.newDAO(deviceManager), s
+}
+
+// twoSensors are the sensors of account1 in tests of the last readings
+var twoSensors = &sensorListDeviceManager{sensors: []*Sensor{
+	{ID: "sensor1", AccountID: "account1"},
+	{ID: "sensor2", AccountID: "account1"},
+}}
+
+const fluxLastReadingsQuery = `from(bucket: "streammarker_measurements")
+  |> range(start: 1970-01-01T00:00:00Z, stop: 2262-04-11T23:47:16.854775807Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> last()
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: 1)`
+
+// fluxLastReadingsCSV is the last point of each of twoSensors, pivoted into a
+// table per sensor. Sensor 2 has no humidity, so its column is empty.
+const fluxLastReadingsCSV = `#datatype,string,long,dateTime:RFC3339,string,string,double,double
+#group,false,false,false,true,true,false,false
+#default,_result,,,,,,
+,result,table,_time,account_id,sensor_id,humidity,temperature
+,,0,2016-05-01T03:30:00Z,account1,sensor1,58,27
+,,1,2016-05-01T02:45:00Z,account1,sensor2,,19
+`
+
+func TestFluxGetLastSensorReadings(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{fluxLastReadingsQuery, fluxLastReadingsCSV})
+	defer s.Close()
+
+	readings, err := s.newDAO(twoSensors).GetLastSensorReadings("account1", "", false, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	assert.False(t, readings.Partial)
+	assert.Equal(t, int64(1462073400), readings.Sensors["sensor1"].Timestamp)
+	assert.Equal(t, []Measurement{{Name: "humidity", Value: 58, Unit: "%"}, {Name: "temperature", Value: 27, Unit: "Celsius"}}, readings.Sensors["sensor1"].Measurements)
+	assert.Equal(t, int64(1462070700), readings.Sensors["sensor2"].Timestamp)
+	assert.Equal(t, []Measurement{{Name: "temperature", Value: 19, Unit: "Celsius"}}, readings.Sensors["sensor2"].Measurements)
+}
+
+func TestFluxGetLastSensorReadingsProjectsMeasurements(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{
+		query: `from(bucket: "streammarker_measurements")
+  |> range(start: 1970-01-01T00:00:00Z, stop: 2262-04-11T23:47:16.854775807Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r._field == "humidity" or r._field == "battery")
+  |> last()
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: 1)`,
+		answer: `#datatype,string,long,dateTime:RFC3339,string,string,double
+#group,false,false,false,true,true,false
+#default,_result,,,,,
+,result,table,_time,account_id,sensor_id,humidity
+,,0,2016-05-01T03:30:00Z,account1,sensor1,58
+`,
+	})
+	defer s.Close()
+
+	readings, err := s.newDAO(twoSensors).GetLastSensorReadings("account1", "", false, []string{"humidity", "battery"})
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	assert.Equal(t, []Measurement{{Name: "humidity", Value: 58, Unit: "%"}}, readings.Sensors["sensor1"].Measurements)
+	assert.Empty(t, readings.Sensors["sensor2"].Measurements)
+}
+
+func TestFluxGetLastSensorReadingsSingleQuery(t *testing.T) {
+	dao, s := newBenchmarkFluxDAO(t)
+	defer s.Close()
+
+	readings, err := dao.GetLastSensorReadings("account1", "", false, []string{"temperature"})
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	if len(s.queries) != 1 {
+		t.Fatal("Expected a single query for all sensors, got", len(s.queries))
+	}
+	if len(readings.Sensors) != benchmarkSensorCount || len(readings.Sensors["sensor7"].Measurements) != 1 {
+		t.Error("Readings were not matched to sensors", len(readings.Sensors))
+	}
+}
+
+// fluxLastSensorReadingQuery is the query for the last point of one sensor,
+// sent when the query of the whole account fails
+func fluxLastSensorReadingQuery(sensorID string) string {
+	return `from(bucket: "streammarker_measurements")
+  |> range(start: 1970-01-01T00:00:00Z, stop: 2262-04-11T23:47:16.854775807Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> last()
+  |> filter(fn: (r) => r["sensor_id"] == "` + sensorID + `")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: 1)`
+}
+
+func TestFluxGetLastSensorReadingsPerSensorAfterFailure(t *testing.T) {
+	s := newFluxStandIn(t,
+		fluxExchange{fluxLastReadingsQuery, `{"code":"internal error","message":"timeout"}`},
+		fluxExchange{fluxLastSensorReadingQuery("sensor1"), `#datatype,string,long,dateTime:RFC3339,string,string,double
+#group,false,false,false,true,true,false
+#default,_result,,,,,
+,result,table,_time,account_id,sensor_id,temperature
+,,0,2016-05-01T03:30:00Z,account1,sensor1,27
+`},
+		fluxExchange{fluxLastSensorReadingQuery("sensor2"), `{"code":"internal error","message":"timeout"}`},
+	)
+	defer s.Close()
+
+	readings, err := s.newDAO(twoSensors).GetLastSensorReadings("account1", "", false, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	assert.True(t, readings.Partial)
+	assert.Equal(t, []Measurement{{Name: "temperature", Value: 27, Unit: "Celsius"}}, readings.Sensors["sensor1"].Measurements)
+	assert.Equal(t, "InfluxDB returned 500 Internal Server Error: timeout", readings.Sensors["sensor2"].Error)
+	assert.Nil(t, readings.Sensors["sensor2"].Measurements)
+}
+
+func TestFluxGetLastSensorReadingsWithEverySensorFailing(t *testing.T) {
+	s := newFluxStandIn(t,
+		fluxExchange{fluxLastReadingsQuery, `{"code":"internal error","message":"timeout"}`},
+		fluxExchange{fluxLastSensorReadingQuery("sensor1"), `{"code":"internal error","message":"timeout"}`},
+		fluxExchange{fluxLastSensorReadingQuery("sensor2"), `{"code":"internal error","message":"timeout"}`},
+	)
+	defer s.Close()
+
+	readings, err := s.newDAO(twoSensors).GetLastSensorReadings("account1", "", false, nil)
+
+	assert.EqualError(t, err, "InfluxDB returned 500 Internal Server Error: timeout")
+	assert.Nil(t, readings)
+}
+
+func TestFluxGetLastSensorReadingsWithMalformedRow(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{fluxLastReadingsQuery, strings.Replace(fluxLastReadingsCSV, "2016-05-01T02:45:00Z", "yesterday", 1)})
+	defer s.Close()
+
+	readings, err := s.newDAO(twoSensors).GetLastSensorReadings("account1", "", false, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	if !readings.Partial {
+		t.Error("Readings with a malformed row were not marked partial")
+	}
+	if readings.Sensors["sensor1"].Error != "" || len(readings.Sensors["sensor1"].Measurements) != 2 {
+		t.Error("Well-formed row was not read", readings.Sensors["sensor1"])
+	}
+	if readings.Sensors["sensor2"].Error == "" || readings.Sensors["sensor2"].Measurements != nil {
+		t.Error("Malformed row was not reported", readings.Sensors["sensor2"])
+	}
+}
+
+func TestFluxQueryForSensorReadingsPaginates(t *testing.T) {
+	s := newFluxStandIn(t,
+		fluxExchange{
+			query: `from(bucket: "streammarker_measurements")
+  |> range(start: 2016-05-01T00:00:00Z, stop: 2016-05-02T00:00:01Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: 2)`,
+			answer: `#datatype,string,long,dateTime:RFC3339,string,string,double
+#group,false,false,false,true,true,false
+#default,_result,,,,,
+,result,table,_time,account_id,sensor_id,temperature
+,,0,2016-05-01T02:00:00Z,account1,sensor1,22
+,,0,2016-05-01T01:00:00Z,account1,sensor1,21.5
+`,
+		},
+		fluxExchange{
+			// the next page stops before the last reading of the first
+			query: `from(bucket: "streammarker_measurements")
+  |> range(start: 2016-05-01T00:00:00Z, stop: 2016-05-01T01:00:00Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: 2)`,
+			answer: `#datatype,string,long,dateTime:RFC3339,string,string,double
+#group,false,false,false,true,true,false
+#default,_result,,,,,
+,result,table,_time,account_id,sensor_id,temperature
+,,0,2016-05-01T00:00:00Z,account1,sensor1,20
+`,
+		},
+	)
+	defer s.Close()
+	dao := s.newDAO(nil)
+
+	results, err := dao.QueryForSensorReadings("account1", "sensor1", 1462060800, 1462147200, &ReadingsQueryOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, results.Readings, 2)
+	assert.Equal(t, int64(1462064400), results.Readings[1].Timestamp)
+	assert.NotEmpty(t, results.NextCursor)
+
+	results, err = dao.QueryForSensorReadings("account1", "sensor1", 1462060800, 1462147200, &ReadingsQueryOptions{Limit: 2, Cursor: results.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MinimalReading{{Timestamp: 1462060800, Measurements: []Measurement{{Name: "temperature", Value: 20, Unit: "Celsius"}}}}, results.Readings)
+	assert.Empty(t, results.NextCursor)
+}
+
+func TestFluxQueryForSensorReadingsPaginatesAggregatesAfterCursorBucket(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{
+		// the page starts at the bucket after the cursor's, which was on the
+		// previous page
+		query: `import "interpolate"
+from(bucket: "streammarker_measurements")
+  |> range(start: 2016-05-01T02:00:00Z, stop: 2016-05-01T04:00:00Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1")
+  |> filter(fn: (r) => r._field == "temperature")
+  |> aggregateWindow(every: 3600s, fn: last, createEmpty: false, timeSrc: "_start")
+  |> interpolate.linear(every: 3600s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"])
+  |> limit(n: 2)`,
+		answer: `#datatype,string,long,dateTime:RFC3339,string,string,double
+#group,false,false,false,true,true,false
+#default,_result,,,,,
+,result,table,_time,account_id,sensor_id,temperature
+,,0,2016-05-01T02:00:00Z,account1,sensor1,24
+,,0,2016-05-01T03:00:00Z,account1,sensor1,27
+`,
+	})
+	defer s.Close()
+	options := &ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateLast, Fill: "linear", Ascending: true, Limit: 2, Measurements: []string{"temperature"}}
+	options.Cursor = encodeReadingsCursor("sensor1", false, time.Unix(1462064400, 0))
+
+	results, err := s.newDAO(nil).QueryForSensorReadings("account1", "sensor1", 1462060800, 1462075199, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, results.Readings, 2)
+	assert.Equal(t, encodeReadingsCursor("sensor1", false, time.Unix(1462071600, 0)), results.NextCursor)
+}
+
+func TestFluxQueryForSensorReadingsFillsWithNumber(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{
+		query: `import "types"
+from(bucket: "streammarker_measurements")
+  |> range(start: 2016-05-01T00:00:00Z, stop: 2016-05-01T04:00:00Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1")
+  |> filter(fn: (r) => types.isNumeric(v: r._value))
+  |> toFloat()
+  |> aggregateWindow(every: 3600s, fn: mean, createEmpty: true, timeSrc: "_start")
+  |> fill(value: -1.0)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"])
+  |> limit(n: 1000)`,
+		answer: `#datatype,string,long,dateTime:RFC3339,string,string,double
+#group,false,false,false,true,true,false
+#default,_result,,,,,
+,result,table,_time,account_id,sensor_id,temperature
+,,0,2016-05-01T00:00:00Z,account1,sensor1,21
+,,0,2016-05-01T01:00:00Z,account1,sensor1,-1
+`,
+	})
+	defer s.Close()
+
+	results, err := s.newDAO(nil).QueryForSensorReadings("account1", "sensor1", 1462060800, 1462075199, &ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Fill: "-1", Ascending: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MinimalReading{
+		{Timestamp: 1462060800, Measurements: []Measurement{{Name: "temperature", Value: 21, Unit: "Celsius"}}},
+		{Timestamp: 1462064400, Measurements: []Measurement{{Name: "temperature", Value: -1, Unit: "Celsius"}}},
+	}, results.Readings)
+}
+
+func TestFluxQueryForMultipleSensorReadings(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{
+		query: `from(bucket: "streammarker_measurements")
+  |> range(start: 2016-05-01T00:00:00Z, stop: 2016-05-01T04:00:00Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1" or r["sensor_id"] == "sensor2" or r["sensor_id"] == "sensor3")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: 1)`,
+		answer: `#datatype,string,long,dateTime:RFC3339,string,string,double,double
+#group,false,false,false,true,true,false,false
+#default,_result,,,,,,
+,result,table,_time,account_id,sensor_id,humidity,temperature
+,,0,2016-05-01T03:30:00Z,account1,sensor1,58,27
+,,1,2016-05-01T02:45:00Z,account1,sensor2,,19
+`,
+	})
+	defer s.Close()
+
+	results, err := s.newDAO(nil).QueryForMultipleSensorReadings("account1", []string{"sensor1", "sensor2", "sensor3"}, 1462060800, 1462075199, &ReadingsQueryOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, results, 3)
+	assert.Equal(t, []*MinimalReading{{Timestamp: 1462073400, Measurements: []Measurement{{Name: "humidity", Value: 58, Unit: "%"}, {Name: "temperature", Value: 27, Unit: "Celsius"}}}}, results["sensor1"].Readings)
+	assert.Equal(t, []*MinimalReading{{Timestamp: 1462070700, Measurements: []Measurement{{Name: "temperature", Value: 19, Unit: "Celsius"}}}}, results["sensor2"].Readings)
+	assert.Empty(t, results["sensor3"].Readings)
+	// full pages of several sensors can't be continued
+	for _, sensorResults := range results {
+		assert.Empty(t, sensorResults.NextCursor)
+	}
+}
+
+func TestFluxQueryForMultipleSensorReadingsInBatches(t *testing.T) {
+	dao, s := newBenchmarkFluxDAO(t)
+	defer s.Close()
+	sensorIDs := make([]string, 0, benchmarkSensorCount)
+	for k := 0; k < benchmarkSensorCount; k++ {
+		sensorIDs = append(sensorIDs, fmt.Sprintf("sensor%d", k))
+	}
+
+	results, err := dao.QueryForMultipleSensorReadings("account1", sensorIDs, 0, time.Now().Unix(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.queries) != 2 {
+		t.Errorf("Expected 2 batched queries for %d sensors, got %d", benchmarkSensorCount, len(s.queries))
+	}
+	if len(results) != benchmarkSensorCount {
+		t.Errorf("Expected results for %d sensors, got %d", benchmarkSensorCount, len(results))
+	}
+	if len(results["sensor50"].Readings) != 1 || len(results["sensor1"].Readings) != 1 {
+		t.Errorf("Readings were not keyed by the sensor of their table")
+	}
+}
+
+func TestFluxGetSensorExtremes(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{
+		query: `import "types"
+data = from(bucket: "streammarker_measurements")
+  |> range(start: 2016-05-01T00:00:00Z, stop: 2016-05-02T00:00:01Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1")
+  |> filter(fn: (r) => types.isNumeric(v: r._value))
+  |> group(columns: ["_field"])
+union(tables: [
+  data |> min() |> set(key: "selector", value: "min"),
+  data |> max() |> set(key: "selector", value: "max"),
+])`,
+		answer: `#datatype,string,long,dateTime:RFC3339,string,double,string
+#group,false,false,false,true,false,false
+#default,_result,,,,,
+,result,table,_time,_field,_value,selector
+,,0,2016-05-01T03:00:00Z,temperature,18.5,min
+,,1,2016-05-01T01:00:00Z,humidity,35,min
+,,2,2016-05-01T05:00:00Z,temperature,24,max
+,,3,2016-05-01T02:00:00Z,humidity,60,max
+`,
+	})
+	defer s.Close()
+
+	extremes, err := s.newDAO(nil).GetSensorExtremes("account1", "sensor1", 1462060800, 1462147200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MinMaxMeasurement{
+		{Name: "humidity", Min: Measurement{Name: "humidity", Value: 35, Unit: "%", Timestamp: 1462064400}, Max: Measurement{Name: "humidity", Value: 60, Unit: "%", Timestamp: 1462068000}},
+		{Name: "temperature", Min: Measurement{Name: "temperature", Value: 18.5, Unit: "Celsius", Timestamp: 1462071600}, Max: Measurement{Name: "temperature", Value: 24, Unit: "Celsius", Timestamp: 1462078800}},
+	}, extremes)
+}
+
+func TestFluxGetDailySummaries(t *testing.T) {
+	// March 13th is 23 hours long in Los Angeles
+	s := newFluxStandIn(t, fluxExchange{
+		query: `import "types"
+data = from(bucket: "streammarker_measurements")
+  |> range(start: 2016-03-12T08:00:00Z, stop: 2016-03-14T07:00:00Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1")
+  |> filter(fn: (r) => types.isNumeric(v: r._value))
+  |> toFloat()
+days = union(tables: [
+  data |> range(start: 2016-03-12T08:00:00Z, stop: 2016-03-13T08:00:00Z) |> set(key: "day", value: "0"),
+  data |> range(start: 2016-03-13T08:00:00Z, stop: 2016-03-14T07:00:00Z) |> set(key: "day", value: "1"),
+])
+  |> group(columns: ["day", "_field"])
+union(tables: [
+  days |> min() |> set(key: "aggregate", value: "min"),
+  days |> mean() |> set(key: "aggregate", value: "mean"),
+  days |> max() |> set(key: "aggregate", value: "max"),
+])`,
+		answer: `#datatype,string,long,string,string,double,string
+#group,false,false,true,true,false,false
+#default,_result,,,,,
+,result,table,day,_field,_value,aggregate
+,,0,1,temperature,18,min
+,,1,1,temperature,20.5,mean
+,,2,1,temperature,23,max
+`,
+	})
+	defer s.Close()
+
+	location, _ := time.LoadLocation("America/Los_Angeles")
+	summaries, err := s.newDAO(nil).GetDailySummaries("account1", "sensor1", time.Date(2016, 3, 12, 9, 0, 0, 0, location), time.Date(2016, 3, 13, 9, 0, 0, 0, location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, summaries, 2)
+	assert.Empty(t, summaries[0].Measurements)
+	assert.Equal(t, []*DailyMeasurementSummary{{Name: "temperature", Unit: "Celsius", Min: 18, Mean: 20.5, Max: 23}}, summaries[1].Measurements)
+}
+
+func TestFluxStreamSensorReadings(t *testing.T) {
+	s := newFluxStandIn(t, fluxExchange{
+		query: `import "types"
+from(bucket: "streammarker_measurements")
+  |> range(start: 2016-05-01T00:00:00Z, stop: 2016-05-01T04:00:00Z)
+  |> filter(fn: (r) => r._measurement == "sensor_measurements")
+  |> filter(fn: (r) => r["account_id"] == "account1")
+  |> filter(fn: (r) => r["sensor_id"] == "sensor1")
+  |> filter(fn: (r) => types.isNumeric(v: r._value))
+  |> aggregateWindow(every: 3600s, fn: mean, createEmpty: true, timeSrc: "_start")
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group(columns: ["sensor_id"])
+  |> sort(columns: ["_time"])`,
+		answer: `#datatype,string,long,dateTime:RFC3339,string,string,double,double
+#group,false,false,false,true,true,false,false
+#default,_result,,,,,,
+,result,table,_time,account_id,sensor_id,humidity,temperature
+,,0,2016-05-01T00:00:00Z,account1,sensor1,51,21
+,,0,2016-05-01T01:00:00Z,account1,sensor1,,21
+`,
+	})
+	defer s.Close()
+	w := &collectingReadingsWriter{}
+
+	err := s.newDAO(nil).StreamSensorReadings("account1", "sensor1", 1462060800, 1462075199, &ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Ascending: true}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MeasurementColumn{{Name: "humidity", Unit: "%"}, {Name: "temperature", Unit: "Celsius"}}, w.columns)
+	assert.Equal(t, []*MinimalReading{
+		{Timestamp: 1462060800, Measurements: []Measurement{{Name: "humidity", Value: 51, Unit: "%"}, {Name: "temperature", Value: 21, Unit: "Celsius"}}},
+		{Timestamp: 1462064400, Measurements: []Measurement{{Name: "temperature", Value: 21, Unit: "Celsius"}}},
+	}, w.readings)
+	assert.Empty(t, w.flushes)
+}
+
+func TestFluxWriteSensorReadingsInBatches(t *testing.T) {
+	s := newFluxStandIn(t)
+	defer s.Close()
+	dao := s.newDAO(nil)
+	readings := make([]*MinimalReading, maxPointsPerWrite+1)
+	for k := range readings {
+		readings[k] = &MinimalReading{Timestamp: int64(1462060800 + k), Measurements: []Measurement{{Name: "temperature", Value: 21.5}}}
+	}
+
+	if err := dao.WriteSensorReadings("account1", "sensor1", readings); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.writes) != 2 || strings.Count(s.writes[0], "\n") != maxPointsPerWrite+1 || strings.Count(s.writes[1], "\n") != 2 {
+		t.Fatalf("Expected readings to be written in batches of %d, got %d batches", maxPointsPerWrite, len(s.writes))
+	}
+	assert.Equal(t, "streammarker_measurements?precision=ns\nsensor_measurements,account_id=account1,sensor_id=sensor1 temperature=21.5 1462065800000000000\n", s.writes[1])
+
+	readings[maxPointsPerWrite].Timestamp = 0
+	s.writes = nil
+	if err := dao.WriteSensorReadings("account1", "sensor1", readings); err != ErrInvalidReading {
+		t.Errorf("Expected ErrInvalidReading, got %v", err)
+	}
+	if len(s.writes) != 0 {
+		t.Error("Readings were written before an invalid reading was found")
+	}
+}
+
+func TestFluxDeleteSensorReadings(t *testing.T) {
+	s := newFluxStandIn(t)
+	defer s.Close()
+
+	if err := s.newDAO(nil).DeleteSensorReadings("account1", `sensor"1`); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []fluxDeleteRequest{{
+		Start:     "1970-01-01T00:00:00Z",
+		Stop:      "2262-04-11T23:47:16.854775807Z",
+		Predicate: `_measurement="sensor_measurements" AND sensor_id="sensor\"1" AND account_id="account1"`,
+	}}, s.deletes)
+}
+
+func TestFluxDAOReportsUnauthorizedToken(t *testing.T) {
+	s := newFluxStandIn(t)
+	defer s.Close()
+	dao := NewFluxDAOWithClient(s.Client(), s.URL, "org1", "streammarker_measurements", "wrong", nil, DefaultMeasurementRegistry())
+
+	_, err := dao.QueryForSensorReadings("account1", "sensor1", 0, 60, nil)
+
+	assert.EqualError(t, err, "InfluxDB returned 401 Unauthorized: unauthorized access")
+}
+
+func TestNewFluxDAOTimesOutRequests(t *testing.T) {
+	dao, err := NewFluxDAO("http://127.0.0.1:8086", "org1", "streammarker_measurements", "token1", 30*time.Second, nil, DefaultMeasurementRegistry())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, dao.httpClient.Timeout)
+}
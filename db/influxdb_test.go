@@ -0,0 +1,608 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	benchmarkSensorCount  = 80
+	benchmarkQueryLatency = time.Millisecond
+)
+
+// latencyInfluxClient is a fake InfluxDB that takes a fixed time to answer each
+// request, returning the last point of every sensor it is asked about
+type latencyInfluxClient struct {
+	client.Client
+	latency time.Duration
+	queries int
+}
+
+func (c *latencyInfluxClient) Query(q client.Query) (*client.Response, error) {
+	c.queries++
+	time.Sleep(c.latency)
+
+	series := make([]models.Row, 0)
+	for k := 0; k < benchmarkSensorCount; k++ {
+		sensorID := fmt.Sprintf("sensor%d", k)
+		if id, ok := q.Parameters["sensor_id"]; ok && id != sensorID {
+			continue
+		}
+		series = append(series, models.Row{
+			Name:    sensorMeasurementsTableName,
+			Tags:    map[string]string{"sensor_id": sensorID},
+			Columns: []string{"time", "temperature"},
+			Values:  [][]interface{}{{"2016-05-01T00:00:00Z", json.Number("21.5")}},
+		})
+	}
+	return &client.Response{Results: []client.Result{{Series: series}}}, nil
+}
+
+// sensorListDeviceManager lists a fixed set of sensors
+type sensorListDeviceManager struct {
+	DeviceManager
+	sensors []*Sensor
+}
+
+func (d *sensorListDeviceManager) GetSensors(accountID string, state string, includeDeleted bool) ([]*Sensor, error) {
+	return d.sensors, nil
+}
+
+func newBenchmarkInfluxDAO() (*InfluxDAO, *latencyInfluxClient) {
+	deviceManager := &sensorListDeviceManager{}
+	for k := 0; k < benchmarkSensorCount; k++ {
+		deviceManager.sensors = append(deviceManager.sensors, &Sensor{ID: fmt.Sprintf("sensor%d", k), AccountID: "account1", State: SensorStateActive})
+	}
+	c := &latencyInfluxClient{latency: benchmarkQueryLatency}
+	return NewInfluxDAOWithClient(c, "streammarker_measurements", deviceManager, DefaultMeasurementRegistry()), c
+}
+
+func TestGetLastSensorReadingsSingleQuery(t *testing.T) {
+	dao, c := newBenchmarkInfluxDAO()
+
+	readings, err := dao.GetLastSensorReadings("account1", "", false, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	if c.queries != 1 {
+		t.Error("Expected a single query for all sensors, got", c.queries)
+	}
+	if len(readings.Sensors) != benchmarkSensorCount || len(readings.Sensors["sensor7"].Measurements) != 1 {
+		t.Error("Readings were not matched to sensors", len(readings.Sensors))
+	}
+}
+
+// BenchmarkGetLastSensorReadings fetches the last readings of every sensor in
+// an account with one query
+func BenchmarkGetLastSensorReadings(b *testing.B) {
+	dao, c := newBenchmarkInfluxDAO()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		dao.GetLastSensorReadings("account1", "", false, nil)
+	}
+	b.ReportMetric(float64(c.queries)/float64(b.N), "queries/op")
+}
+
+// BenchmarkGetLastSensorReadingsPerSensor is the previous approach of one query
+// per sensor, kept as a baseline for BenchmarkGetLastSensorReadings
+func BenchmarkGetLastSensorReadingsPerSensor(b *testing.B) {
+	dao, c := newBenchmarkInfluxDAO()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		sensors, _ := dao.deviceManager.GetSensors("account1", "", false)
+		for _, sensor := range sensors {
+			dao.queryDB(selectSensorMeasurements(sensor.AccountID, sensor.ID, nil).
+				orderByTimeDesc().
+				limit(1))
+		}
+	}
+	b.ReportMetric(float64(c.queries)/float64(b.N), "queries/op")
+}
+
+// seriesInfluxClient is a fake InfluxDB answering every query with the same series
+type seriesInfluxClient struct {
+	client.Client
+	series []models.Row
+}
+
+func (c *seriesInfluxClient) Query(q client.Query) (*client.Response, error) {
+	return &client.Response{Results: []client.Result{{Series: c.series}}}, nil
+}
+
+func TestGetLastSensorReadingsWithMalformedSeries(t *testing.T) {
+	deviceManager := &sensorListDeviceManager{sensors: []*Sensor{
+		{ID: "sensor1", AccountID: "account1"},
+		{ID: "sensor2", AccountID: "account1"},
+	}}
+	c := &seriesInfluxClient{series: []models.Row{
+		{Tags: map[string]string{"sensor_id": "sensor1"}, Columns: []string{"time", "temperature"}, Values: [][]interface{}{{"2016-05-01T00:00:00Z", json.Number("21.5")}}},
+		{Tags: map[string]string{"sensor_id": "sensor2"}, Columns: []string{"time", "temperature"}, Values: [][]interface{}{{"yesterday", json.Number("19")}}},
+	}}
+	dao := NewInfluxDAOWithClient(c, "streammarker_measurements", deviceManager, DefaultMeasurementRegistry())
+
+	readings, err := dao.GetLastSensorReadings("account1", "", false, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	if !readings.Partial {
+		t.Error("Readings with a malformed series were not marked partial")
+	}
+	if readings.Sensors["sensor1"].Error != "" || len(readings.Sensors["sensor1"].Measurements) != 1 {
+		t.Error("Well-formed series was not read", readings.Sensors["sensor1"])
+	}
+	if readings.Sensors["sensor2"].Error == "" || readings.Sensors["sensor2"].Measurements != nil {
+		t.Error("Malformed series was not reported", readings.Sensors["sensor2"])
+	}
+}
+
+func TestQueryForMultipleSensorReadingsInBatches(t *testing.T) {
+	dao, influx := newBenchmarkInfluxDAO()
+	influx.latency = 0
+	sensorIDs := make([]string, 0, benchmarkSensorCount)
+	for k := 0; k < benchmarkSensorCount; k++ {
+		sensorIDs = append(sensorIDs, fmt.Sprintf("sensor%d", k))
+	}
+
+	results, err := dao.QueryForMultipleSensorReadings("account1", sensorIDs, 0, time.Now().Unix(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if influx.queries != 2 {
+		t.Errorf("Expected 2 batched queries for %d sensors, got %d", benchmarkSensorCount, influx.queries)
+	}
+	if len(results) != benchmarkSensorCount {
+		t.Errorf("Expected results for %d sensors, got %d", benchmarkSensorCount, len(results))
+	}
+	if len(results["sensor50"].Readings) != 1 || len(results["sensor1"].Readings) != 0 {
+		t.Errorf("Readings were not keyed by the sensor of their series")
+	}
+}
+
+// writeInfluxClient records the batches of points written to it
+type writeInfluxClient struct {
+	client.Client
+	batches []client.BatchPoints
+}
+
+func (c *writeInfluxClient) Write(bp client.BatchPoints) error {
+	c.batches = append(c.batches, bp)
+	return nil
+}
+
+func TestWriteSensorReadingsInBatches(t *testing.T) {
+	c := &writeInfluxClient{}
+	dao := NewInfluxDAOWithClient(c, "streammarker_measurements", nil, DefaultMeasurementRegistry())
+	readings := make([]*MinimalReading, maxPointsPerWrite+1)
+	for k := range readings {
+		readings[k] = &MinimalReading{Timestamp: int64(1462060800 + k), Measurements: []Measurement{{Name: "temperature", Value: 21.5}}}
+	}
+
+	if err := dao.WriteSensorReadings("account1", "sensor1", readings); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.batches) != 2 || len(c.batches[0].Points()) != maxPointsPerWrite || len(c.batches[1].Points()) != 1 {
+		t.Errorf("Expected readings to be written in batches of %d, got %d batches", maxPointsPerWrite, len(c.batches))
+	}
+
+	readings[maxPointsPerWrite].Timestamp = 0
+	c.batches = nil
+	if err := dao.WriteSensorReadings("account1", "sensor1", readings); err != ErrInvalidReading {
+		t.Errorf("Expected ErrInvalidReading, got %v", err)
+	}
+	if len(c.batches) != 0 {
+		t.Error("Readings were written before an invalid reading was found")
+	}
+}
+
+// collectingReadingsWriter keeps the readings streamed to it, and how many
+// had been streamed at each flush
+type collectingReadingsWriter struct {
+	columns  []*MeasurementColumn
+	readings []*MinimalReading
+	flushes  []int
+}
+
+func (w *collectingReadingsWriter) WriteColumns(columns []*MeasurementColumn) error {
+	w.columns = columns
+	return nil
+}
+
+func (w *collectingReadingsWriter) WriteReading(reading *MinimalReading) error {
+	w.readings = append(w.readings, reading)
+	return nil
+}
+
+func (w *collectingReadingsWriter) Flush() error {
+	w.flushes = append(w.flushes, len(w.readings))
+	return nil
+}
+
+// influxQLExchange is an InfluxQL query the InfluxDAO is expected to send,
+// with its bound parameters and the results InfluxDB answers it with, or the
+// error it fails with
+type influxQLExchange struct {
+	command    string
+	parameters map[string]interface{}
+	results    []client.Result
+	err        error
+}
+
+// fixtureInfluxClient is a stand-in for InfluxDB 1.x. Each query must be
+// exactly the command and parameters of one of the expected exchanges, which
+// are answered once each in any order, so concurrent queries can be expected.
+// Chunked queries are sent each result as a chunk of its own.
+type fixtureInfluxClient struct {
+	client.Client
+	t         *testing.T
+	mutex     sync.Mutex
+	exchanges []influxQLExchange
+}
+
+func newFixtureInfluxDAO(t *testing.T, deviceManager DeviceManager, exchanges ...influxQLExchange) (*InfluxDAO, *fixtureInfluxClient) {
+	c := &fixtureInfluxClient{t: t, exchanges: exchanges}
+	return NewInfluxDAOWithClient(c, "streammarker_measurements", deviceManager, DefaultMeasurementRegistry()), c
+}
+
+// verify fails the test if any expected query wasn't sent
+func (c *fixtureInfluxClient) verify() {
+	for _, exchange := range c.exchanges {
+		c.t.Errorf("Expected query was not sent: %s %v", exchange.command, exchange.parameters)
+	}
+}
+
+// answer returns the results of the exchange of a query, which is then used up
+func (c *fixtureInfluxClient) answer(q client.Query) ([]client.Result, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if q.Database != "streammarker_measurements" {
+		c.t.Errorf("Query %s was sent to database %s", q.Command, q.Database)
+	}
+	for k, exchange := range c.exchanges {
+		if exchange.command == q.Command && (len(exchange.parameters) == 0 && len(q.Parameters) == 0 || reflect.DeepEqual(exchange.parameters, q.Parameters)) {
+			c.exchanges = append(c.exchanges[:k], c.exchanges[k+1:]...)
+			return exchange.results, exchange.err
+		}
+	}
+	c.t.Errorf("Unexpected query: %s %v", q.Command, q.Parameters)
+	return nil, errors.New("unexpected query")
+}
+
+func (c *fixtureInfluxClient) Query(q client.Query) (*client.Response, error) {
+	results, err := c.answer(q)
+	if err != nil {
+		return nil, err
+	}
+	return &client.Response{Results: results}, nil
+}
+
+func (c *fixtureInfluxClient) QueryAsChunk(q client.Query) (*client.ChunkedResponse, error) {
+	results, err := c.answer(q)
+	if err != nil {
+		return nil, err
+	}
+	var chunks bytes.Buffer
+	encoder := json.NewEncoder(&chunks)
+	for _, result := range results {
+		if err = encoder.Encode(&client.Response{Results: []client.Result{result}}); err != nil {
+			return nil, err
+		}
+	}
+	return client.NewChunkedResponse(&chunks), nil
+}
+
+const influxQLLastReadingsCommand = `SELECT * FROM "sensor_measurements" WHERE "account_id" = $account_id GROUP BY "sensor_id" ORDER BY time DESC LIMIT 1`
+
+const influxQLLastSensorReadingCommand = `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id ORDER BY time DESC LIMIT 1`
+
+// influxQLLastReadings is the last point of each of twoSensors, in a series
+// per sensor. Sensor 2 has no humidity in its last point.
+var influxQLLastReadings = []client.Result{{Series: []models.Row{
+	{Name: "sensor_measurements", Tags: map[string]string{"sensor_id": "sensor1"}, Columns: []string{"time", "account_id", "humidity", "temperature"}, Values: [][]interface{}{{"2016-05-01T03:30:00Z", "account1", json.Number("58"), json.Number("27")}}},
+	{Name: "sensor_measurements", Tags: map[string]string{"sensor_id": "sensor2"}, Columns: []string{"time", "account_id", "humidity", "temperature"}, Values: [][]interface{}{{"2016-05-01T02:45:00Z", "account1", nil, json.Number("19")}}},
+}}}
+
+func TestGetLastSensorReadings(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, twoSensors, influxQLExchange{
+		command:    influxQLLastReadingsCommand,
+		parameters: map[string]interface{}{"account_id": "account1"},
+		results:    influxQLLastReadings,
+	})
+	defer c.verify()
+
+	readings, err := dao.GetLastSensorReadings("account1", "", false, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	assert.False(t, readings.Partial)
+	assert.Equal(t, int64(1462073400), readings.Sensors["sensor1"].Timestamp)
+	assert.Equal(t, []Measurement{{Name: "humidity", Value: 58, Unit: "%"}, {Name: "temperature", Value: 27, Unit: "Celsius"}}, readings.Sensors["sensor1"].Measurements)
+	assert.Equal(t, int64(1462070700), readings.Sensors["sensor2"].Timestamp)
+	assert.Equal(t, []Measurement{{Name: "temperature", Value: 19, Unit: "Celsius"}}, readings.Sensors["sensor2"].Measurements)
+}
+
+func TestGetLastSensorReadingsProjectsMeasurements(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, twoSensors, influxQLExchange{
+		command:    `SELECT "humidity", "battery" FROM "sensor_measurements" WHERE "account_id" = $account_id GROUP BY "sensor_id" ORDER BY time DESC LIMIT 1`,
+		parameters: map[string]interface{}{"account_id": "account1"},
+		results: []client.Result{{Series: []models.Row{
+			{Name: "sensor_measurements", Tags: map[string]string{"sensor_id": "sensor1"}, Columns: []string{"time", "humidity", "battery"}, Values: [][]interface{}{{"2016-05-01T03:30:00Z", json.Number("58"), nil}}},
+		}}},
+	})
+	defer c.verify()
+
+	readings, err := dao.GetLastSensorReadings("account1", "", false, []string{"humidity", "battery"})
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	assert.Equal(t, []Measurement{{Name: "humidity", Value: 58, Unit: "%"}}, readings.Sensors["sensor1"].Measurements)
+	assert.Empty(t, readings.Sensors["sensor2"].Measurements)
+}
+
+func TestGetLastSensorReadingsPerSensorAfterFailure(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, twoSensors,
+		influxQLExchange{
+			command:    influxQLLastReadingsCommand,
+			parameters: map[string]interface{}{"account_id": "account1"},
+			err:        errors.New("timeout"),
+		},
+		influxQLExchange{
+			command:    influxQLLastSensorReadingCommand,
+			parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1"},
+			results: []client.Result{{Series: []models.Row{
+				{Name: "sensor_measurements", Columns: []string{"time", "account_id", "sensor_id", "temperature"}, Values: [][]interface{}{{"2016-05-01T03:30:00Z", "account1", "sensor1", json.Number("27")}}},
+			}}},
+		},
+		influxQLExchange{
+			command:    influxQLLastSensorReadingCommand,
+			parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor2"},
+			err:        errors.New("timeout"),
+		},
+	)
+	defer c.verify()
+
+	readings, err := dao.GetLastSensorReadings("account1", "", false, nil)
+
+	if err != nil {
+		t.Fatal("Unexpected error getting last sensor readings", err)
+	}
+	assert.True(t, readings.Partial)
+	assert.Equal(t, []Measurement{{Name: "temperature", Value: 27, Unit: "Celsius"}}, readings.Sensors["sensor1"].Measurements)
+	assert.Equal(t, "timeout", readings.Sensors["sensor2"].Error)
+	assert.Nil(t, readings.Sensors["sensor2"].Measurements)
+}
+
+func TestGetLastSensorReadingsWithEverySensorFailing(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, twoSensors,
+		influxQLExchange{command: influxQLLastReadingsCommand, parameters: map[string]interface{}{"account_id": "account1"}, err: errors.New("timeout")},
+		influxQLExchange{command: influxQLLastSensorReadingCommand, parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1"}, err: errors.New("timeout")},
+		influxQLExchange{command: influxQLLastSensorReadingCommand, parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor2"}, err: errors.New("timeout")},
+	)
+	defer c.verify()
+
+	readings, err := dao.GetLastSensorReadings("account1", "", false, nil)
+
+	assert.EqualError(t, err, "timeout")
+	assert.Nil(t, readings)
+}
+
+// temperatureSeries is a series of temperature readings of sensor 1, with a
+// time and a value in each row
+func temperatureSeries(column string, rows ...[]interface{}) []client.Result {
+	return []client.Result{{Series: []models.Row{{Name: "sensor_measurements", Columns: []string{"time", column}, Values: rows}}}}
+}
+
+func TestQueryForSensorReadingsPaginates(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, nil,
+		influxQLExchange{
+			command:    `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time ORDER BY time DESC LIMIT 2`,
+			parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1", "start_time": "2016-05-01T00:00:00Z", "end_time": "2016-05-02T00:00:00Z"},
+			results:    temperatureSeries("temperature", []interface{}{"2016-05-01T02:00:00Z", json.Number("22")}, []interface{}{"2016-05-01T01:00:00Z", json.Number("21.5")}),
+		},
+		influxQLExchange{
+			// the next page is before the last reading of the first
+			command:    `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time AND time < $cursor_time ORDER BY time DESC LIMIT 2`,
+			parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1", "start_time": "2016-05-01T00:00:00Z", "end_time": "2016-05-02T00:00:00Z", "cursor_time": "2016-05-01T01:00:00Z"},
+			results:    temperatureSeries("temperature", []interface{}{"2016-05-01T00:00:00Z", json.Number("20")}),
+		},
+	)
+	defer c.verify()
+
+	results, err := dao.QueryForSensorReadings("account1", "sensor1", 1462060800, 1462147200, &ReadingsQueryOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, results.Readings, 2)
+	assert.Equal(t, int64(1462064400), results.Readings[1].Timestamp)
+	assert.NotEmpty(t, results.NextCursor)
+
+	results, err = dao.QueryForSensorReadings("account1", "sensor1", 1462060800, 1462147200, &ReadingsQueryOptions{Limit: 2, Cursor: results.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MinimalReading{{Timestamp: 1462060800, Measurements: []Measurement{{Name: "temperature", Value: 20, Unit: "Celsius"}}}}, results.Readings)
+	assert.Empty(t, results.NextCursor)
+}
+
+func TestQueryForSensorReadingsPaginatesAggregatesAfterCursorBucket(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, nil, influxQLExchange{
+		// the page starts at the bucket after the cursor's, which was on the
+		// previous page
+		command:    `SELECT last("temperature") AS "last_temperature" FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time AND time >= $cursor_time GROUP BY time(3600s) fill(linear) ORDER BY time ASC LIMIT 2`,
+		parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1", "start_time": "2016-05-01T00:00:00Z", "end_time": "2016-05-01T03:59:59Z", "cursor_time": "2016-05-01T02:00:00Z"},
+		results:    temperatureSeries("last_temperature", []interface{}{"2016-05-01T02:00:00Z", json.Number("24")}, []interface{}{"2016-05-01T03:00:00Z", json.Number("27")}),
+	})
+	defer c.verify()
+	options := &ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateLast, Fill: "linear", Ascending: true, Limit: 2, Measurements: []string{"temperature"}}
+	options.Cursor = encodeReadingsCursor("sensor1", false, time.Unix(1462064400, 0))
+
+	results, err := dao.QueryForSensorReadings("account1", "sensor1", 1462060800, 1462075199, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MinimalReading{
+		{Timestamp: 1462068000, Measurements: []Measurement{{Name: "temperature", Value: 24, Unit: "Celsius"}}},
+		{Timestamp: 1462071600, Measurements: []Measurement{{Name: "temperature", Value: 27, Unit: "Celsius"}}},
+	}, results.Readings)
+	assert.Equal(t, encodeReadingsCursor("sensor1", false, time.Unix(1462071600, 0)), results.NextCursor)
+}
+
+func TestQueryForMultipleSensorReadings(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, nil, influxQLExchange{
+		command:    `SELECT * FROM "sensor_measurements" WHERE ("sensor_id" = $sensor_id OR "sensor_id" = $sensor_id_1 OR "sensor_id" = $sensor_id_2) AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time GROUP BY "sensor_id" ORDER BY time DESC LIMIT 1`,
+		parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1", "sensor_id_1": "sensor2", "sensor_id_2": "sensor3", "start_time": "2016-05-01T00:00:00Z", "end_time": "2016-05-01T03:59:59Z"},
+		results:    influxQLLastReadings,
+	})
+	defer c.verify()
+
+	results, err := dao.QueryForMultipleSensorReadings("account1", []string{"sensor1", "sensor2", "sensor3"}, 1462060800, 1462075199, &ReadingsQueryOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, results, 3)
+	assert.Equal(t, []*MinimalReading{{Timestamp: 1462073400, Measurements: []Measurement{{Name: "humidity", Value: 58, Unit: "%"}, {Name: "temperature", Value: 27, Unit: "Celsius"}}}}, results["sensor1"].Readings)
+	assert.Equal(t, []*MinimalReading{{Timestamp: 1462070700, Measurements: []Measurement{{Name: "temperature", Value: 19, Unit: "Celsius"}}}}, results["sensor2"].Readings)
+	assert.Empty(t, results["sensor3"].Readings)
+	// full pages of several sensors can't be continued
+	for _, sensorResults := range results {
+		assert.Empty(t, sensorResults.NextCursor)
+	}
+}
+
+func TestGetSensorExtremes(t *testing.T) {
+	timeRange := map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1", "start_time": "2016-05-01T00:00:00Z", "end_time": "2016-05-02T00:00:00Z"}
+	dao, c := newFixtureInfluxDAO(t, nil,
+		influxQLExchange{
+			command: `SHOW FIELD KEYS FROM "sensor_measurements"`,
+			results: []client.Result{{Series: []models.Row{{Name: "sensor_measurements", Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{
+				{"door_open", "boolean"},
+				{"humidity", "float"},
+				{"temperature", "float"},
+			}}}}},
+		},
+		influxQLExchange{
+			command: `SELECT min("humidity") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time; ` +
+				`SELECT max("humidity") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time; ` +
+				`SELECT min("temperature") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time; ` +
+				`SELECT max("temperature") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time`,
+			parameters: timeRange,
+			results: []client.Result{
+				temperatureSeries("min", []interface{}{"2016-05-01T01:00:00Z", json.Number("35")})[0],
+				temperatureSeries("max", []interface{}{"2016-05-01T02:00:00Z", json.Number("60")})[0],
+				temperatureSeries("min", []interface{}{"2016-05-01T03:00:00Z", json.Number("18.5")})[0],
+				temperatureSeries("max", []interface{}{"2016-05-01T05:00:00Z", json.Number("24")})[0],
+			},
+		},
+	)
+	defer c.verify()
+
+	extremes, err := dao.GetSensorExtremes("account1", "sensor1", 1462060800, 1462147200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MinMaxMeasurement{
+		{Name: "humidity", Min: Measurement{Name: "humidity", Value: 35, Unit: "%", Timestamp: 1462064400}, Max: Measurement{Name: "humidity", Value: 60, Unit: "%", Timestamp: 1462068000}},
+		{Name: "temperature", Min: Measurement{Name: "temperature", Value: 18.5, Unit: "Celsius", Timestamp: 1462071600}, Max: Measurement{Name: "temperature", Value: 24, Unit: "Celsius", Timestamp: 1462078800}},
+	}, extremes)
+}
+
+func TestGetSensorExtremesWithInvalidTime(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, nil,
+		influxQLExchange{
+			command: `SHOW FIELD KEYS FROM "sensor_measurements"`,
+			results: []client.Result{{Series: []models.Row{{Name: "sensor_measurements", Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{{"temperature", "float"}}}}}},
+		},
+		influxQLExchange{
+			command: `SELECT min("temperature") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time; ` +
+				`SELECT max("temperature") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time`,
+			parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1", "start_time": "2016-05-01T00:00:00Z", "end_time": "2016-05-02T00:00:00Z"},
+			results: []client.Result{
+				temperatureSeries("min", []interface{}{nil, json.Number("18.5")})[0],
+				temperatureSeries("max", []interface{}{"2016-05-01T05:00:00Z", json.Number("24")})[0],
+			},
+		},
+	)
+	defer c.verify()
+
+	extremes, err := dao.GetSensorExtremes("account1", "sensor1", 1462060800, 1462147200)
+
+	assert.EqualError(t, err, "Extreme of temperature has an invalid time: <nil>")
+	assert.Nil(t, extremes)
+}
+
+func TestGetDailySummaries(t *testing.T) {
+	// March 13th is 23 hours long in Los Angeles
+	dao, c := newFixtureInfluxDAO(t, nil, influxQLExchange{
+		command: `SELECT min(*), mean(*), max(*) FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $day0_start AND time < $day0_end; ` +
+			`SELECT min(*), mean(*), max(*) FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $day1_start AND time < $day1_end`,
+		parameters: map[string]interface{}{
+			"account_id": "account1", "sensor_id": "sensor1",
+			"day0_start": "2016-03-12T08:00:00Z", "day0_end": "2016-03-13T08:00:00Z",
+			"day1_start": "2016-03-13T08:00:00Z", "day1_end": "2016-03-14T07:00:00Z",
+		},
+		results: []client.Result{
+			{},
+			{Series: []models.Row{{Name: "sensor_measurements", Columns: []string{"time", "min_temperature", "mean_temperature", "max_temperature"}, Values: [][]interface{}{
+				{"2016-03-13T08:00:00Z", json.Number("18"), json.Number("20.5"), json.Number("23")},
+			}}}},
+		},
+	})
+	defer c.verify()
+
+	location, _ := time.LoadLocation("America/Los_Angeles")
+	summaries, err := dao.GetDailySummaries("account1", "sensor1", time.Date(2016, 3, 12, 9, 0, 0, 0, location), time.Date(2016, 3, 13, 9, 0, 0, 0, location))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, summaries, 2)
+	assert.Empty(t, summaries[0].Measurements)
+	assert.Equal(t, []*DailyMeasurementSummary{{Name: "temperature", Unit: "Celsius", Min: 18, Mean: 20.5, Max: 23}}, summaries[1].Measurements)
+}
+
+func TestStreamSensorReadings(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, nil, influxQLExchange{
+		command:    `SELECT mean(*) FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time GROUP BY time(3600s) ORDER BY time ASC`,
+		parameters: map[string]interface{}{"account_id": "account1", "sensor_id": "sensor1", "start_time": "2016-05-01T00:00:00Z", "end_time": "2016-05-01T03:59:59Z"},
+		results: []client.Result{
+			{Series: []models.Row{{Name: "sensor_measurements", Columns: []string{"time", "mean_humidity", "mean_temperature"}, Values: [][]interface{}{{"2016-05-01T00:00:00Z", json.Number("51"), json.Number("21")}}}}},
+			{Series: []models.Row{{Name: "sensor_measurements", Columns: []string{"time", "mean_humidity", "mean_temperature"}, Values: [][]interface{}{{"2016-05-01T01:00:00Z", nil, json.Number("21")}}}}},
+		},
+	})
+	defer c.verify()
+	w := &collectingReadingsWriter{}
+
+	err := dao.StreamSensorReadings("account1", "sensor1", 1462060800, 1462075199, &ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Ascending: true}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*MeasurementColumn{{Name: "humidity", Unit: "%"}, {Name: "temperature", Unit: "Celsius"}}, w.columns)
+	assert.Equal(t, []*MinimalReading{
+		{Timestamp: 1462060800, Measurements: []Measurement{{Name: "humidity", Value: 51, Unit: "%"}, {Name: "temperature", Value: 21, Unit: "Celsius"}}},
+		{Timestamp: 1462064400, Measurements: []Measurement{{Name: "temperature", Value: 21, Unit: "Celsius"}}},
+	}, w.readings)
+	assert.Equal(t, []int{1, 2}, w.flushes)
+}
+
+func TestDeleteSensorReadings(t *testing.T) {
+	dao, c := newFixtureInfluxDAO(t, nil, influxQLExchange{
+		command:    `DROP SERIES FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id`,
+		parameters: map[string]interface{}{"account_id": "account1", "sensor_id": `sensor"1`},
+		results:    []client.Result{{}},
+	})
+	defer c.verify()
+
+	assert.NoError(t, dao.DeleteSensorReadings("account1", `sensor"1`))
+}
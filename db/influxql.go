@@ -0,0 +1,185 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// influxQuery builds an InfluxQL statement whose values are sent to InfluxDB
+// as bound parameters rather than being spliced into the statement text
+type influxQuery struct {
+	statement  string
+	conditions []string
+	groupBy    []string
+	fill       string
+	order      string
+	limitN     int
+	params     map[string]interface{}
+}
+
+// newInfluxQuery starts a query with the given statement, such as a SELECT
+// clause and its measurement
+func newInfluxQuery(statement string) *influxQuery {
+	return &influxQuery{
+		statement: statement,
+		params:    make(map[string]interface{}),
+	}
+}
+
+// whereTagEquals restricts the query to points whose tag has the given value
+func (q *influxQuery) whereTagEquals(tag string, value string) *influxQuery {
+	return q.where(tag, "=", value)
+}
+
+// whereTimeBetween restricts the query to points within the inclusive range
+func (q *influxQuery) whereTimeBetween(start time.Time, end time.Time) *influxQuery {
+	q.conditions = append(q.conditions,
+		"time >= $start_time",
+		"time <= $end_time")
+	q.params["start_time"] = start.UTC().Format(time.RFC3339)
+	q.params["end_time"] = end.UTC().Format(time.RFC3339)
+	return q
+}
+
+// whereTimeWithin restricts the query to points from start up to but not
+// including end, binding the bounds as name_start and name_end
+func (q *influxQuery) whereTimeWithin(name string, start time.Time, end time.Time) *influxQuery {
+	q.conditions = append(q.conditions,
+		fmt.Sprintf("time >= $%s_start", name),
+		fmt.Sprintf("time < $%s_end", name))
+	q.params[name+"_start"] = start.UTC().Format(time.RFC3339)
+	q.params[name+"_end"] = end.UTC().Format(time.RFC3339)
+	return q
+}
+
+// whereTime compares the time of points against a bound parameter, which is
+// sent with nanosecond precision
+func (q *influxQuery) whereTime(operator string, param string, t time.Time) *influxQuery {
+	q.conditions = append(q.conditions, fmt.Sprintf("time %s $%s", operator, param))
+	q.params[param] = t.UTC().Format(time.RFC3339Nano)
+	return q
+}
+
+// whereTagIn restricts the query to points whose tag has any of the given
+// values
+func (q *influxQuery) whereTagIn(tag string, values []string) *influxQuery {
+	if len(values) == 1 {
+		return q.whereTagEquals(tag, values[0])
+	}
+	comparisons := make([]string, len(values))
+	for k, value := range values {
+		comparisons[k] = fmt.Sprintf("%s = $%s", quoteIdentifier(tag), q.bind(tag, value))
+	}
+	q.conditions = append(q.conditions, "("+strings.Join(comparisons, " OR ")+")")
+	return q
+}
+
+// where adds a comparison of a field or tag against a bound parameter named
+// after it
+func (q *influxQuery) where(name string, operator string, value interface{}) *influxQuery {
+	q.conditions = append(q.conditions, fmt.Sprintf("%s %s $%s", quoteIdentifier(name), operator, q.bind(name, value)))
+	return q
+}
+
+// bind adds a parameter named after a field or tag, numbering it if the name
+// is already taken, and returns the parameter name
+func (q *influxQuery) bind(name string, value interface{}) string {
+	param := name
+	for n := 1; q.hasParam(param); n++ {
+		param = fmt.Sprintf("%s_%d", name, n)
+	}
+	q.params[param] = value
+	return param
+}
+
+func (q *influxQuery) hasParam(name string) bool {
+	_, ok := q.params[name]
+	return ok
+}
+
+// groupByTime aggregates points into buckets of the given interval
+func (q *influxQuery) groupByTime(interval time.Duration) *influxQuery {
+	q.groupBy = append(q.groupBy, fmt.Sprintf("time(%ds)", int64(interval/time.Second)))
+	return q
+}
+
+// groupByTag returns a separate series for each value of the tag
+func (q *influxQuery) groupByTag(tag string) *influxQuery {
+	q.groupBy = append(q.groupBy, quoteIdentifier(tag))
+	return q
+}
+
+// fillWith sets how buckets without points are filled: none, null, previous,
+// linear or a number
+func (q *influxQuery) fillWith(fill string) *influxQuery {
+	q.fill = fill
+	return q
+}
+
+// orderByTimeDesc returns the newest points first
+func (q *influxQuery) orderByTimeDesc() *influxQuery {
+	q.order = "ORDER BY time DESC"
+	return q
+}
+
+// orderByTimeAsc returns the oldest points first
+func (q *influxQuery) orderByTimeAsc() *influxQuery {
+	q.order = "ORDER BY time ASC"
+	return q
+}
+
+// limit caps the number of points returned
+func (q *influxQuery) limit(n int) *influxQuery {
+	q.limitN = n
+	return q
+}
+
+// command renders the statement text, which never contains parameter values
+func (q *influxQuery) command() string {
+	parts := []string{q.statement}
+	if len(q.conditions) > 0 {
+		parts = append(parts, "WHERE "+strings.Join(q.conditions, " AND "))
+	}
+	if len(q.groupBy) > 0 {
+		parts = append(parts, "GROUP BY "+strings.Join(q.groupBy, ", "))
+	}
+	if q.fill != "" {
+		parts = append(parts, fmt.Sprintf("fill(%s)", q.fill))
+	}
+	if q.order != "" {
+		parts = append(parts, q.order)
+	}
+	if q.limitN > 0 {
+		parts = append(parts, fmt.Sprintf("LIMIT %d", q.limitN))
+	}
+	return strings.Join(parts, " ")
+}
+
+// batchInfluxQueries combines queries into one request of several statements,
+// whose results are returned in order. Parameters with the same name must have
+// the same value in every query.
+func batchInfluxQueries(queries ...*influxQuery) *influxQuery {
+	commands := make([]string, 0, len(queries))
+	batch := newInfluxQuery("")
+	for _, q := range queries {
+		commands = append(commands, q.command())
+		for name, value := range q.params {
+			batch.params[name] = value
+		}
+	}
+	batch.statement = strings.Join(commands, "; ")
+	return batch
+}
+
+// build creates the client query to run against the database
+func (q *influxQuery) build(databaseName string) client.Query {
+	return client.NewQueryWithParameters(q.command(), databaseName, "", q.params)
+}
+
+// quoteIdentifier quotes a measurement, tag or field name for use in InfluxQL
+func quoteIdentifier(name string) string {
+	return "\"" + strings.Replace(strings.Replace(name, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const hostileSensorID = "1' or account_id = 'account2"
+
+func TestInfluxQueryBindsTagValues(t *testing.T) {
+	q := selectSensorMeasurements("account1", hostileSensorID, nil).
+		orderByTimeDesc().
+		limit(1).
+		build("streammarker_measurements")
+
+	assert.Equal(t, `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id ORDER BY time DESC LIMIT 1`, q.Command)
+	assert.Equal(t, "streammarker_measurements", q.Database)
+	assert.Equal(t, hostileSensorID, q.Parameters["sensor_id"])
+	assert.Equal(t, "account1", q.Parameters["account_id"])
+}
+
+func TestInfluxQueryBindsTimeRange(t *testing.T) {
+	q := selectSensorMeasurements("account1", "sensor1", nil).
+		whereTimeBetween(time.Unix(0, 0), time.Unix(60, 0)).
+		build("streammarker_measurements")
+
+	assert.Equal(t, `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time`, q.Command)
+	assert.Equal(t, "1970-01-01T00:00:00Z", q.Parameters["start_time"])
+	assert.Equal(t, "1970-01-01T00:01:00Z", q.Parameters["end_time"])
+}
+
+func TestInfluxQueryRepeatedParameterNames(t *testing.T) {
+	q := newInfluxQuery("SELECT * FROM m").
+		where("value", ">", 1).
+		where("value", "<", 5)
+
+	assert.Equal(t, `SELECT * FROM m WHERE "value" > $value AND "value" < $value_1`, q.command())
+	assert.Equal(t, 1, q.params["value"])
+	assert.Equal(t, 5, q.params["value_1"])
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	assert.Equal(t, `"sensor_measurements"`, quoteIdentifier("sensor_measurements"))
+	assert.Equal(t, `"a\"b\\c"`, quoteIdentifier(`a"b\c`))
+}
+
+func TestInfluxQueryGroupByTime(t *testing.T) {
+	q, columnPrefix := selectSensorReadings("account1", []string{"sensor1"}, 0, 3600, &ReadingsQueryOptions{Interval: 5 * time.Minute, Aggregate: AggregateMean, Fill: "previous"})
+
+	assert.Equal(t, `SELECT mean(*) FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time GROUP BY time(300s) fill(previous) ORDER BY time DESC`, q.command())
+	assert.Equal(t, "mean_", columnPrefix)
+}
+
+func TestInfluxQueryMeasurementProjection(t *testing.T) {
+	assert.Equal(t, `SELECT "soil_moisture", "temp\"erature" FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id`,
+		selectSensorMeasurements("account1", "sensor1", []string{"soil_moisture", `temp"erature`}).command())
+	assert.Equal(t, `max("soil_moisture") AS "max_soil_moisture"`, aggregateProjection(AggregateMax, []string{"soil_moisture"}))
+}
+
+func TestInfluxQueryWhereTagIn(t *testing.T) {
+	q := newInfluxQuery("SELECT * FROM m").
+		whereTagIn("sensor_id", []string{"sensor1", "sensor2", "sensor3"}).
+		whereTagEquals("sensor_id", "sensor4")
+
+	assert.Equal(t, `SELECT * FROM m WHERE ("sensor_id" = $sensor_id OR "sensor_id" = $sensor_id_1 OR "sensor_id" = $sensor_id_2) AND "sensor_id" = $sensor_id_3`, q.command())
+	assert.Equal(t, "sensor3", q.params["sensor_id_2"])
+	assert.Equal(t, "sensor4", q.params["sensor_id_3"])
+}
+
+func TestReadingsQueryOptionsValidate(t *testing.T) {
+	assert.NoError(t, (&ReadingsQueryOptions{}).Validate())
+	assert.NoError(t, (&ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMax, Fill: "0"}).Validate())
+	assert.Equal(t, ErrInvalidAggregation, (&ReadingsQueryOptions{Aggregate: AggregateMax}).Validate())
+	assert.Equal(t, ErrInvalidAggregation, (&ReadingsQueryOptions{Interval: time.Hour, Aggregate: "sum); DROP"}).Validate())
+	assert.Equal(t, ErrInvalidAggregation, (&ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Fill: "0) DROP"}).Validate())
+	assert.Equal(t, ErrInvalidAggregation, (&ReadingsQueryOptions{Interval: 1500 * time.Millisecond, Aggregate: AggregateMean}).Validate())
+	assert.NoError(t, (&ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Fill: "-2.5"}).Validate())
+	for _, fill := range []string{"NaN", "Inf", "-Inf", "+Infinity", "0x1p-2", "1e3", ".5", "1_000", "1" + strings.Repeat("0", 400)} {
+		assert.Equal(t, ErrInvalidAggregation, (&ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Fill: fill}).Validate(), fill)
+	}
+}
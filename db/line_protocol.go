@@ -0,0 +1,56 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// lineProtocolPrecisions are the units timestamps in line protocol may be
+// given in, with an empty precision meaning nanoseconds
+var lineProtocolPrecisions = map[string]bool{
+	"":   true,
+	"n":  true,
+	"ns": true,
+	"u":  true,
+	"ms": true,
+	"s":  true,
+}
+
+// SensorPoint is a point to be written to InfluxDB, keeping the full precision
+// of its time and the types of its field values
+type SensorPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Time        time.Time
+}
+
+// ParseSensorPoints parses points in InfluxDB line protocol. Timestamps are in
+// the given precision, one of n, ns, u, ms or s, and points without one are
+// given the current time.
+func ParseSensorPoints(data []byte, precision string) ([]*SensorPoint, error) {
+	if !lineProtocolPrecisions[precision] {
+		return nil, fmt.Errorf("Unknown precision: %s", precision)
+	}
+	parsed, err := models.ParsePointsWithPrecision(data, time.Now().UTC(), precision)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]*SensorPoint, 0, len(parsed))
+	for _, p := range parsed {
+		fields, err := p.Fields()
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, &SensorPoint{
+			Measurement: string(p.Name()),
+			Tags:        p.Tags().Map(),
+			Fields:      fields,
+			Time:        p.Time(),
+		})
+	}
+	return points, nil
+}
@@ -0,0 +1,25 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSensorPoints(t *testing.T) {
+	points, err := ParseSensorPoints([]byte("sensor_measurements,sensor_id=sensor1 temperature=21.5,battery_level=87i 1462060800\n"), "s")
+
+	assert.NoError(t, err)
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, "sensor_measurements", points[0].Measurement)
+		assert.Equal(t, map[string]string{"sensor_id": "sensor1"}, points[0].Tags)
+		assert.Equal(t, 21.5, points[0].Fields["temperature"])
+		assert.Equal(t, int64(87), points[0].Fields["battery_level"])
+		assert.Equal(t, int64(1462060800), points[0].Time.Unix())
+	}
+}
+
+func TestParseSensorPointsUnknownPrecision(t *testing.T) {
+	_, err := ParseSensorPoints([]byte("sensor_measurements,sensor_id=sensor1 temperature=21.5 1"), "d")
+	assert.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	// MeasurementMatchExact matches a column with exactly the measurement type name
+	MeasurementMatchExact = "exact"
+	// MeasurementMatchPrefix matches columns starting with the measurement type name
+	MeasurementMatchPrefix = "prefix"
+	// MeasurementMatchContains matches columns containing the measurement type name
+	MeasurementMatchContains = "contains"
+
+	// MeasurementValueFloat is a measurement with a floating-point value
+	MeasurementValueFloat = "float"
+	// MeasurementValueInteger is a measurement with a whole-number value
+	MeasurementValueInteger = "integer"
+	// MeasurementValueBoolean is a measurement that is on or off, reported as 1 or 0
+	MeasurementValueBoolean = "boolean"
+)
+
+// measurementTagColumns are the columns of sensor measurement series that hold
+// tags or timestamps rather than measurement values
+var measurementTagColumns = map[string]bool{
+	"time":       true,
+	"sensor_id":  true,
+	"account_id": true,
+}
+
+// MeasurementType describes the unit and value type of the measurements stored
+// in matching InfluxDB fields
+type MeasurementType struct {
+	Name      string `json:"name"`
+	Match     string `json:"match"`
+	Unit      string `json:"unit"`
+	ValueType string `json:"value_type"`
+}
+
+// MeasurementRegistry maps InfluxDB field names to measurement types
+type MeasurementRegistry struct {
+	types []*MeasurementType
+}
+
+type measurementRegistryConfig struct {
+	MeasurementTypes []*MeasurementType `json:"measurement_types"`
+}
+
+// DefaultMeasurementRegistry returns the registry of measurements reported by
+// StreamMarker sensors
+func DefaultMeasurementRegistry() *MeasurementRegistry {
+	registry, _ := NewMeasurementRegistry([]*MeasurementType{
+		{Name: "temperature", Match: MeasurementMatchContains, Unit: "Celsius", ValueType: MeasurementValueFloat},
+		{Name: "humidity", Match: MeasurementMatchContains, Unit: "%", ValueType: MeasurementValueFloat},
+		{Name: "soil_moisture", Match: MeasurementMatchContains, Unit: "VWC", ValueType: MeasurementValueFloat},
+	})
+	return registry
+}
+
+// NewMeasurementRegistry creates a registry from a list of measurement types.
+// Columns are matched against exact names first, then against the remaining
+// types in the order given.
+func NewMeasurementRegistry(types []*MeasurementType) (*MeasurementRegistry, error) {
+	for _, t := range types {
+		if t.Name == "" {
+			return nil, fmt.Errorf("Measurement type is missing a name")
+		}
+		if t.Match == "" {
+			t.Match = MeasurementMatchExact
+		}
+		if t.ValueType == "" {
+			t.ValueType = MeasurementValueFloat
+		}
+		switch t.Match {
+		case MeasurementMatchExact, MeasurementMatchPrefix, MeasurementMatchContains:
+		default:
+			return nil, fmt.Errorf("Measurement type %s has unknown match: %s", t.Name, t.Match)
+		}
+		switch t.ValueType {
+		case MeasurementValueFloat, MeasurementValueInteger, MeasurementValueBoolean:
+		default:
+			return nil, fmt.Errorf("Measurement type %s has unknown value type: %s", t.Name, t.ValueType)
+		}
+	}
+	return &MeasurementRegistry{types}, nil
+}
+
+// LoadMeasurementRegistry reads a registry from a JSON config file
+func LoadMeasurementRegistry(path string) (*MeasurementRegistry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config measurementRegistryConfig
+	if err = json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, fmt.Errorf("Error parsing measurement types in %s: %s", path, err.Error())
+	}
+	return NewMeasurementRegistry(config.MeasurementTypes)
+}
+
+// MeasurementTypes returns the registered measurement types
+func (r *MeasurementRegistry) MeasurementTypes() []*MeasurementType {
+	return r.types
+}
+
+// Lookup finds the measurement type for a column, or nil if none matches
+func (r *MeasurementRegistry) Lookup(column string) *MeasurementType {
+	for _, t := range r.types {
+		if t.Match == MeasurementMatchExact && t.Name == column {
+			return t
+		}
+	}
+	for _, t := range r.types {
+		if (t.Match == MeasurementMatchPrefix && strings.HasPrefix(column, t.Name)) ||
+			(t.Match == MeasurementMatchContains && strings.Contains(column, t.Name)) {
+			return t
+		}
+	}
+	return nil
+}
+
+// measurementFromColumn converts the value of an InfluxDB column to a
+// measurement, returning false for tags, missing values and values that don't
+// match their measurement type. Unregistered numeric fields have no unit.
+func (r *MeasurementRegistry) measurementFromColumn(column string, value interface{}) (Measurement, bool) {
+	if measurementTagColumns[column] || value == nil {
+		return Measurement{}, false
+	}
+
+	valueType := MeasurementValueFloat
+	measurement := Measurement{Name: column}
+	if t := r.Lookup(column); t != nil {
+		valueType = t.ValueType
+		measurement.Unit = t.Unit
+	}
+
+	var err error
+	switch v := value.(type) {
+	case json.Number:
+		if valueType == MeasurementValueBoolean {
+			return measurement, false
+		}
+		measurement.Value, err = v.Float64()
+	case float64:
+		if valueType == MeasurementValueBoolean {
+			return measurement, false
+		}
+		measurement.Value = v
+	case bool:
+		if valueType != MeasurementValueBoolean {
+			return measurement, false
+		}
+		if v {
+			measurement.Value = 1
+		}
+	default:
+		return measurement, false
+	}
+	return measurement, err == nil
+}
+
+// fieldValue converts a measurement to the type of its InfluxDB field,
+// returning false for tags and values that don't match the measurement type.
+// Measurements without a unit are taken to be in the unit of their type.
+// Temperatures in Fahrenheit or Kelvin are converted to Celsius, and any
+// other unit must be the unit of the type.
+func (r *MeasurementRegistry) fieldValue(measurement Measurement) (interface{}, bool) {
+	if measurement.Name == "" || measurementTagColumns[measurement.Name] {
+		return nil, false
+	}
+
+	valueType := MeasurementValueFloat
+	unit := ""
+	if t := r.Lookup(measurement.Name); t != nil {
+		valueType = t.ValueType
+		unit = t.Unit
+	}
+	switch {
+	case measurement.Unit == "" || measurement.Unit == unit:
+	case unit == UnitCelsius && (measurement.Unit == UnitFahrenheit || measurement.Unit == UnitKelvin):
+		measurement.Value = toCelsius(measurement.Value, measurement.Unit)
+	default:
+		return nil, false
+	}
+	if math.IsNaN(measurement.Value) || math.IsInf(measurement.Value, 0) {
+		return nil, false
+	}
+
+	switch valueType {
+	case MeasurementValueInteger:
+		if measurement.Value != math.Trunc(measurement.Value) {
+			return nil, false
+		}
+		return int64(measurement.Value), true
+	case MeasurementValueBoolean:
+		if measurement.Value != 0 && measurement.Value != 1 {
+			return nil, false
+		}
+		return measurement.Value == 1, true
+	}
+	return measurement.Value, true
+}
+
+// typedFieldValue converts a parsed line protocol value to the type of its
+// InfluxDB field, returning false for strings and values that don't match the
+// measurement type
+func (r *MeasurementRegistry) typedFieldValue(name string, value interface{}) (interface{}, bool) {
+	measurement := Measurement{Name: name}
+	switch v := value.(type) {
+	case float64:
+		measurement.Value = v
+	case int64:
+		measurement.Value = float64(v)
+	case uint64:
+		measurement.Value = float64(v)
+	case bool:
+		if v {
+			measurement.Value = 1
+		}
+	default:
+		return nil, false
+	}
+	return r.fieldValue(measurement)
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeasurementRegistryLookupPrefersExactMatch(t *testing.T) {
+	registry, err := NewMeasurementRegistry([]*MeasurementType{
+		{Name: "battery", Match: MeasurementMatchPrefix, Unit: "V"},
+		{Name: "battery_percent", Unit: "%", ValueType: MeasurementValueInteger},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "%", registry.Lookup("battery_percent").Unit)
+	assert.Equal(t, "V", registry.Lookup("battery_1").Unit)
+	assert.Nil(t, registry.Lookup("light"))
+}
+
+func TestMeasurementRegistryRejectsUnknownValueType(t *testing.T) {
+	_, err := NewMeasurementRegistry([]*MeasurementType{{Name: "light", ValueType: "complex"}})
+	assert.Error(t, err)
+}
+
+func TestMeasurementFromColumn(t *testing.T) {
+	registry, _ := NewMeasurementRegistry([]*MeasurementType{
+		{Name: "temperature", Match: MeasurementMatchContains, Unit: "Celsius"},
+		{Name: "door_open", ValueType: MeasurementValueBoolean},
+	})
+
+	m, ok := registry.measurementFromColumn("soil_temperature", json.Number("21.5"))
+	assert.True(t, ok)
+	assert.Equal(t, Measurement{Name: "soil_temperature", Value: 21.5, Unit: "Celsius"}, m)
+
+	m, ok = registry.measurementFromColumn("door_open", true)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, m.Value)
+
+	// unregistered numeric fields are kept without a unit
+	m, ok = registry.measurementFromColumn("light", json.Number("300"))
+	assert.True(t, ok)
+	assert.Equal(t, Measurement{Name: "light", Value: 300}, m)
+
+	_, ok = registry.measurementFromColumn("sensor_id", "sensor1")
+	assert.False(t, ok)
+	_, ok = registry.measurementFromColumn("light", nil)
+	assert.False(t, ok)
+}
+
+func TestFieldValue(t *testing.T) {
+	registry, _ := NewMeasurementRegistry([]*MeasurementType{
+		{Name: "door_open", ValueType: MeasurementValueBoolean},
+		{Name: "battery_level", ValueType: MeasurementValueInteger},
+	})
+
+	v, ok := registry.fieldValue(Measurement{Name: "temperature", Value: 21.5})
+	assert.True(t, ok)
+	assert.Equal(t, 21.5, v)
+	v, ok = registry.fieldValue(Measurement{Name: "door_open", Value: 1})
+	assert.True(t, ok)
+	assert.Equal(t, true, v)
+	v, ok = registry.fieldValue(Measurement{Name: "battery_level", Value: 87})
+	assert.True(t, ok)
+	assert.Equal(t, int64(87), v)
+
+	for _, m := range []Measurement{{Name: "door_open", Value: 0.5}, {Name: "battery_level", Value: 87.5}, {Name: "sensor_id", Value: 1}, {Name: "", Value: 1}} {
+		_, ok = registry.fieldValue(m)
+		assert.False(t, ok, m.Name)
+	}
+}
+
+func TestFieldValueUnits(t *testing.T) {
+	registry := DefaultMeasurementRegistry()
+
+	v, ok := registry.fieldValue(Measurement{Name: "humidity", Value: 40, Unit: UnitRelativeHumidity})
+	assert.True(t, ok)
+	assert.Equal(t, 40.0, v)
+	v, ok = registry.fieldValue(Measurement{Name: "temperature", Value: 77, Unit: UnitFahrenheit})
+	assert.True(t, ok)
+	assert.InDelta(t, 25, v, 0.001)
+	v, ok = registry.fieldValue(Measurement{Name: "soil_temperature", Value: 283.15, Unit: UnitKelvin})
+	assert.True(t, ok)
+	assert.InDelta(t, 10, v, 0.001)
+
+	for _, m := range []Measurement{
+		{Name: "humidity", Value: 11.5, Unit: UnitAbsoluteHumidity},
+		{Name: "soil_moisture", Value: 30, Unit: UnitRelativeHumidity},
+		{Name: "temperature", Value: 21.5, Unit: "Rankine"},
+		{Name: "battery", Value: 80, Unit: UnitRelativeHumidity},
+	} {
+		_, ok = registry.fieldValue(m)
+		assert.False(t, ok, m.Name)
+	}
+}
+
+func TestLoadMeasurementRegistry(t *testing.T) {
+	f, _ := ioutil.TempFile("", "measurement_types")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"measurement_types":[{"name":"light","unit":"lux"},{"name":"battery","match":"prefix","unit":"V"}]}`)
+	f.Close()
+
+	registry, err := LoadMeasurementRegistry(f.Name())
+
+	assert.NoError(t, err)
+	assert.Len(t, registry.MeasurementTypes(), 2)
+	assert.Equal(t, MeasurementMatchExact, registry.Lookup("light").Match)
+	assert.Equal(t, MeasurementValueFloat, registry.Lookup("light").ValueType)
+}
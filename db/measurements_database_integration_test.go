@@ -0,0 +1,592 @@
+//go:build integration
+// +build integration
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// The suite runs against real InfluxDB servers, such as influxdb:1.8 and
+// influxdb:2.7 containers, found with these environment variables:
+//
+//   STREAMMARKER_TEST_INFLUXDB_ADDRESS   address of InfluxDB 1.x
+//   STREAMMARKER_TEST_INFLUXDB2_ADDRESS  address of InfluxDB 2.x
+//   STREAMMARKER_TEST_INFLUXDB2_ORG      organization of the 2.x token
+//   STREAMMARKER_TEST_INFLUXDB2_TOKEN    2.x token allowed to create buckets
+//
+// Each run writes to a new database or bucket, which is dropped afterwards.
+// Versions without an address are skipped.
+
+// measurementsBackend opens a MeasurementsDatabase over an empty database of
+// one InfluxDB version. Queries fail with the error fail returns for the
+// sensor they're limited to, or for an empty sensor ID if they're for the
+// whole account.
+type measurementsBackend struct {
+	name string
+	open func(t *testing.T, deviceManager DeviceManager, registry *MeasurementRegistry, fail func(sensorID string) error) (MeasurementsDatabase, func())
+}
+
+var measurementsBackends = []measurementsBackend{
+	{name: "InfluxQL", open: openInfluxQLBackend},
+	{name: "Flux", open: openFluxBackend},
+}
+
+// failingInfluxClient is an InfluxDB client whose queries fail with the error
+// fail returns, if any
+type failingInfluxClient struct {
+	client.Client
+	fail func(q client.Query) error
+}
+
+func (c *failingInfluxClient) Query(q client.Query) (*client.Response, error) {
+	if err := c.fail(q); err != nil {
+		return nil, err
+	}
+	return c.Client.Query(q)
+}
+
+func (c *failingInfluxClient) QueryAsChunk(q client.Query) (*client.ChunkedResponse, error) {
+	if err := c.fail(q); err != nil {
+		return nil, err
+	}
+	return c.Client.QueryAsChunk(q)
+}
+
+// runInfluxQL runs a statement that returns no results, such as CREATE DATABASE
+func runInfluxQL(c client.Client, command string) error {
+	response, err := c.Query(client.NewQuery(command, "", ""))
+	if err != nil {
+		return err
+	}
+	return response.Error()
+}
+
+func openInfluxQLBackend(t *testing.T, deviceManager DeviceManager, registry *MeasurementRegistry, fail func(sensorID string) error) (MeasurementsDatabase, func()) {
+	address := os.Getenv("STREAMMARKER_TEST_INFLUXDB_ADDRESS")
+	if address == "" {
+		t.Skip("STREAMMARKER_TEST_INFLUXDB_ADDRESS is not set")
+	}
+	c, err := client.NewHTTPClient(client.HTTPConfig{Addr: address, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	databaseName := fmt.Sprintf("streammarker_test_%d", time.Now().UnixNano())
+	if err = runInfluxQL(c, "CREATE DATABASE "+quoteIdentifier(databaseName)); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+
+	failing := &failingInfluxClient{Client: c, fail: func(q client.Query) error {
+		sensorID, _ := q.Parameters["sensor_id"].(string)
+		return fail(sensorID)
+	}}
+	return NewInfluxDAOWithClient(failing, databaseName, deviceManager, registry), func() {
+		if err := runInfluxQL(c, "DROP DATABASE "+quoteIdentifier(databaseName)); err != nil {
+			t.Error(err)
+		}
+		c.Close()
+	}
+}
+
+// fluxSensorPattern finds the sensor a Flux query is limited to
+var fluxSensorPattern = regexp.MustCompile(`r\["sensor_id"\] == "([^"]*)"`)
+
+// influxDB2Request sends a request with a JSON body, if given, to the v2 API,
+// decoding the JSON response into out, if given
+func influxDB2Request(t *testing.T, method, address, token string, body, out interface{}) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, address, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		t.Fatalf("%s %s returned %s", method, address, resp.Status)
+	}
+	if out != nil {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func openFluxBackend(t *testing.T, deviceManager DeviceManager, registry *MeasurementRegistry, fail func(sensorID string) error) (MeasurementsDatabase, func()) {
+	address := strings.TrimRight(os.Getenv("STREAMMARKER_TEST_INFLUXDB2_ADDRESS"), "/")
+	if address == "" {
+		t.Skip("STREAMMARKER_TEST_INFLUXDB2_ADDRESS is not set")
+	}
+	target, err := url.Parse(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, token := os.Getenv("STREAMMARKER_TEST_INFLUXDB2_ORG"), os.Getenv("STREAMMARKER_TEST_INFLUXDB2_TOKEN")
+
+	var orgs struct {
+		Orgs []struct {
+			ID string `json:"id"`
+		} `json:"orgs"`
+	}
+	influxDB2Request(t, "GET", address+"/api/v2/orgs?org="+url.QueryEscape(org), token, nil, &orgs)
+	if len(orgs.Orgs) != 1 {
+		t.Fatalf("Organization %s was not found", org)
+	}
+	var bucket struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	influxDB2Request(t, "POST", address+"/api/v2/buckets", token, map[string]interface{}{
+		"orgID":          orgs.Orgs[0].ID,
+		"name":           fmt.Sprintf("streammarker_test_%d", time.Now().UnixNano()),
+		"retentionRules": []interface{}{},
+	}, &bucket)
+
+	// queries pass through a proxy, which fails them before they reach InfluxDB
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	s := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v2/query" {
+			body, _ := ioutil.ReadAll(req.Body)
+			var query fluxQueryRequest
+			json.Unmarshal(body, &query)
+			sensorID := ""
+			if match := fluxSensorPattern.FindStringSubmatch(query.Query); match != nil {
+				sensorID = match[1]
+			}
+			if err := fail(sensorID); err != nil {
+				resp.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(resp).Encode(&fluxAPIError{Code: "internal error", Message: err.Error()})
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		proxy.ServeHTTP(resp, req)
+	}))
+	return NewFluxDAOWithClient(s.Client(), s.URL, org, bucket.Name, token, deviceManager, registry), func() {
+		s.Close()
+		influxDB2Request(t, "DELETE", address+"/api/v2/buckets/"+bucket.ID, token, nil, nil)
+	}
+}
+
+// suiteStart is the start of the hour of the first suite reading
+const suiteStart = 1462060800
+
+// suiteEnd is the last second of the suite's readings
+const suiteEnd = suiteStart + 4*3600 - 1
+
+func suiteTime(hours, minutes int64) int64 {
+	return suiteStart + hours*3600 + minutes*60
+}
+
+func suiteRegistry() *MeasurementRegistry {
+	types := DefaultMeasurementRegistry().MeasurementTypes()
+	types = append(types,
+		&MeasurementType{Name: "battery", Unit: "%", ValueType: MeasurementValueInteger},
+		&MeasurementType{Name: "door_open", ValueType: MeasurementValueBoolean},
+	)
+	registry, _ := NewMeasurementRegistry(types)
+	return registry
+}
+
+// writeSuiteReadings writes the readings the suite queries through a database.
+// Sensor 1 is missing a humidity at 01:00, and sensor 2 is missing one in its
+// last reading, so the readings of some times and buckets are incomplete.
+func writeSuiteReadings(t *testing.T, database MeasurementsDatabase) {
+	reading := func(timestamp int64, temperature float64, humidity ...float64) *MinimalReading {
+		r := &MinimalReading{Timestamp: timestamp, Measurements: []Measurement{{Name: "temperature", Value: temperature}}}
+		for _, h := range humidity {
+			r.Measurements = append(r.Measurements, Measurement{Name: "humidity", Value: h})
+		}
+		return r
+	}
+	writes := []struct {
+		accountID, sensorID string
+		readings            []*MinimalReading
+	}{
+		{"account1", "sensor1", []*MinimalReading{
+			reading(suiteTime(0, 0), 20, 50),
+			reading(suiteTime(0, 30), 22, 52),
+			reading(suiteTime(1, 0), 21),
+			reading(suiteTime(3, 0), 25, 60),
+			reading(suiteTime(3, 30), 27, 58),
+		}},
+		{"account1", "sensor2", []*MinimalReading{
+			reading(suiteTime(0, 15), 18, 40),
+			reading(suiteTime(2, 45), 19),
+		}},
+		{"account2", "sensor3", []*MinimalReading{
+			reading(suiteTime(0, 0), 30, 70),
+		}},
+	}
+	for _, w := range writes {
+		if err := database.WriteSensorReadings(w.accountID, w.sensorID, w.readings); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags := map[string]string{"account_id": "account1", "sensor_id": "sensor4"}
+	err := database.WriteSensorPoints([]*SensorPoint{
+		{Measurement: "sensor_measurements", Tags: tags, Fields: map[string]interface{}{"battery": int64(90), "door_open": false}, Time: time.Unix(suiteTime(0, 0), 0)},
+		{Measurement: "sensor_measurements", Tags: tags, Fields: map[string]interface{}{"battery": int64(80), "door_open": true}, Time: time.Unix(suiteTime(1, 0), 0)},
+		{Measurement: "sensor_measurements", Tags: tags, Fields: map[string]interface{}{"battery": int64(60)}, Time: time.Unix(suiteTime(3, 0), 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// describeMeasurements renders measurements in order of name, so readings of
+// both backends can be compared however their columns are ordered
+func describeMeasurements(measurements []Measurement) string {
+	parts := make([]string, 0, len(measurements))
+	for _, m := range measurements {
+		part := fmt.Sprintf("%s=%.6g", m.Name, m.Value)
+		if m.Unit != "" {
+			part += m.Unit
+		}
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// describeReadings renders each reading as its offset from the start of the
+// suite's readings followed by its measurements
+func describeReadings(readings []*MinimalReading) []string {
+	described := make([]string, 0, len(readings))
+	for _, r := range readings {
+		offset := time.Duration(r.Timestamp-suiteStart) * time.Second
+		described = append(described, strings.TrimSpace(fmt.Sprintf("%s %s", offset, describeMeasurements(r.Measurements))))
+	}
+	return described
+}
+
+// queryAllPages follows the cursors of a readings query, returning each page
+func queryAllPages(t *testing.T, database MeasurementsDatabase, sensorID string, options ReadingsQueryOptions) [][]string {
+	var pages [][]string
+	for {
+		results, err := database.QueryForSensorReadings("account1", sensorID, suiteStart, suiteEnd, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, describeReadings(results.Readings))
+		if results.NextCursor == "" || len(pages) > 10 {
+			return pages
+		}
+		options.Cursor = results.NextCursor
+	}
+}
+
+func TestMeasurementsDatabase(t *testing.T) {
+	for _, backend := range measurementsBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			testMeasurementsDatabase(t, backend)
+		})
+	}
+}
+
+func testMeasurementsDatabase(t *testing.T, backend measurementsBackend) {
+	deviceManager := &sensorListDeviceManager{sensors: []*Sensor{
+		{ID: "sensor1", AccountID: "account1"},
+		{ID: "sensor2", AccountID: "account1"},
+		{ID: "sensor4", AccountID: "account1"},
+		{ID: "sensor5", AccountID: "account1"},
+	}}
+	var failing func(sensorID string) error
+	database, closeDatabase := backend.open(t, deviceManager, suiteRegistry(), func(sensorID string) error {
+		if failing != nil {
+			return failing(sensorID)
+		}
+		return nil
+	})
+	defer closeDatabase()
+	writeSuiteReadings(t, database)
+
+	t.Run("GetLastSensorReadings", func(t *testing.T) {
+		readings, err := database.GetLastSensorReadings("account1", "", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, readings.Partial)
+		assert.Len(t, readings.Sensors, 4)
+		assert.Equal(t, suiteTime(3, 30), readings.Sensors["sensor1"].Timestamp)
+		assert.Equal(t, "humidity=58% temperature=27Celsius", describeMeasurements(readings.Sensors["sensor1"].Measurements))
+		// the last point of sensor 2 has no humidity, so its earlier one isn't
+		// returned alongside the last temperature
+		assert.Equal(t, suiteTime(2, 45), readings.Sensors["sensor2"].Timestamp)
+		assert.Equal(t, "temperature=19Celsius", describeMeasurements(readings.Sensors["sensor2"].Measurements))
+		assert.Equal(t, suiteTime(3, 0), readings.Sensors["sensor4"].Timestamp)
+		assert.Equal(t, "battery=60%", describeMeasurements(readings.Sensors["sensor4"].Measurements))
+		assert.Empty(t, readings.Sensors["sensor5"].Measurements)
+	})
+
+	t.Run("GetLastSensorReadingsProjectsMeasurements", func(t *testing.T) {
+		readings, err := database.GetLastSensorReadings("account1", "", false, []string{"humidity"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "humidity=58%", describeMeasurements(readings.Sensors["sensor1"].Measurements))
+		assert.Equal(t, suiteTime(0, 15), readings.Sensors["sensor2"].Timestamp)
+		assert.Equal(t, "humidity=40%", describeMeasurements(readings.Sensors["sensor2"].Measurements))
+		assert.Empty(t, readings.Sensors["sensor4"].Measurements)
+	})
+
+	t.Run("GetLastSensorReadingsPerSensorAfterFailure", func(t *testing.T) {
+		failing = func(sensorID string) error {
+			if sensorID == "" || sensorID == "sensor2" {
+				return fmt.Errorf("timeout")
+			}
+			return nil
+		}
+		defer func() { failing = nil }()
+
+		readings, err := database.GetLastSensorReadings("account1", "", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, readings.Partial)
+		assert.Equal(t, "humidity=58% temperature=27Celsius", describeMeasurements(readings.Sensors["sensor1"].Measurements))
+		assert.Contains(t, readings.Sensors["sensor2"].Error, "timeout")
+		assert.Empty(t, readings.Sensors["sensor2"].Measurements)
+	})
+
+	t.Run("GetLastSensorReadingsWithEverySensorFailing", func(t *testing.T) {
+		failing = func(sensorID string) error {
+			return fmt.Errorf("timeout")
+		}
+		defer func() { failing = nil }()
+
+		readings, err := database.GetLastSensorReadings("account1", "", false, nil)
+		assert.Error(t, err)
+		assert.Nil(t, readings)
+	})
+
+	t.Run("QueryForSensorReadings", func(t *testing.T) {
+		assert.Equal(t, [][]string{
+			{"3h30m0s humidity=58% temperature=27Celsius", "3h0m0s humidity=60% temperature=25Celsius"},
+			{"1h0m0s temperature=21Celsius", "30m0s humidity=52% temperature=22Celsius"},
+			{"0s humidity=50% temperature=20Celsius"},
+		}, queryAllPages(t, database, "sensor1", ReadingsQueryOptions{Limit: 2}))
+		assert.Equal(t, [][]string{
+			{"0s humidity=50% temperature=20Celsius", "30m0s humidity=52% temperature=22Celsius"},
+			{"1h0m0s temperature=21Celsius", "3h0m0s humidity=60% temperature=25Celsius"},
+			{"3h30m0s humidity=58% temperature=27Celsius"},
+		}, queryAllPages(t, database, "sensor1", ReadingsQueryOptions{Limit: 2, Ascending: true}))
+	})
+
+	t.Run("QueryForSensorReadingsProjectsMeasurements", func(t *testing.T) {
+		assert.Equal(t, [][]string{
+			{"3h30m0s humidity=58%", "3h0m0s humidity=60%", "30m0s humidity=52%", "0s humidity=50%"},
+		}, queryAllPages(t, database, "sensor1", ReadingsQueryOptions{Measurements: []string{"humidity"}}))
+	})
+
+	t.Run("QueryForSensorReadingsOfOtherAccount", func(t *testing.T) {
+		assert.Equal(t, [][]string{{}}, queryAllPages(t, database, "sensor3", ReadingsQueryOptions{}))
+	})
+
+	t.Run("QueryForSensorReadingsWithTypedMeasurements", func(t *testing.T) {
+		assert.Equal(t, [][]string{
+			{"0s battery=90% door_open=0", "1h0m0s battery=80% door_open=1", "3h0m0s battery=60%"},
+		}, queryAllPages(t, database, "sensor4", ReadingsQueryOptions{Ascending: true}))
+	})
+
+	t.Run("QueryForSensorReadingsAggregates", func(t *testing.T) {
+		hourly := func(fill string) ReadingsQueryOptions {
+			return ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Fill: fill, Ascending: true}
+		}
+		assert.Equal(t, [][]string{
+			{"0s humidity=51% temperature=21Celsius", "1h0m0s temperature=21Celsius", "3h0m0s humidity=59% temperature=26Celsius"},
+		}, queryAllPages(t, database, "sensor1", hourly("none")))
+		assert.Equal(t, [][]string{
+			{"0s humidity=51% temperature=21Celsius", "1h0m0s temperature=21Celsius", "2h0m0s", "3h0m0s humidity=59% temperature=26Celsius"},
+		}, queryAllPages(t, database, "sensor1", hourly("null")))
+		assert.Equal(t, [][]string{
+			{"0s humidity=51% temperature=21Celsius", "1h0m0s humidity=51% temperature=21Celsius", "2h0m0s humidity=51% temperature=21Celsius", "3h0m0s humidity=59% temperature=26Celsius"},
+		}, queryAllPages(t, database, "sensor1", hourly("previous")))
+		assert.Equal(t, [][]string{
+			{"0s humidity=51% temperature=21Celsius", "1h0m0s humidity=53.6667% temperature=21Celsius", "2h0m0s humidity=56.3333% temperature=23.5Celsius", "3h0m0s humidity=59% temperature=26Celsius"},
+		}, queryAllPages(t, database, "sensor1", hourly("linear")))
+		// InfluxQL fills every field of the measurement with a number, even
+		// those the sensor doesn't have, so the filled measurements are named
+		numericFill := hourly("-1")
+		numericFill.Measurements = []string{"temperature", "humidity"}
+		assert.Equal(t, [][]string{
+			{"0s humidity=51% temperature=21Celsius", "1h0m0s humidity=-1% temperature=21Celsius", "2h0m0s humidity=-1% temperature=-1Celsius", "3h0m0s humidity=59% temperature=26Celsius"},
+		}, queryAllPages(t, database, "sensor1", numericFill))
+		// integer measurements are interpolated as floats
+		assert.Equal(t, [][]string{
+			{"0s battery=90%", "1h0m0s battery=80%", "2h0m0s battery=70%", "3h0m0s battery=60%"},
+		}, queryAllPages(t, database, "sensor4", ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMax, Fill: "linear", Ascending: true, Measurements: []string{"battery"}}))
+	})
+
+	t.Run("QueryForSensorReadingsPaginatesAggregates", func(t *testing.T) {
+		options := ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Fill: "null", Limit: 2}
+		assert.Equal(t, [][]string{
+			{"3h0m0s humidity=59% temperature=26Celsius", "2h0m0s"},
+			{"1h0m0s temperature=21Celsius", "0s humidity=51% temperature=21Celsius"},
+			{},
+		}, queryAllPages(t, database, "sensor1", options))
+		// each page starts at the bucket after the last one returned, rather
+		// than regrouping the rest of that bucket's readings
+		options.Ascending = true
+		options.Aggregate = AggregateLast
+		assert.Equal(t, [][]string{
+			{"0s humidity=52% temperature=22Celsius", "1h0m0s temperature=21Celsius"},
+			{"2h0m0s", "3h0m0s humidity=58% temperature=27Celsius"},
+			{},
+		}, queryAllPages(t, database, "sensor1", options))
+	})
+
+	t.Run("QueryForMultipleSensorReadings", func(t *testing.T) {
+		results, err := database.QueryForMultipleSensorReadings("account1", []string{"sensor1", "sensor2", "sensor3"}, suiteStart, suiteEnd, &ReadingsQueryOptions{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, results, 3)
+		assert.Equal(t, []string{"3h30m0s humidity=58% temperature=27Celsius"}, describeReadings(results["sensor1"].Readings))
+		assert.Equal(t, []string{"2h45m0s temperature=19Celsius"}, describeReadings(results["sensor2"].Readings))
+		assert.Empty(t, results["sensor3"].Readings)
+
+		results, err = database.QueryForMultipleSensorReadings("account1", []string{"sensor1", "sensor2"}, suiteStart, suiteEnd, &ReadingsQueryOptions{Interval: 2 * time.Hour, Aggregate: AggregateMin, Ascending: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"0s humidity=50% temperature=20Celsius", "2h0m0s humidity=58% temperature=25Celsius"}, describeReadings(results["sensor1"].Readings))
+		assert.Equal(t, []string{"0s humidity=40% temperature=18Celsius", "2h0m0s temperature=19Celsius"}, describeReadings(results["sensor2"].Readings))
+	})
+
+	t.Run("GetSensorExtremes", func(t *testing.T) {
+		extremes, err := database.GetSensorExtremes("account1", "sensor1", suiteStart, suiteEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []*MinMaxMeasurement{
+			{Name: "humidity", Min: Measurement{Name: "humidity", Value: 50, Unit: "%", Timestamp: suiteTime(0, 0)}, Max: Measurement{Name: "humidity", Value: 60, Unit: "%", Timestamp: suiteTime(3, 0)}},
+			{Name: "temperature", Min: Measurement{Name: "temperature", Value: 20, Unit: "Celsius", Timestamp: suiteTime(0, 0)}, Max: Measurement{Name: "temperature", Value: 27, Unit: "Celsius", Timestamp: suiteTime(3, 30)}},
+		}, extremes)
+
+		// boolean measurements have no extremes
+		extremes, err = database.GetSensorExtremes("account1", "sensor4", suiteStart, suiteEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []*MinMaxMeasurement{
+			{Name: "battery", Min: Measurement{Name: "battery", Value: 60, Unit: "%", Timestamp: suiteTime(3, 0)}, Max: Measurement{Name: "battery", Value: 90, Unit: "%", Timestamp: suiteTime(0, 0)}},
+		}, extremes)
+	})
+
+	t.Run("GetDailySummaries", func(t *testing.T) {
+		// the readings are all on the evening of April 30th in Los Angeles
+		location, _ := time.LoadLocation("America/Los_Angeles")
+		summaries, err := database.GetDailySummaries("account1", "sensor1", time.Date(2016, 4, 30, 12, 0, 0, 0, location), time.Date(2016, 5, 1, 12, 0, 0, 0, location))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, summaries, 2)
+		assert.Equal(t, []*DailyMeasurementSummary{
+			{Name: "humidity", Unit: "%", Min: 50, Mean: 55, Max: 60},
+			{Name: "temperature", Unit: "Celsius", Min: 20, Mean: 23, Max: 27},
+		}, summaries[0].Measurements)
+		assert.Empty(t, summaries[1].Measurements)
+	})
+
+	t.Run("GetDailySummariesAcrossDaylightSaving", func(t *testing.T) {
+		// March 13th is 23 hours long in Los Angeles, so the first reading is
+		// in its last hour and the second is in the next day
+		err := database.WriteSensorReadings("account1", "sensor6", []*MinimalReading{
+			{Timestamp: time.Date(2016, 3, 14, 6, 30, 0, 0, time.UTC).Unix(), Measurements: []Measurement{{Name: "temperature", Value: 10}}},
+			{Timestamp: time.Date(2016, 3, 14, 7, 30, 0, 0, time.UTC).Unix(), Measurements: []Measurement{{Name: "temperature", Value: 12}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		location, _ := time.LoadLocation("America/Los_Angeles")
+		summaries, err := database.GetDailySummaries("account1", "sensor6", time.Date(2016, 3, 13, 9, 0, 0, 0, location), time.Date(2016, 3, 14, 9, 0, 0, 0, location))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, summaries, 2)
+		assert.Equal(t, []*DailyMeasurementSummary{{Name: "temperature", Unit: "Celsius", Min: 10, Mean: 10, Max: 10}}, summaries[0].Measurements)
+		assert.Equal(t, []*DailyMeasurementSummary{{Name: "temperature", Unit: "Celsius", Min: 12, Mean: 12, Max: 12}}, summaries[1].Measurements)
+	})
+
+	t.Run("StreamSensorReadings", func(t *testing.T) {
+		w := &collectingReadingsWriter{}
+		// InfluxQL names every field of the measurement for a wildcard, so
+		// the streamed measurements are named
+		options := &ReadingsQueryOptions{Interval: time.Hour, Aggregate: AggregateMean, Ascending: true, Measurements: []string{"temperature", "humidity"}}
+		if err := database.StreamSensorReadings("account1", "sensor1", suiteStart, suiteEnd, options, w); err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(w.columns, func(a, b int) bool { return w.columns[a].Name < w.columns[b].Name })
+		assert.Equal(t, []*MeasurementColumn{{Name: "humidity", Unit: "%"}, {Name: "temperature", Unit: "Celsius"}}, w.columns)
+		assert.Equal(t, []string{
+			"0s humidity=51% temperature=21Celsius",
+			"1h0m0s temperature=21Celsius",
+			"2h0m0s",
+			"3h0m0s humidity=59% temperature=26Celsius",
+		}, describeReadings(w.readings))
+	})
+
+	t.Run("WriteSensorReadingsRejectsInvalidReading", func(t *testing.T) {
+		err := database.WriteSensorReadings("account1", "sensor1", []*MinimalReading{
+			{Timestamp: suiteTime(3, 45), Measurements: []Measurement{{Name: "temperature", Value: 30}}},
+			{Timestamp: 0, Measurements: []Measurement{{Name: "temperature", Value: 31}}},
+		})
+		assert.Equal(t, ErrInvalidReading, err)
+		assert.Len(t, queryAllPages(t, database, "sensor1", ReadingsQueryOptions{})[0], 5)
+	})
+
+	t.Run("DeleteSensorReadings", func(t *testing.T) {
+		hostileSensorID := `sensor"1`
+		if err := database.WriteSensorReadings("account1", hostileSensorID, []*MinimalReading{{Timestamp: suiteTime(0, 0), Measurements: []Measurement{{Name: "temperature", Value: 10}}}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := database.DeleteSensorReadings("account1", hostileSensorID); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, [][]string{{}}, queryAllPages(t, database, hostileSensorID, ReadingsQueryOptions{}))
+		assert.Len(t, queryAllPages(t, database, "sensor1", ReadingsQueryOptions{})[0], 5)
+
+		// readings are only deleted from the sensor's account
+		if err := database.DeleteSensorReadings("account2", "sensor1"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, queryAllPages(t, database, "sensor1", ReadingsQueryOptions{})[0], 5)
+
+		if err := database.DeleteSensorReadings("account1", "sensor1"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, [][]string{{}}, queryAllPages(t, database, "sensor1", ReadingsQueryOptions{}))
+		assert.Len(t, queryAllPages(t, database, "sensor2", ReadingsQueryOptions{})[0], 2)
+	})
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// UnitSystemMetric returns measurements in the units they are recorded in
+	UnitSystemMetric = "metric"
+	// UnitSystemImperial returns temperatures in Fahrenheit
+	UnitSystemImperial = "imperial"
+
+	// UnitCelsius is the unit temperatures are recorded in
+	UnitCelsius = "Celsius"
+	// UnitFahrenheit is a temperature unit
+	UnitFahrenheit = "Fahrenheit"
+	// UnitKelvin is a temperature unit
+	UnitKelvin = "Kelvin"
+
+	// UnitRelativeHumidity is the unit humidity is recorded in
+	UnitRelativeHumidity = "%"
+	// UnitAbsoluteHumidity is grams of water vapour per cubic metre of air
+	UnitAbsoluteHumidity = "g/m³"
+
+	// airTemperatureMeasurement and humidityMeasurement are the measurements
+	// absolute humidity is computed from. Other measurements in Celsius or
+	// percent, like soil temperature or battery charge, are left alone.
+	airTemperatureMeasurement = "temperature"
+	humidityMeasurement       = "humidity"
+)
+
+// UnitOptions selects the units measurements are converted to when read
+type UnitOptions struct {
+	// Temperature is the unit for Celsius measurements, or empty to leave them
+	Temperature string
+	// AbsoluteHumidity converts relative humidity to absolute humidity using
+	// the temperature from the same reading
+	AbsoluteHumidity bool
+}
+
+// NewUnitOptions creates the unit options for a unit system, with an optional
+// override for the temperature unit
+func NewUnitOptions(system string, temperatureUnit string, absoluteHumidity bool) (*UnitOptions, error) {
+	options := &UnitOptions{AbsoluteHumidity: absoluteHumidity}
+	switch system {
+	case "", UnitSystemMetric:
+	case UnitSystemImperial:
+		options.Temperature = UnitFahrenheit
+	default:
+		return nil, fmt.Errorf("Unknown unit system: %s", system)
+	}
+
+	switch temperatureUnit {
+	case "":
+	case UnitCelsius, UnitFahrenheit, UnitKelvin:
+		options.Temperature = temperatureUnit
+	default:
+		return nil, fmt.Errorf("Unknown temperature unit: %s", temperatureUnit)
+	}
+	return options, nil
+}
+
+// ConvertMeasurements converts the measurements of one reading in place
+func (u *UnitOptions) ConvertMeasurements(measurements []Measurement) {
+	if u.AbsoluteHumidity {
+		convertHumidity(measurements)
+	}
+
+	for k := range measurements {
+		if measurements[k].Unit != UnitCelsius || u.Temperature == "" {
+			continue
+		}
+		measurements[k].Value = convertCelsius(measurements[k].Value, u.Temperature)
+		measurements[k].Unit = u.Temperature
+	}
+}
+
+// convertHumidity replaces the relative humidity of a reading with absolute
+// humidity, using the air temperature of the same reading
+func convertHumidity(measurements []Measurement) {
+	var temperature *Measurement
+	for k := range measurements {
+		if measurements[k].Name == airTemperatureMeasurement && measurements[k].Unit == UnitCelsius {
+			temperature = &measurements[k]
+			break
+		}
+	}
+	if temperature == nil {
+		return
+	}
+	for k := range measurements {
+		if measurements[k].Name == humidityMeasurement && measurements[k].Unit == UnitRelativeHumidity {
+			measurements[k].Value = absoluteHumidity(temperature.Value, measurements[k].Value)
+			measurements[k].Unit = UnitAbsoluteHumidity
+		}
+	}
+}
+
+// ConvertLatestReadings converts the measurements of every sensor's reading
+func (u *UnitOptions) ConvertLatestReadings(readings *LatestSensorReadings) {
+	for _, reading := range readings.Sensors {
+		u.ConvertMeasurements(reading.Measurements)
+	}
+}
+
+// ConvertSensorReadings converts the measurements of every reading of a sensor
+func (u *UnitOptions) ConvertSensorReadings(results *QueryForSensorReadingsResults) {
+	for _, reading := range results.Readings {
+		u.ConvertMeasurements(reading.Measurements)
+	}
+}
+
+func convertCelsius(celsius float64, unit string) float64 {
+	switch unit {
+	case UnitFahrenheit:
+		return celsius*9/5 + 32
+	case UnitKelvin:
+		return celsius + 273.15
+	}
+	return celsius
+}
+
+// toCelsius converts a temperature in Fahrenheit or Kelvin to Celsius
+func toCelsius(value float64, unit string) float64 {
+	switch unit {
+	case UnitFahrenheit:
+		return (value - 32) * 5 / 9
+	case UnitKelvin:
+		return value - 273.15
+	}
+	return value
+}
+
+// absoluteHumidity approximates the water vapour density of air from its
+// temperature and relative humidity, using the Magnus formula for saturation
+// vapour pressure
+func absoluteHumidity(celsius float64, relativeHumidity float64) float64 {
+	saturationPressure := 6.112 * math.Exp((17.67*celsius)/(celsius+243.5))
+	return saturationPressure * relativeHumidity * 2.1674 / (273.15 + celsius)
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUnitOptionsImperial(t *testing.T) {
+	options, err := NewUnitOptions(UnitSystemImperial, "", false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, UnitFahrenheit, options.Temperature)
+}
+
+func TestNewUnitOptionsTemperatureOverride(t *testing.T) {
+	options, err := NewUnitOptions(UnitSystemImperial, UnitKelvin, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, UnitKelvin, options.Temperature)
+}
+
+func TestNewUnitOptionsUnknown(t *testing.T) {
+	_, err := NewUnitOptions("nautical", "", false)
+	assert.Error(t, err)
+
+	_, err = NewUnitOptions(UnitSystemMetric, "Rankine", false)
+	assert.Error(t, err)
+}
+
+func TestConvertMeasurementsToFahrenheit(t *testing.T) {
+	measurements := []Measurement{
+		{Name: "temperature", Value: 25, Unit: UnitCelsius},
+		{Name: "humidity", Value: 50, Unit: UnitRelativeHumidity},
+	}
+
+	(&UnitOptions{Temperature: UnitFahrenheit}).ConvertMeasurements(measurements)
+
+	assert.Equal(t, Measurement{Name: "temperature", Value: 77, Unit: UnitFahrenheit}, measurements[0])
+	assert.Equal(t, Measurement{Name: "humidity", Value: 50, Unit: UnitRelativeHumidity}, measurements[1])
+}
+
+func TestConvertMeasurementsToAbsoluteHumidity(t *testing.T) {
+	measurements := []Measurement{
+		{Name: "humidity", Value: 50, Unit: UnitRelativeHumidity},
+		{Name: "temperature", Value: 25, Unit: UnitCelsius},
+	}
+
+	(&UnitOptions{Temperature: UnitKelvin, AbsoluteHumidity: true}).ConvertMeasurements(measurements)
+
+	// the humidity is computed from the temperature before it is converted
+	assert.Equal(t, UnitAbsoluteHumidity, measurements[0].Unit)
+	assert.InDelta(t, 11.5, measurements[0].Value, 0.1)
+	assert.Equal(t, UnitKelvin, measurements[1].Unit)
+	assert.InDelta(t, 298.15, measurements[1].Value, 0.001)
+}
+
+func TestConvertMeasurementsAbsoluteHumidityWithoutTemperature(t *testing.T) {
+	measurements := []Measurement{{Name: "humidity", Value: 50, Unit: UnitRelativeHumidity}}
+
+	(&UnitOptions{AbsoluteHumidity: true}).ConvertMeasurements(measurements)
+
+	assert.Equal(t, Measurement{Name: "humidity", Value: 50, Unit: UnitRelativeHumidity}, measurements[0])
+}
+
+func TestConvertMeasurementsAbsoluteHumidityUsesAirTemperature(t *testing.T) {
+	measurements := []Measurement{
+		{Name: "soil_temperature", Value: 10, Unit: UnitCelsius},
+		{Name: "battery", Value: 80, Unit: UnitRelativeHumidity},
+		{Name: "humidity", Value: 50, Unit: UnitRelativeHumidity},
+		{Name: "temperature", Value: 25, Unit: UnitCelsius},
+	}
+
+	(&UnitOptions{AbsoluteHumidity: true}).ConvertMeasurements(measurements)
+
+	assert.Equal(t, Measurement{Name: "soil_temperature", Value: 10, Unit: UnitCelsius}, measurements[0])
+	assert.Equal(t, Measurement{Name: "battery", Value: 80, Unit: UnitRelativeHumidity}, measurements[1])
+	assert.Equal(t, UnitAbsoluteHumidity, measurements[2].Unit)
+	assert.InDelta(t, 11.5, measurements[2].Value, 0.1)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mholt/binding"
+	"github.com/skidder/streammarker-data-access/db"
+)
+
+// AccountHandler instance
+type AccountHandler struct {
+	database db.AccountManager
+}
+
+// NewAccountHandler creates a new AccountHandler
+func NewAccountHandler(database db.AccountManager) *AccountHandler {
+	return &AccountHandler{database}
+}
+
+// InitializeRouterForAccountHandler initializes the handler on the given router
+func InitializeRouterForAccountHandler(r *mux.Router, database db.AccountManager) {
+	m := NewAccountHandler(database)
+	r.HandleFunc("/data-access/v1/account/{account_id}", m.GetAccount).Methods("GET")
+	r.HandleFunc("/data-access/v1/account/{account_id}", m.CreateAccount).Methods("POST")
+	r.HandleFunc("/data-access/v1/account/{account_id}", m.UpdateAccount).Methods("PUT")
+}
+
+// GetAccount retrieves an account from the database
+func (m *AccountHandler) GetAccount(resp http.ResponseWriter, req *http.Request) {
+	accountID := mux.Vars(req)["account_id"]
+	if !verifyAccountOwner(resp, req, accountID) {
+		return
+	}
+	if account, err := m.database.GetAccount(accountID); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(account)
+	} else if err == db.ErrAccountNotFound {
+		log.Printf("Account not found: %s", accountID)
+		http.Error(resp,
+			"Account not found",
+			http.StatusNotFound)
+	} else {
+		log.Printf("Error getting account: %s", err.Error())
+		http.Error(resp,
+			"Error getting account",
+			http.StatusInternalServerError)
+	}
+}
+
+// CreateAccount creates a new account record in the database. Callers bound
+// to an account may not create accounts.
+func (m *AccountHandler) CreateAccount(resp http.ResponseWriter, req *http.Request) {
+	if !verifyServiceCaller(resp, req) {
+		return
+	}
+
+	// bind the request to an account model
+	account := new(db.Account)
+	errs := binding.Bind(req, account)
+	if errs.Handle(resp) {
+		log.Printf("Error while binding request to model: %s", errs.Error())
+		http.Error(resp,
+			"Invalid request",
+			http.StatusBadRequest)
+		return
+	}
+
+	account.ID = mux.Vars(req)["account_id"]
+	if createdAccount, err := m.database.CreateAccount(account); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusCreated)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(createdAccount)
+	} else if err == db.ErrAlreadyExists {
+		log.Printf("Account already exists: %s", account.ID)
+		http.Error(resp,
+			"Account already exists",
+			http.StatusConflict)
+	} else {
+		log.Printf("Error creating account: %s", err.Error())
+		http.Error(resp,
+			"Error creating account",
+			http.StatusInternalServerError)
+	}
+}
+
+// UpdateAccount updates an account record in the database. Callers bound to
+// an account may not update accounts, so can't lift their own suspension.
+func (m *AccountHandler) UpdateAccount(resp http.ResponseWriter, req *http.Request) {
+	if !verifyServiceCaller(resp, req) {
+		return
+	}
+
+	// bind the request to an account model
+	accountUpdates := new(db.Account)
+	errs := binding.Bind(req, accountUpdates)
+	if errs.Handle(resp) {
+		log.Printf("Error while binding request to model: %s", errs.Error())
+		http.Error(resp,
+			"Invalid request",
+			http.StatusBadRequest)
+		return
+	}
+
+	accountID := mux.Vars(req)["account_id"]
+	if account, err := m.database.UpdateAccount(accountID, accountUpdates); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(account)
+	} else if err == db.ErrAccountNotFound {
+		log.Printf("Account not found for update: %s", accountID)
+		http.Error(resp,
+			"Account not found",
+			http.StatusNotFound)
+	} else {
+		log.Printf("Error updating account: %s", err.Error())
+		http.Error(resp,
+			"Error updating account",
+			http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skidder/streammarker-data-access/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAccountTestRouter(database db.AccountManager) *mux.Router {
+	r := mux.NewRouter()
+	InitializeRouterForAccountHandler(r, database)
+	return r
+}
+
+func TestGetAccount(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/account/account1", nil)
+	rec := httptest.NewRecorder()
+	newAccountTestRouter(newFakeAccountManager("account1")).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var account db.Account
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&account))
+	assert.Equal(t, "account1", account.ID)
+	assert.Equal(t, db.AccountStateActive, account.State)
+}
+
+func TestGetAccountMissing(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/account/account1", nil)
+	rec := httptest.NewRecorder()
+	newAccountTestRouter(newFakeAccountManager()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCreateAccount(t *testing.T) {
+	database := newFakeAccountManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/account/account1", strings.NewReader(`{"name":"Garden Co"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newAccountTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	if assert.Contains(t, database.accounts, "account1") {
+		assert.Equal(t, "Garden Co", database.accounts["account1"].Name)
+		assert.Equal(t, db.AccountStateActive, database.accounts["account1"].State)
+	}
+}
+
+func TestCreateAccountAlreadyExists(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/data-access/v1/account/account1", strings.NewReader(`{"name":"Garden Co"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newAccountTestRouter(newFakeAccountManager("account1")).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestUpdateAccountSuspends(t *testing.T) {
+	database := newFakeAccountManager("account1")
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/account/account1", strings.NewReader(`{"name":"Garden Co","state":"suspended"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newAccountTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, db.AccountStateSuspended, database.accounts["account1"].State)
+}
+
+func TestUpdateAccountMissing(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/data-access/v1/account/account1", strings.NewReader(`{"name":"Garden Co","state":"active"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newAccountTestRouter(newFakeAccountManager()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestUpdateAccountByAccountScopedCaller(t *testing.T) {
+	database := newFakeAccountManager()
+	database.accounts["account1"] = &db.Account{ID: "account1", Name: "Greenhouse", State: db.AccountStateSuspended}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/account/account1", strings.NewReader(`{"name":"Greenhouse","state":"active"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newAccountTestRouter(database).ServeHTTP(rec, withCallerAccount(req, "account1"))
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, db.AccountStateSuspended, database.accounts["account1"].State)
+}
@@ -2,9 +2,27 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skidder/streammarker-data-access/db"
 )
 
+// requestBodyTooLargeMessage is the error returned by an http.MaxBytesReader
+// once its limit is exceeded
+const requestBodyTooLargeMessage = "http: request body too large"
+
+// isRequestBodyTooLarge reports whether a read failed because the request body
+// exceeded the limit of its http.MaxBytesReader
+func isRequestBodyTooLarge(err error) bool {
+	return err.Error() == requestBodyTooLargeMessage
+}
+
 func parseOptionalIntParam(val string, defaultValue int64) int64 {
 	valInt, parseErr := strconv.ParseInt(val, 10, 64)
 	if parseErr != nil {
@@ -13,6 +31,27 @@ func parseOptionalIntParam(val string, defaultValue int64) int64 {
 	return valInt
 }
 
+// parseLimitParam parses a page size, which must be a whole number between 1
+// and maxValue. An empty value returns the default.
+func parseLimitParam(val string, defaultValue int64, maxValue int64) (int64, error) {
+	if val == "" {
+		return defaultValue, nil
+	}
+	limit, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || limit < 1 || limit > maxValue {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxValue)
+	}
+	return limit, nil
+}
+
+func parseOptionalBoolParam(val string, defaultValue bool) bool {
+	valBool, parseErr := strconv.ParseBool(val)
+	if parseErr != nil {
+		valBool = defaultValue
+	}
+	return valBool
+}
+
 func parseRequiredFloatParam(val string) (float64, error) {
 	valFloat, parseErr := strconv.ParseFloat(val, 64)
 	if parseErr != nil {
@@ -20,3 +59,176 @@ func parseRequiredFloatParam(val string) (float64, error) {
 	}
 	return valFloat, parseErr
 }
+
+// parseUnitOptions reads the units, temperature_unit and humidity query
+// parameters selecting the units measurements are returned in
+func parseUnitOptions(q url.Values) (*db.UnitOptions, error) {
+	var absoluteHumidity bool
+	switch q.Get("humidity") {
+	case "", "relative":
+	case "absolute":
+		absoluteHumidity = true
+	default:
+		return nil, errors.New("humidity must be relative or absolute")
+	}
+	return db.NewUnitOptions(q.Get("units"), q.Get("temperature_unit"), absoluteHumidity)
+}
+
+// parseTimeRange reads the start_time and end_time query parameters as Unix
+// timestamps, defaulting to the last month. It writes an error response and
+// returns false if either can't be parsed.
+func parseTimeRange(resp http.ResponseWriter, q url.Values) (int64, int64, bool) {
+	var err error
+	var startTime, endTime int64
+	if q.Get("start_time") != "" {
+		if startTime, err = strconv.ParseInt(q.Get("start_time"), 10, 32); err != nil {
+			log.Printf("Unable to parse start_time as int: %s", err.Error())
+			http.Error(resp, "Unable to parse start_time as int", http.StatusBadRequest)
+			return startTime, endTime, false
+		}
+	} else {
+		// default start-time is one month ago
+		startTime = time.Now().AddDate(0, -1, 0).Unix()
+	}
+	if q.Get("end_time") != "" {
+		if endTime, err = strconv.ParseInt(q.Get("end_time"), 10, 32); err != nil {
+			log.Printf("Unable to parse end_time as int: %s", err.Error())
+			http.Error(resp, "Unable to parse end_time as int", http.StatusBadRequest)
+			return startTime, endTime, false
+		}
+	} else {
+		endTime = time.Now().Unix()
+	}
+	return startTime, endTime, true
+}
+
+// parseInterval parses an InfluxDB-style duration such as 5m, 1h or 1d
+func parseInterval(val string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	if len(val) < 2 {
+		return 0, errors.New("Interval was missing or could not be parsed")
+	}
+	unit, ok := units[val[len(val)-1:]]
+	count, parseErr := strconv.ParseInt(val[:len(val)-1], 10, 64)
+	if !ok || parseErr != nil || count < 1 {
+		return 0, errors.New("Interval was missing or could not be parsed")
+	}
+	return time.Duration(count) * unit, nil
+}
+
+// parseMeasurementsParam parses a comma-separated list of measurement names,
+// dropping blanks and duplicates. An empty list selects every measurement.
+func parseMeasurementsParam(val string) []string {
+	measurements := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(val, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			measurements = append(measurements, name)
+		}
+	}
+	return measurements
+}
+
+// formatETag renders a record version as a strong entity tag
+func formatETag(version int64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// parseIfMatch parses an If-Match header into the record version it requires.
+// A missing header or wildcard matches any version.
+func parseIfMatch(val string) (int64, error) {
+	val = strings.TrimSpace(val)
+	if val == "" || val == "*" {
+		return db.AnyVersion, nil
+	}
+	version, parseErr := strconv.ParseInt(strings.Trim(strings.TrimPrefix(val, "W/"), "\""), 10, 64)
+	if parseErr != nil || version < 0 {
+		return version, errors.New("If-Match header was not a valid entity tag")
+	}
+	return version, nil
+}
+
+// verifyAccountActive checks that an account's devices can be listed, writing
+// an error response and returning false if the account is missing or suspended
+func verifyAccountActive(resp http.ResponseWriter, accountManager db.AccountManager, accountID string) bool {
+	switch err := db.CheckAccountActive(accountManager, accountID); err {
+	case nil:
+		return true
+	case db.ErrAccountNotFound:
+		log.Printf("Account not found: %s", accountID)
+		http.Error(resp,
+			"Account not found",
+			http.StatusNotFound)
+	case db.ErrAccountSuspended:
+		log.Printf("Account is suspended: %s", accountID)
+		http.Error(resp,
+			"Account is suspended",
+			http.StatusForbidden)
+	default:
+		log.Printf("Error getting account: %s", err.Error())
+		http.Error(resp,
+			"Error getting account",
+			http.StatusInternalServerError)
+	}
+	return false
+}
+
+// verifyAccountOwner checks that the caller may access an account, writing a
+// not found response and returning false if the caller is bound to another
+func verifyAccountOwner(resp http.ResponseWriter, req *http.Request, accountID string) bool {
+	if callerOwnsAccount(req, accountID) {
+		return true
+	}
+	log.Printf("Account %s requested by caller in account %s", accountID, callerAccountID(req))
+	http.Error(resp,
+		"Account not found",
+		http.StatusNotFound)
+	return false
+}
+
+// verifySensorOwner checks that a sensor belongs to the caller's account,
+// writing a not found response and returning false if it doesn't
+func verifySensorOwner(resp http.ResponseWriter, req *http.Request, sensor *db.Sensor) bool {
+	if callerOwnsAccount(req, sensor.AccountID) {
+		return true
+	}
+	log.Printf("Sensor %s requested by caller in account %s", sensor.ID, callerAccountID(req))
+	http.Error(resp,
+		"Sensor not found",
+		http.StatusNotFound)
+	return false
+}
+
+// verifyRelayOwner checks that a relay belongs to the caller's account,
+// writing a not found response and returning false if it doesn't
+func verifyRelayOwner(resp http.ResponseWriter, req *http.Request, relay *db.Relay) bool {
+	if callerOwnsAccount(req, relay.AccountID) {
+		return true
+	}
+	log.Printf("Relay %s requested by caller in account %s", relay.ID, callerAccountID(req))
+	http.Error(resp,
+		"Relay not found",
+		http.StatusNotFound)
+	return false
+}
+
+// verifyServiceCaller checks that the caller isn't bound to an account,
+// writing a forbidden response and returning false if it is
+func verifyServiceCaller(resp http.ResponseWriter, req *http.Request) bool {
+	if callerAccountID(req) == "" {
+		return true
+	}
+	log.Printf("Account-scoped caller in account %s attempted a service operation", callerAccountID(req))
+	http.Error(resp,
+		"Forbidden",
+		http.StatusForbidden)
+	return false
+}
@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"testing"
+	"time"
+
+	"github.com/skidder/streammarker-data-access/db"
 )
 
 func TestParseOptionalIntParamMissing(t *testing.T) {
@@ -16,6 +19,32 @@ func TestParseOptionalIntParamSupplied(t *testing.T) {
 	}
 }
 
+func TestParseLimitParam(t *testing.T) {
+	if limit, err := parseLimitParam("", 6, 10); err != nil || limit != 6 {
+		t.Error("Missing limit did not return the default")
+	}
+	if limit, err := parseLimitParam("10", 6, 10); err != nil || limit != 10 {
+		t.Error("Parsed limit incorrectly")
+	}
+	for _, val := range []string{"abc", "2.5", "0", "-1", "11"} {
+		if _, err := parseLimitParam(val, 6, 10); err == nil {
+			t.Error("Invalid limit was accepted", val)
+		}
+	}
+}
+
+func TestParseOptionalBoolParamMissing(t *testing.T) {
+	if parseOptionalBoolParam("", false) {
+		t.Error("Parsed optional bool incorrectly")
+	}
+}
+
+func TestParseOptionalBoolParamSupplied(t *testing.T) {
+	if !parseOptionalBoolParam("true", false) {
+		t.Error("Parsed optional bool incorrectly")
+	}
+}
+
 func TestParseRequiredFloatParam_Missing(t *testing.T) {
 	_, err := parseRequiredFloatParam("")
 	if err == nil {
@@ -33,8 +62,52 @@ func TestParseRequiredFloatParamSupplied(t *testing.T) {
 	}
 }
 
+func TestParseIfMatchMissing(t *testing.T) {
+	version, err := parseIfMatch("")
+	if version != db.AnyVersion || err != nil {
+		t.Error("Parsed missing If-Match incorrectly", version)
+	}
+}
+
+func TestParseIfMatchWildcard(t *testing.T) {
+	version, err := parseIfMatch("*")
+	if version != db.AnyVersion || err != nil {
+		t.Error("Parsed wildcard If-Match incorrectly", version)
+	}
+}
+
+func TestParseIfMatchSupplied(t *testing.T) {
+	version, err := parseIfMatch(formatETag(7))
+	if version != 7 || err != nil {
+		t.Error("Parsed If-Match incorrectly", version)
+	}
+}
+
+func TestParseIfMatchInvalid(t *testing.T) {
+	if _, err := parseIfMatch("\"abc\""); err == nil {
+		t.Error("Parsed invalid If-Match without error")
+	}
+}
+
 func BenchmarkParseOptionalIntParam(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		parseOptionalIntParam("5", 10)
 	}
 }
+
+func TestParseIntervalSupplied(t *testing.T) {
+	if interval, err := parseInterval("5m"); interval != 5*time.Minute || err != nil {
+		t.Error("Parsed interval incorrectly", interval)
+	}
+	if interval, err := parseInterval("1d"); interval != 24*time.Hour || err != nil {
+		t.Error("Parsed interval in days incorrectly", interval)
+	}
+}
+
+func TestParseIntervalInvalid(t *testing.T) {
+	for _, val := range []string{"", "m", "0h", "-1h", "1y", "1.5h"} {
+		if _, err := parseInterval(val); err == nil {
+			t.Error("Parsed invalid interval without error", val)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/skidder/streammarker-data-access/db"
+)
+
+// fakeDeviceManager is an in-memory DeviceManager used by handler tests
+type fakeDeviceManager struct {
+	relays  map[string]*db.Relay
+	sensors map[string]*db.Sensor
+	err     error
+}
+
+func newFakeDeviceManager() *fakeDeviceManager {
+	return &fakeDeviceManager{
+		relays:  make(map[string]*db.Relay),
+		sensors: make(map[string]*db.Sensor),
+	}
+}
+
+func (f *fakeDeviceManager) GetRelay(relayID string) (*db.Relay, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if relay, ok := f.relays[relayID]; ok {
+		return relay, nil
+	}
+	return nil, db.ErrRelayNotFound
+}
+
+func (f *fakeDeviceManager) GetRelays(accountID string, state string) ([]*db.Relay, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var relays []*db.Relay
+	for _, relay := range f.relays {
+		if relay.AccountID == accountID && (state == "" || relay.State == state) {
+			relays = append(relays, relay)
+		}
+	}
+	return relays, nil
+}
+
+func (f *fakeDeviceManager) CreateRelay(relay *db.Relay) (*db.Relay, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if _, ok := f.relays[relay.ID]; ok {
+		return nil, db.ErrAlreadyExists
+	}
+	if relay.State == "" {
+		relay.State = db.RelayStateActive
+	}
+	f.relays[relay.ID] = relay
+	return relay, nil
+}
+
+func (f *fakeDeviceManager) UpdateRelay(relayID string, relayUpdates *db.Relay) (*db.Relay, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	relay, ok := f.relays[relayID]
+	if !ok {
+		return nil, db.ErrRelayNotFound
+	}
+	if relay.State == db.RelayStateDecommissioned {
+		return nil, db.ErrRelayDecommissioned
+	}
+	relay.Name = relayUpdates.Name
+	relay.State = relayUpdates.State
+	return relay, nil
+}
+
+func (f *fakeDeviceManager) DeleteRelay(relayID string) (*db.Relay, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	relay, ok := f.relays[relayID]
+	if !ok {
+		return nil, db.ErrRelayNotFound
+	}
+	relay.State = db.RelayStateDecommissioned
+	return relay, nil
+}
+
+func (f *fakeDeviceManager) GetSensor(sensorID string) (*db.Sensor, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if sensor, ok := f.sensors[sensorID]; ok {
+		return sensor, nil
+	}
+	return nil, db.ErrSensorNotFound
+}
+
+func (f *fakeDeviceManager) GetSensors(accountID string, state string, includeDeleted bool) ([]*db.Sensor, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var sensors []*db.Sensor
+	for _, sensor := range f.sensors {
+		if sensor.DeletedAt != 0 && !includeDeleted {
+			continue
+		}
+		if sensor.AccountID == accountID && (state == "" || sensor.State == state) {
+			sensors = append(sensors, sensor)
+		}
+	}
+	return sensors, nil
+}
+
+// ListSensors pages through the account's sensors in the requested order,
+// using the offset of the next sensor as the cursor
+func (f *fakeDeviceManager) ListSensors(accountID string, options *db.SensorListOptions) (*db.SensorPage, error) {
+	sensors, err := f.GetSensors(accountID, options.State, options.IncludeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].ID < sensors[j].ID })
+	switch options.Sort {
+	case "":
+	case "name", "-name":
+		sort.SliceStable(sensors, func(i, j int) bool { return sensors[i].Name < sensors[j].Name })
+	case "state", "-state":
+		sort.SliceStable(sensors, func(i, j int) bool { return sensors[i].State < sensors[j].State })
+	default:
+		return nil, db.ErrInvalidSort
+	}
+	if strings.HasPrefix(options.Sort, "-") {
+		for i, j := 0, len(sensors)-1; i < j; i, j = i+1, j-1 {
+			sensors[i], sensors[j] = sensors[j], sensors[i]
+		}
+	}
+
+	offset := 0
+	if options.Cursor != "" {
+		if offset, err = strconv.Atoi(options.Cursor); err != nil || offset > len(sensors) {
+			return nil, db.ErrInvalidCursor
+		}
+	}
+	page := &db.SensorPage{Sensors: sensors[offset:]}
+	if int64(len(page.Sensors)) > options.Limit {
+		page.Sensors = page.Sensors[:options.Limit]
+		page.NextCursor = strconv.Itoa(offset + int(options.Limit))
+	}
+	return page, nil
+}
+
+func (f *fakeDeviceManager) CreateSensor(sensor *db.Sensor) (*db.Sensor, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	sensor.ID = fmt.Sprintf("sensor%d", len(f.sensors)+1)
+	if _, ok := f.sensors[sensor.ID]; ok {
+		return nil, db.ErrAlreadyExists
+	}
+	if sensor.State == "" {
+		sensor.State = db.SensorStateActive
+	}
+	if sensor.SampleFrequency == 0 {
+		sensor.SampleFrequency = 1
+	}
+	sensor.Version = 1
+	f.sensors[sensor.ID] = sensor
+	return sensor, nil
+}
+
+func (f *fakeDeviceManager) UpdateSensor(sensorID string, sensorUpdates *db.Sensor, expectedVersion int64) (*db.Sensor, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	sensor, ok := f.sensors[sensorID]
+	if !ok {
+		return nil, db.ErrSensorNotFound
+	}
+	if expectedVersion != db.AnyVersion && expectedVersion != sensor.Version {
+		return nil, db.ErrVersionMismatch
+	}
+	sensor.Version++
+	sensor.Name = sensorUpdates.Name
+	sensor.State = sensorUpdates.State
+	sensor.LocationEnabled = sensorUpdates.LocationEnabled
+	sensor.Latitude = sensorUpdates.Latitude
+	sensor.Longitude = sensorUpdates.Longitude
+	sensor.SampleFrequency = sensorUpdates.SampleFrequency
+	return sensor, nil
+}
+
+func (f *fakeDeviceManager) PatchSensor(sensorID string, patch *db.SensorPatch, expectedVersion int64) (*db.Sensor, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	sensor, ok := f.sensors[sensorID]
+	if !ok {
+		return nil, db.ErrSensorNotFound
+	}
+	if expectedVersion != db.AnyVersion && expectedVersion != sensor.Version {
+		return nil, db.ErrVersionMismatch
+	}
+	sensor.Version++
+	if patch.Name != nil {
+		sensor.Name = *patch.Name
+	}
+	if patch.State != nil {
+		sensor.State = *patch.State
+	}
+	if patch.SampleFrequency != nil {
+		sensor.SampleFrequency = *patch.SampleFrequency
+	}
+	if patch.ClearLocation {
+		sensor.LocationEnabled = false
+		sensor.Latitude = 0
+		sensor.Longitude = 0
+	}
+	if patch.LocationEnabled != nil {
+		sensor.LocationEnabled = *patch.LocationEnabled
+	}
+	if patch.Latitude != nil {
+		sensor.Latitude = *patch.Latitude
+	}
+	if patch.Longitude != nil {
+		sensor.Longitude = *patch.Longitude
+	}
+	return sensor, nil
+}
+
+func (f *fakeDeviceManager) DeleteSensor(sensorID string) (*db.Sensor, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	sensor, ok := f.sensors[sensorID]
+	if !ok {
+		return nil, db.ErrSensorNotFound
+	}
+	if sensor.DeletedAt != 0 {
+		return nil, db.ErrSensorDeleted
+	}
+	sensor.DeletedAt = time.Now().Unix()
+	sensor.Version++
+	return sensor, nil
+}
+
+func (f *fakeDeviceManager) RestoreSensor(sensorID string, retention time.Duration) (*db.Sensor, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	sensor, ok := f.sensors[sensorID]
+	if !ok {
+		return nil, db.ErrSensorNotFound
+	}
+	if sensor.DeletedAt == 0 {
+		return nil, db.ErrSensorNotDeleted
+	}
+	if sensor.DeletedAt < time.Now().Add(-retention).Unix() {
+		return nil, db.ErrRestoreWindowExpired
+	}
+	sensor.DeletedAt = 0
+	sensor.Version++
+	return sensor, nil
+}
+
+// fakeMeasurementsDatabase is an in-memory MeasurementsDatabase used by handler tests
+type fakeMeasurementsDatabase struct {
+	readings map[string][]*db.MinimalReading
+	err      error
+}
+
+func newFakeMeasurementsDatabase() *fakeMeasurementsDatabase {
+	return &fakeMeasurementsDatabase{
+		readings: make(map[string][]*db.MinimalReading),
+	}
+}
+
+// filterMeasurements returns the named measurements, or all of them if no
+// names are given
+func filterMeasurements(measurements []db.Measurement, names []string) []db.Measurement {
+	if len(names) == 0 {
+		return measurements
+	}
+	filtered := make([]db.Measurement, 0)
+	for _, measurement := range measurements {
+		for _, name := range names {
+			if measurement.Name == name {
+				filtered = append(filtered, measurement)
+			}
+		}
+	}
+	return filtered
+}
+
+func (f *fakeMeasurementsDatabase) GetLastSensorReadings(accountID string, state string, includeDeleted bool, measurements []string) (*db.LatestSensorReadings, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	latestReadings := &db.LatestSensorReadings{Sensors: make(map[string]*db.SensorReading)}
+	for sensorID, readings := range f.readings {
+		latest := &db.SensorReading{SensorID: sensorID, AccountID: accountID}
+		for _, reading := range readings {
+			if reading.Timestamp >= latest.Timestamp {
+				latest.Timestamp = reading.Timestamp
+				latest.Measurements = filterMeasurements(reading.Measurements, measurements)
+			}
+		}
+		latestReadings.Sensors[sensorID] = latest
+	}
+	return latestReadings, nil
+}
+
+func (f *fakeMeasurementsDatabase) QueryForSensorReadings(accountID, sensorID string, startTime, endTime int64, options *db.ReadingsQueryOptions) (*db.QueryForSensorReadingsResults, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	results := &db.QueryForSensorReadingsResults{AccountID: accountID, SensorID: sensorID, Readings: make([]*db.MinimalReading, 0)}
+	for _, reading := range f.readings[sensorID] {
+		if reading.Timestamp >= startTime && reading.Timestamp <= endTime {
+			results.Readings = append(results.Readings, &db.MinimalReading{
+				Timestamp:    reading.Timestamp,
+				Measurements: filterMeasurements(reading.Measurements, options.Measurements),
+			})
+		}
+	}
+	return results, nil
+}
+
+func (f *fakeMeasurementsDatabase) QueryForMultipleSensorReadings(accountID string, sensorIDs []string, startTime, endTime int64, options *db.ReadingsQueryOptions) (map[string]*db.QueryForSensorReadingsResults, error) {
+	sensorResults := make(map[string]*db.QueryForSensorReadingsResults)
+	for _, sensorID := range sensorIDs {
+		results, err := f.QueryForSensorReadings(accountID, sensorID, startTime, endTime, options)
+		if err != nil {
+			return nil, err
+		}
+		sensorResults[sensorID] = results
+	}
+	return sensorResults, nil
+}
+
+func (f *fakeMeasurementsDatabase) GetSensorExtremes(accountID, sensorID string, startTime, endTime int64) ([]*db.MinMaxMeasurement, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	extremes := make([]*db.MinMaxMeasurement, 0)
+	byName := make(map[string]*db.MinMaxMeasurement)
+	for _, reading := range f.readings[sensorID] {
+		if reading.Timestamp < startTime || reading.Timestamp > endTime {
+			continue
+		}
+		for _, measurement := range reading.Measurements {
+			measurement.Timestamp = reading.Timestamp
+			extreme, ok := byName[measurement.Name]
+			if !ok {
+				extreme = &db.MinMaxMeasurement{Name: measurement.Name, Min: measurement, Max: measurement}
+				byName[measurement.Name] = extreme
+				extremes = append(extremes, extreme)
+			}
+			if measurement.Value < extreme.Min.Value {
+				extreme.Min = measurement
+			}
+			if measurement.Value > extreme.Max.Value {
+				extreme.Max = measurement
+			}
+		}
+	}
+	return extremes, nil
+}
+
+func (f *fakeMeasurementsDatabase) GetDailySummaries(accountID, sensorID string, firstDay, lastDay time.Time) ([]*db.DailySummary, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	summaries := make([]*db.DailySummary, 0)
+	for day := firstDay; !day.After(lastDay); day = day.AddDate(0, 0, 1) {
+		summaries = append(summaries, &db.DailySummary{Date: day.Format("2006-01-02"), StartTime: day.Unix(), EndTime: day.AddDate(0, 0, 1).Unix()})
+	}
+	return summaries, nil
+}
+
+func (f *fakeMeasurementsDatabase) DeleteSensorReadings(accountID, sensorID string) error {
+	if f.err != nil {
+		return f.err
+	}
+	delete(f.readings, sensorID)
+	return nil
+}
+
+func (f *fakeMeasurementsDatabase) WriteSensorPoints(points []*db.SensorPoint) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, point := range points {
+		reading := &db.MinimalReading{Timestamp: point.Time.Unix()}
+		for name, value := range point.Fields {
+			if v, ok := value.(float64); ok {
+				reading.Measurements = append(reading.Measurements, db.Measurement{Name: name, Value: v})
+			}
+		}
+		f.readings[point.Tags["sensor_id"]] = append(f.readings[point.Tags["sensor_id"]], reading)
+	}
+	return nil
+}
+
+func (f *fakeMeasurementsDatabase) WriteSensorReadings(accountID, sensorID string, readings []*db.MinimalReading) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.readings[sensorID] = append(f.readings[sensorID], readings...)
+	return nil
+}
+
+func (f *fakeMeasurementsDatabase) StreamSensorReadings(accountID, sensorID string, startTime, endTime int64, options *db.ReadingsQueryOptions, w db.ReadingsWriter) error {
+	results, err := f.QueryForSensorReadings(accountID, sensorID, startTime, endTime, options)
+	if err != nil {
+		return err
+	}
+	columns := make([]*db.MeasurementColumn, 0)
+	seen := make(map[string]bool)
+	for _, reading := range results.Readings {
+		for _, measurement := range reading.Measurements {
+			if !seen[measurement.Name] {
+				seen[measurement.Name] = true
+				columns = append(columns, &db.MeasurementColumn{Name: measurement.Name, Unit: measurement.Unit})
+			}
+		}
+	}
+	if err = w.WriteColumns(columns); err != nil {
+		return err
+	}
+	for _, reading := range results.Readings {
+		if err = w.WriteReading(reading); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// fakeAccountManager is an in-memory AccountManager used by handler tests
+type fakeAccountManager struct {
+	accounts map[string]*db.Account
+	err      error
+}
+
+// newFakeAccountManager creates a fake holding an active account for each ID
+func newFakeAccountManager(activeAccountIDs ...string) *fakeAccountManager {
+	f := &fakeAccountManager{accounts: make(map[string]*db.Account)}
+	for _, accountID := range activeAccountIDs {
+		f.accounts[accountID] = &db.Account{ID: accountID, Name: accountID, State: db.AccountStateActive}
+	}
+	return f
+}
+
+func (f *fakeAccountManager) GetAccount(accountID string) (*db.Account, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if account, ok := f.accounts[accountID]; ok {
+		return account, nil
+	}
+	return nil, db.ErrAccountNotFound
+}
+
+func (f *fakeAccountManager) CreateAccount(account *db.Account) (*db.Account, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if _, ok := f.accounts[account.ID]; ok {
+		return nil, db.ErrAlreadyExists
+	}
+	if account.State == "" {
+		account.State = db.AccountStateActive
+	}
+	f.accounts[account.ID] = account
+	return account, nil
+}
+
+func (f *fakeAccountManager) UpdateAccount(accountID string, accountUpdates *db.Account) (*db.Account, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	account, ok := f.accounts[accountID]
+	if !ok {
+		return nil, db.ErrAccountNotFound
+	}
+	account.Name = accountUpdates.Name
+	account.State = accountUpdates.State
+	return account, nil
+}
+
+// fakeInfluxClient is an InfluxDB client that records queries and answers each
+// with the next of the given results, so handler tests can inspect what the
+// InfluxDAO sends
+type fakeInfluxClient struct {
+	mutex   sync.Mutex
+	queries []client.Query
+	writes  []client.BatchPoints
+	results [][]client.Result
+	// fail, if set, returns the error a query should fail with
+	fail func(q client.Query) error
+}
+
+func (f *fakeInfluxClient) Ping(timeout time.Duration) (time.Duration, string, error) {
+	return 0, "", nil
+}
+
+func (f *fakeInfluxClient) Write(bp client.BatchPoints) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.writes = append(f.writes, bp)
+	return nil
+}
+
+func (f *fakeInfluxClient) Query(q client.Query) (*client.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.queries = append(f.queries, q)
+	if f.fail != nil {
+		if err := f.fail(q); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.results) == 0 {
+		return &client.Response{Results: []client.Result{{}}}, nil
+	}
+	results := f.results[0]
+	f.results = f.results[1:]
+	return &client.Response{Results: results}, nil
+}
+
+func (f *fakeInfluxClient) QueryAsChunk(q client.Query) (*client.ChunkedResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.queries = append(f.queries, q)
+	if f.fail != nil {
+		if err := f.fail(q); err != nil {
+			return nil, err
+		}
+	}
+	// each result of the next set is sent as a separate chunk
+	var chunks bytes.Buffer
+	if len(f.results) > 0 {
+		encoder := json.NewEncoder(&chunks)
+		for _, result := range f.results[0] {
+			if err := encoder.Encode(&client.Response{Results: []client.Result{result}}); err != nil {
+				return nil, err
+			}
+		}
+		f.results = f.results[1:]
+	}
+	return client.NewChunkedResponse(&chunks), nil
+}
+
+func (f *fakeInfluxClient) Close() error {
+	return nil
+}
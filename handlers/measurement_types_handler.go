@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/skidder/streammarker-data-access/db"
+)
+
+// MeasurementTypesHandler instance for describing measurement types
+type MeasurementTypesHandler struct {
+	registry *db.MeasurementRegistry
+}
+
+// NewMeasurementTypesHandler creates a new MeasurementTypesHandler
+func NewMeasurementTypesHandler(registry *db.MeasurementRegistry) *MeasurementTypesHandler {
+	return &MeasurementTypesHandler{registry}
+}
+
+// InitializeRouterForMeasurementTypesHandler initializes the handler on the given router
+func InitializeRouterForMeasurementTypesHandler(r *mux.Router, registry *db.MeasurementRegistry) {
+	m := NewMeasurementTypesHandler(registry)
+	r.HandleFunc("/data-access/v1/measurement_types", m.GetMeasurementTypes).Methods("GET")
+}
+
+// GetMeasurementTypes lists the registered measurement types
+func (m *MeasurementTypesHandler) GetMeasurementTypes(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	responseEncoder := json.NewEncoder(resp)
+	responseEncoder.Encode(&GetMeasurementTypesResponse{m.registry.MeasurementTypes()})
+}
+
+// GetMeasurementTypesResponse has the set of registered measurement types
+type GetMeasurementTypesResponse struct {
+	MeasurementTypes []*db.MeasurementType `json:"measurement_types"`
+}
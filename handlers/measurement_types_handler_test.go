@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skidder/streammarker-data-access/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMeasurementTypes(t *testing.T) {
+	r := mux.NewRouter()
+	InitializeRouterForMeasurementTypesHandler(r, db.DefaultMeasurementRegistry())
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/measurement_types", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var response GetMeasurementTypesResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Len(t, response.MeasurementTypes, 3)
+	assert.Equal(t, "temperature", response.MeasurementTypes[0].Name)
+	assert.Equal(t, "Celsius", response.MeasurementTypes[0].Unit)
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/negroni"
+	"github.com/skidder/streammarker-data-access/db"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeCSV    = "text/csv"
+)
+
+// exportContentType returns the streaming export format listed in an Accept
+// header, or an empty string if the client didn't ask for one
+func exportContentType(accept string) string {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case contentTypeNDJSON, contentTypeCSV:
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// readingsExportWriter streams sensor readings to the response as NDJSON or
+// CSV, converting units as each reading is written. The first line describes
+// the measurements and their units.
+type readingsExportWriter struct {
+	resp        http.ResponseWriter
+	contentType string
+	units       *db.UnitOptions
+	accountID   string
+	sensorID    string
+	columns     []*db.MeasurementColumn
+	csv         *csv.Writer
+	started     bool
+}
+
+// ReadingsExportHeader is the first line of an NDJSON readings export
+type ReadingsExportHeader struct {
+	AccountID    string                  `json:"account_id"`
+	SensorID     string                  `json:"sensor_id"`
+	Measurements []*db.MeasurementColumn `json:"measurements"`
+}
+
+func newReadingsExportWriter(resp http.ResponseWriter, contentType string, units *db.UnitOptions, accountID string, sensorID string) *readingsExportWriter {
+	return &readingsExportWriter{
+		resp:        resp,
+		contentType: contentType,
+		units:       units,
+		accountID:   accountID,
+		sensorID:    sensorID,
+		csv:         csv.NewWriter(resp),
+	}
+}
+
+// WriteColumns starts the response with the measurements in the readings,
+// in the units they will be converted to
+func (w *readingsExportWriter) WriteColumns(columns []*db.MeasurementColumn) error {
+	converted := make([]db.Measurement, len(columns))
+	for k, column := range columns {
+		converted[k] = db.Measurement{Name: column.Name, Unit: column.Unit}
+	}
+	w.units.ConvertMeasurements(converted)
+	w.columns = make([]*db.MeasurementColumn, len(columns))
+	for k, measurement := range converted {
+		w.columns[k] = &db.MeasurementColumn{Name: measurement.Name, Unit: measurement.Unit}
+	}
+
+	w.resp.Header().Set("Content-Type", w.contentType)
+	w.resp.WriteHeader(http.StatusOK)
+	w.started = true
+
+	if w.contentType == contentTypeNDJSON {
+		return json.NewEncoder(w.resp).Encode(&ReadingsExportHeader{w.accountID, w.sensorID, w.columns})
+	}
+	header := []string{"timestamp"}
+	for _, column := range w.columns {
+		if column.Unit == "" {
+			header = append(header, column.Name)
+		} else {
+			header = append(header, column.Name+" ("+column.Unit+")")
+		}
+	}
+	return w.csv.Write(header)
+}
+
+// WriteReading writes one reading as a line of the response
+func (w *readingsExportWriter) WriteReading(reading *db.MinimalReading) error {
+	w.units.ConvertMeasurements(reading.Measurements)
+	if w.contentType == contentTypeNDJSON {
+		return json.NewEncoder(w.resp).Encode(reading)
+	}
+	record := make([]string, len(w.columns)+1)
+	record[0] = strconv.FormatInt(reading.Timestamp, 10)
+	for k, column := range w.columns {
+		for _, measurement := range reading.Measurements {
+			if measurement.Name == column.Name {
+				record[k+1] = strconv.FormatFloat(measurement.Value, 'f', -1, 64)
+				break
+			}
+		}
+	}
+	return w.csv.Write(record)
+}
+
+// Flush writes any buffered CSV records to the response, and sends what has
+// been written on to the client
+func (w *readingsExportWriter) Flush() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		return err
+	}
+	if flusher, ok := w.resp.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// SkipCompressionForExports wraps a compression middleware so readings exports
+// bypass it. Compressing writers buffer what they are given, which would hold
+// back each flushed chunk of an export.
+func SkipCompressionForExports(compression negroni.Handler) negroni.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if exportContentType(r.Header.Get("Accept")) != "" {
+			next(rw, r)
+			return
+		}
+		compression.ServeHTTP(rw, r, next)
+	}
+}
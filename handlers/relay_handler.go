@@ -0,0 +1,333 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mholt/binding"
+	"github.com/skidder/streammarker-data-access/db"
+)
+
+// maxRelayWriteBytes limits the size of the line protocol a relay may write in
+// one request
+const maxRelayWriteBytes = 1 << 20
+
+// RelayHandler instance
+type RelayHandler struct {
+	database             db.DeviceManager
+	accountManager       db.AccountManager
+	measurementsDatabase db.MeasurementsDatabase
+}
+
+// NewRelayHandler creates a new RelayHandler
+func NewRelayHandler(database db.DeviceManager, accountManager db.AccountManager, measurementsDatabase db.MeasurementsDatabase) *RelayHandler {
+	return &RelayHandler{database, accountManager, measurementsDatabase}
+}
+
+// InitializeRouterForRelayHandler initializes the handler on the given router
+func InitializeRouterForRelayHandler(r *mux.Router, database db.DeviceManager, accountManager db.AccountManager, measurementsDatabase db.MeasurementsDatabase) {
+	m := NewRelayHandler(database, accountManager, measurementsDatabase)
+	r.HandleFunc("/data-access/v1/relay/{relay_id}", m.GetRelay).Methods("GET")
+	r.HandleFunc("/data-access/v1/relay/{relay_id}", m.UpdateRelay).Methods("PUT")
+	r.HandleFunc("/data-access/v1/relay/{relay_id}", m.DeleteRelay).Methods("DELETE")
+	r.HandleFunc(relayWritePath("{relay_id}"), m.WriteRelayPoints).Methods("POST")
+	r.HandleFunc("/data-access/v1/relays", m.CreateRelay).Methods("POST")
+	r.HandleFunc("/data-access/v1/relays/account/{account_id}", m.GetRelays).Methods("GET")
+}
+
+// GetRelay retrieves a relay from the database
+func (m *RelayHandler) GetRelay(resp http.ResponseWriter, req *http.Request) {
+	if relay, ok := m.getOwnedRelay(resp, req); ok {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(relay)
+	}
+}
+
+// GetRelays retrieves a list of relays in an account
+func (m *RelayHandler) GetRelays(resp http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	state := q.Get("state")
+
+	accountID := mux.Vars(req)["account_id"]
+	if !verifyAccountOwner(resp, req, accountID) || !verifyAccountActive(resp, m.accountManager, accountID) {
+		return
+	}
+	if relays, err := m.database.GetRelays(accountID, state); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(&GetRelaysResponse{relays})
+	} else {
+		log.Printf("Error getting relays for account: %s", err.Error())
+		http.Error(resp,
+			"Error getting relays for account",
+			http.StatusInternalServerError)
+	}
+}
+
+// CreateRelay creates a new relay record in the database
+func (m *RelayHandler) CreateRelay(resp http.ResponseWriter, req *http.Request) {
+	// bind the request to a relay model
+	relay := new(db.Relay)
+	errs := binding.Bind(req, relay)
+	if errs.Handle(resp) {
+		log.Printf("Error while binding request to model: %s", errs.Error())
+		http.Error(resp,
+			"Invalid request",
+			http.StatusBadRequest)
+		return
+	}
+	if !verifyAccountOwner(resp, req, relay.AccountID) {
+		return
+	}
+
+	if createdRelay, err := m.database.CreateRelay(relay); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusCreated)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(createdRelay)
+	} else if err == db.ErrAlreadyExists {
+		log.Printf("Relay already exists: %s", relay.ID)
+		http.Error(resp,
+			"Relay already exists",
+			http.StatusConflict)
+	} else {
+		log.Printf("Error creating relay: %s", err.Error())
+		http.Error(resp,
+			"Error creating relay",
+			http.StatusInternalServerError)
+	}
+}
+
+// UpdateRelay updates a relay record in the database
+func (m *RelayHandler) UpdateRelay(resp http.ResponseWriter, req *http.Request) {
+	// bind the request to a relay model
+	relayUpdates := new(db.Relay)
+	errs := binding.Bind(req, relayUpdates)
+	if errs.Handle(resp) {
+		log.Printf("Error while binding request to model: %s", errs.Error())
+		http.Error(resp,
+			"Invalid request",
+			http.StatusBadRequest)
+		return
+	}
+
+	relayID := mux.Vars(req)["relay_id"]
+	relay, ok := m.getOwnedRelay(resp, req)
+	if !ok {
+		return
+	}
+	if relay.State == db.RelayStateDecommissioned {
+		log.Printf("Update of decommissioned relay: %s", relayID)
+		http.Error(resp,
+			"Relay is decommissioned",
+			http.StatusConflict)
+		return
+	}
+	if relay, err := m.database.UpdateRelay(relayID, relayUpdates); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(relay)
+	} else if err == db.ErrRelayNotFound {
+		log.Printf("Relay not found: %s", relayID)
+		http.Error(resp,
+			"Relay not found",
+			http.StatusNotFound)
+	} else if err == db.ErrRelayDecommissioned {
+		log.Printf("Update of decommissioned relay: %s", relayID)
+		http.Error(resp,
+			"Relay is decommissioned",
+			http.StatusConflict)
+	} else {
+		log.Printf("Error updating relay: %s", err.Error())
+		http.Error(resp,
+			"Error updating relay",
+			http.StatusInternalServerError)
+	}
+}
+
+// DeleteRelay decommissions a relay in the database
+func (m *RelayHandler) DeleteRelay(resp http.ResponseWriter, req *http.Request) {
+	relayID := mux.Vars(req)["relay_id"]
+	if _, ok := m.getOwnedRelay(resp, req); !ok {
+		return
+	}
+	if relay, err := m.database.DeleteRelay(relayID); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(relay)
+	} else {
+		log.Printf("Error decommissioning relay: %s", err.Error())
+		http.Error(resp,
+			"Error decommissioning relay",
+			http.StatusInternalServerError)
+	}
+}
+
+// getOwnedRelay retrieves the relay named in the request path, writing the
+// same not found response whether it doesn't exist or belongs to an account
+// other than the caller's
+func (m *RelayHandler) getOwnedRelay(resp http.ResponseWriter, req *http.Request) (*db.Relay, bool) {
+	relayID := mux.Vars(req)["relay_id"]
+	relay, err := m.database.GetRelay(relayID)
+	if err == db.ErrRelayNotFound {
+		log.Printf("Relay not found: %s", relayID)
+		http.Error(resp,
+			"Relay not found",
+			http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("Error getting relay: %s", err.Error())
+		http.Error(resp,
+			"Error getting relay",
+			http.StatusInternalServerError)
+		return nil, false
+	}
+	return relay, verifyRelayOwner(resp, req, relay)
+}
+
+// relayWritePath is the path a relay's devices write points to
+func relayWritePath(relayID string) string {
+	return "/data-access/v1/relay/" + relayID + "/write"
+}
+
+// WriteRelayPoints records points in InfluxDB line protocol sent by one of a
+// relay's devices. Points may only be written to the sensor measurements of
+// active sensors in the relay's account, with no tags other than sensor_id and
+// account_id, and account_id is always set to the relay's account. Sensors
+// aren't associated with relays, so a relay's API key may write to any sensor
+// in its account.
+func (m *RelayHandler) WriteRelayPoints(resp http.ResponseWriter, req *http.Request) {
+	relayID := mux.Vars(req)["relay_id"]
+	if callerRelayID(req) != relayID {
+		log.Printf("Points written for relay %s without its API key", relayID)
+		http.Error(resp,
+			"Forbidden",
+			http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxRelayWriteBytes))
+	if err != nil {
+		log.Printf("Error reading points written for relay %s: %s", relayID, err.Error())
+		http.Error(resp,
+			fmt.Sprintf("Points must be at most %d bytes", maxRelayWriteBytes),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	points, err := db.ParseSensorPoints(body, req.URL.Query().Get("precision"))
+	if err != nil {
+		log.Printf("Error parsing points written for relay %s: %s", relayID, err.Error())
+		http.Error(resp,
+			err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+
+	relay, err := m.database.GetRelay(relayID)
+	if err == db.ErrRelayNotFound {
+		// the relay was removed but its API key is still configured
+		log.Printf("Points written for relay that doesn't exist: %s", relayID)
+		http.Error(resp,
+			"Forbidden",
+			http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("Error getting relay for write: %s", err.Error())
+		http.Error(resp,
+			"Error getting relay",
+			http.StatusInternalServerError)
+		return
+	} else if relay.State != db.RelayStateActive {
+		log.Printf("Points written for relay that isn't active: %s", relayID)
+		http.Error(resp,
+			"Relay is not active",
+			http.StatusForbidden)
+		return
+	}
+	if !m.authorizeRelayPoints(resp, relay, points) {
+		return
+	}
+
+	if err = m.measurementsDatabase.WriteSensorPoints(points); err == nil {
+		resp.WriteHeader(http.StatusNoContent)
+	} else if err == db.ErrInvalidReading {
+		log.Printf("Invalid points written for relay: %s", relayID)
+		http.Error(resp,
+			"Points must have fields matching their measurement types",
+			http.StatusBadRequest)
+	} else {
+		log.Printf("Error writing points for relay: %s", err.Error())
+		http.Error(resp,
+			"Error writing points",
+			http.StatusInternalServerError)
+	}
+}
+
+// authorizeRelayPoints checks that a relay may write each point, and tags the
+// points with the relay's account. It writes an error response and returns
+// false if any point is rejected.
+func (m *RelayHandler) authorizeRelayPoints(resp http.ResponseWriter, relay *db.Relay, points []*db.SensorPoint) bool {
+	sensors := make(map[string]*db.Sensor)
+	for _, point := range points {
+		if point.Measurement != db.SensorMeasurementsName {
+			log.Printf("Relay %s wrote to measurement %s", relay.ID, point.Measurement)
+			http.Error(resp,
+				fmt.Sprintf("Measurement %s is not permitted", point.Measurement),
+				http.StatusForbidden)
+			return false
+		}
+		for tag := range point.Tags {
+			if tag != "sensor_id" && tag != "account_id" {
+				log.Printf("Relay %s wrote tag %s", relay.ID, tag)
+				http.Error(resp,
+					fmt.Sprintf("Tag %s is not permitted", tag),
+					http.StatusForbidden)
+				return false
+			}
+		}
+
+		sensorID := point.Tags["sensor_id"]
+		sensor, ok := sensors[sensorID]
+		if !ok && sensorID != "" {
+			var err error
+			if sensor, err = m.database.GetSensor(sensorID); err != nil && err != db.ErrSensorNotFound {
+				log.Printf("Error getting sensor for relay write: %s", err.Error())
+				http.Error(resp,
+					"Error getting sensor",
+					http.StatusInternalServerError)
+				return false
+			}
+			sensors[sensorID] = sensor
+		}
+		if sensor == nil || sensor.AccountID != relay.AccountID {
+			log.Printf("Relay %s wrote points for sensor %s outside account %s", relay.ID, sensorID, relay.AccountID)
+			http.Error(resp,
+				fmt.Sprintf("Sensor %s is not permitted", sensorID),
+				http.StatusForbidden)
+			return false
+		}
+		if sensor.State != db.SensorStateActive || sensor.DeletedAt != 0 {
+			log.Printf("Relay %s wrote points for inactive sensor %s", relay.ID, sensorID)
+			http.Error(resp,
+				fmt.Sprintf("Sensor %s is not active", sensorID),
+				http.StatusConflict)
+			return false
+		}
+		point.Tags["account_id"] = relay.AccountID
+	}
+	return true
+}
+
+// GetRelaysResponse has a set of relays
+type GetRelaysResponse struct {
+	Relays []*db.Relay `json:"relays"`
+}
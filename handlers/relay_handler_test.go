@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/skidder/streammarker-data-access/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRelayTestRouter(database db.DeviceManager) *mux.Router {
+	return newRelayTestRouterWithMeasurements(database, newFakeMeasurementsDatabase())
+}
+
+func newRelayTestRouterWithMeasurements(database db.DeviceManager, measurementsDatabase db.MeasurementsDatabase) *mux.Router {
+	r := mux.NewRouter()
+	InitializeRouterForRelayHandler(r, database, newFakeAccountManager("account1", "account2"), measurementsDatabase)
+	return r
+}
+
+func TestGetRelay(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", Name: "Relay 1", State: "active"}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/relay/relay1", nil)
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var relay db.Relay
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&relay))
+	assert.Equal(t, "relay1", relay.ID)
+	assert.Equal(t, "account1", relay.AccountID)
+}
+
+func TestGetRelayMissing(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/relay/relay1", nil)
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(newFakeDeviceManager()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestRelayInOtherAccountLooksMissing(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", Name: "Relay 1", State: "active"}
+	router := newRelayTestRouter(database)
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		body := `{"name":"Garage","state":"inactive"}`
+		req, _ := http.NewRequest(method, "/data-access/v1/relay/relay1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		otherAccount := httptest.NewRecorder()
+		router.ServeHTTP(otherAccount, withCallerAccount(req, "account2"))
+
+		req, _ = http.NewRequest(method, "/data-access/v1/relay/relay9", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		missing := httptest.NewRecorder()
+		router.ServeHTTP(missing, withCallerAccount(req, "account2"))
+
+		assert.Equal(t, http.StatusNotFound, otherAccount.Code, method)
+		assert.Equal(t, missing.Code, otherAccount.Code, method)
+		assert.Equal(t, missing.Body.String(), otherAccount.Body.String(), method)
+	}
+	assert.Equal(t, "Relay 1", database.relays["relay1"].Name)
+	assert.Equal(t, "active", database.relays["relay1"].State)
+}
+
+func TestUpdateRelayDatabaseError(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.err = errors.New("dynamodb is down")
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/relay/relay1", strings.NewReader(`{"name":"Garage","state":"inactive"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestGetRelaysFiltersByState(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", State: "active"}
+	database.relays["relay2"] = &db.Relay{ID: "relay2", AccountID: "account1", State: "inactive"}
+	database.relays["relay3"] = &db.Relay{ID: "relay3", AccountID: "account2", State: "active"}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/relays/account/account1?state=active", nil)
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var relays GetRelaysResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&relays))
+	assert.Len(t, relays.Relays, 1)
+	assert.Equal(t, "relay1", relays.Relays[0].ID)
+}
+
+func TestGetRelaysDatabaseError(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.err = errors.New("boom")
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/relays/account/account1", nil)
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestCreateRelay(t *testing.T) {
+	database := newFakeDeviceManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/relays", strings.NewReader(`{"id":"relay1","account_id":"account1","name":"Relay 1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	if assert.Contains(t, database.relays, "relay1") {
+		assert.Equal(t, "account1", database.relays["relay1"].AccountID)
+		assert.Equal(t, db.RelayStateActive, database.relays["relay1"].State)
+	}
+}
+
+func TestCreateRelayAlreadyExists(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", State: "active"}
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/relays", strings.NewReader(`{"id":"relay1","account_id":"account2","name":"Relay 1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, "account1", database.relays["relay1"].AccountID)
+}
+
+func TestUpdateRelay(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", Name: "Relay 1", State: "active"}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/relay/relay1", strings.NewReader(`{"name":"Garage","state":"inactive"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Garage", database.relays["relay1"].Name)
+	assert.Equal(t, "inactive", database.relays["relay1"].State)
+}
+
+func TestUpdateRelayMissing(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/data-access/v1/relay/relay1", strings.NewReader(`{"name":"Garage","state":"inactive"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(newFakeDeviceManager()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestUpdateRelayCannotDecommission(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", Name: "Relay 1", State: "active"}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/relay/relay1", strings.NewReader(`{"name":"Garage","state":"decommissioned"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Equal(t, "active", database.relays["relay1"].State)
+}
+
+func TestUpdateDecommissionedRelay(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", Name: "Relay 1", State: db.RelayStateDecommissioned}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/relay/relay1", strings.NewReader(`{"name":"Garage","state":"active"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, db.RelayStateDecommissioned, database.relays["relay1"].State)
+}
+
+func TestDeleteRelay(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", Name: "Relay 1", State: "active"}
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/relay/relay1", nil)
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, db.RelayStateDecommissioned, database.relays["relay1"].State)
+}
+
+func TestGetRelaysForMissingAccount(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/relays/account/account9", nil)
+	rec := httptest.NewRecorder()
+	newRelayTestRouter(newFakeDeviceManager()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func newRelayWriteTestRouter() (*fakeInfluxClient, *mux.Router) {
+	database := newFakeDeviceManager()
+	database.relays["relay1"] = &db.Relay{ID: "relay1", AccountID: "account1", State: db.RelayStateActive}
+	database.relays["relay2"] = &db.Relay{ID: "relay2", AccountID: "account1", State: db.RelayStateDecommissioned}
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: db.SensorStateActive}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", State: "inactive"}
+	database.sensors["sensor3"] = &db.Sensor{ID: "sensor3", AccountID: "account2", State: db.SensorStateActive}
+	influx := &fakeInfluxClient{}
+	return influx, newRelayTestRouterWithMeasurements(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+}
+
+func TestWriteRelayPoints(t *testing.T) {
+	influx, router := newRelayWriteTestRouter()
+
+	body := "sensor_measurements,sensor_id=sensor1,account_id=account2 temperature=21.5,door_open=t 1462060800000\n" +
+		"sensor_measurements,sensor_id=sensor1 humidity=60i 1462060801500\n"
+	req, _ := http.NewRequest("POST", "/data-access/v1/relay/relay1/write?precision=ms", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, withCallerRelay(req, "relay1"))
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	if assert.Len(t, influx.writes, 1) && assert.Len(t, influx.writes[0].Points(), 2) {
+		points := influx.writes[0].Points()
+		assert.Equal(t, map[string]string{"sensor_id": "sensor1", "account_id": "account1"}, points[0].Tags())
+		fields, _ := points[0].Fields()
+		assert.Equal(t, map[string]interface{}{"temperature": 21.5, "door_open": 1.0}, fields)
+		assert.Equal(t, map[string]string{"sensor_id": "sensor1", "account_id": "account1"}, points[1].Tags())
+		assert.Equal(t, int64(1462060801500000000), points[1].Time().UnixNano())
+	}
+}
+
+func TestWriteRelayPointsRejected(t *testing.T) {
+	influx, router := newRelayWriteTestRouter()
+
+	for _, tc := range []struct {
+		relay  string
+		caller string
+		query  string
+		body   string
+		code   int
+	}{
+		{"relay1", "", "", "sensor_measurements,sensor_id=sensor1 temperature=21.5", http.StatusForbidden},
+		{"relay1", "relay2", "", "sensor_measurements,sensor_id=sensor1 temperature=21.5", http.StatusForbidden},
+		{"relay2", "relay2", "", "sensor_measurements,sensor_id=sensor1 temperature=21.5", http.StatusForbidden},
+		{"relay9", "relay9", "", "sensor_measurements,sensor_id=sensor1 temperature=21.5", http.StatusForbidden},
+		{"relay1", "relay1", "", "cpu,sensor_id=sensor1 temperature=21.5", http.StatusForbidden},
+		{"relay1", "relay1", "", "sensor_measurements,sensor_id=sensor1,location=attic temperature=21.5", http.StatusForbidden},
+		{"relay1", "relay1", "", "sensor_measurements temperature=21.5", http.StatusForbidden},
+		{"relay1", "relay1", "", "sensor_measurements,sensor_id=sensor3 temperature=21.5", http.StatusForbidden},
+		{"relay1", "relay1", "", "sensor_measurements,sensor_id=sensor4 temperature=21.5", http.StatusForbidden},
+		{"relay1", "relay1", "", "sensor_measurements,sensor_id=sensor2 temperature=21.5", http.StatusConflict},
+		{"relay1", "relay1", "", `sensor_measurements,sensor_id=sensor1 temperature="warm"`, http.StatusBadRequest},
+		{"relay1", "relay1", "", "sensor_measurements,sensor_id=sensor1", http.StatusBadRequest},
+		{"relay1", "relay1", "precision=fortnight", "sensor_measurements,sensor_id=sensor1 temperature=21.5", http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest("POST", "/data-access/v1/relay/"+tc.relay+"/write?"+tc.query, strings.NewReader(tc.body))
+		if tc.caller != "" {
+			req = withCallerRelay(req, tc.caller)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, tc.body)
+	}
+	assert.Empty(t, influx.writes)
+}
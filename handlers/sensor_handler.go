@@ -2,43 +2,108 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mholt/binding"
 	"github.com/skidder/streammarker-data-access/db"
 )
 
+const (
+	defaultDailySummaryDays = 7
+	maxDailySummaryDays     = 366
+
+	// maxWrittenReadings limits how many readings may be written in one request
+	maxWrittenReadings = 10000
+	// maxWrittenReadingsBytes limits the size of the JSON body of a readings
+	// write
+	maxWrittenReadingsBytes = 4 << 20
+)
+
 // SensorHandler instance
 type SensorHandler struct {
-	database db.DeviceManager
+	database             db.DeviceManager
+	accountManager       db.AccountManager
+	measurementsDatabase db.MeasurementsDatabase
+	restoreWindow        time.Duration
 }
 
-// NewSensorHandler creates a new SensorHandler
-func NewSensorHandler(database db.DeviceManager) *SensorHandler {
-	return &SensorHandler{database}
+// NewSensorHandler creates a new SensorHandler. Deleted sensors may be restored
+// for the duration of the restore window.
+func NewSensorHandler(database db.DeviceManager, accountManager db.AccountManager, measurementsDatabase db.MeasurementsDatabase, restoreWindow time.Duration) *SensorHandler {
+	return &SensorHandler{database, accountManager, measurementsDatabase, restoreWindow}
 }
 
 // InitializeRouterForSensorHandler initializes the handler on the given router
-func InitializeRouterForSensorHandler(r *mux.Router, database db.DeviceManager) {
-	m := NewSensorHandler(database)
+func InitializeRouterForSensorHandler(r *mux.Router, database db.DeviceManager, accountManager db.AccountManager, measurementsDatabase db.MeasurementsDatabase, restoreWindow time.Duration) {
+	m := NewSensorHandler(database, accountManager, measurementsDatabase, restoreWindow)
 	r.HandleFunc("/data-access/v1/sensor/{sensor_id}", m.GetSensor).Methods("GET")
 	r.HandleFunc("/data-access/v1/sensor/{sensor_id}", m.UpdateSensor).Methods("PUT")
+	r.HandleFunc("/data-access/v1/sensor/{sensor_id}", m.PatchSensor).Methods("PATCH")
+	r.HandleFunc("/data-access/v1/sensor/{sensor_id}", m.DeleteSensor).Methods("DELETE")
+	r.HandleFunc("/data-access/v1/sensor/{sensor_id}/restore", m.RestoreSensor).Methods("POST")
+	r.HandleFunc("/data-access/v1/sensor/{sensor_id}/extremes", m.GetSensorExtremes).Methods("GET")
+	r.HandleFunc("/data-access/v1/sensor/{sensor_id}/daily_summaries", m.GetDailySummaries).Methods("GET")
+	r.HandleFunc("/data-access/v1/sensor/{sensor_id}/readings", m.WriteSensorReadings).Methods("POST")
+	r.HandleFunc("/data-access/v1/sensors", m.CreateSensor).Methods("POST")
 }
 
 // GetSensor retrieves a sensor from the database
 func (m *SensorHandler) GetSensor(resp http.ResponseWriter, req *http.Request) {
-	sensorID := mux.Vars(req)["sensor_id"]
-	if sensor, err := m.database.GetSensor(sensorID); err == nil {
+	if sensor, ok := m.getOwnedSensor(resp, req); ok {
 		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("ETag", formatETag(sensor.Version))
 		resp.WriteHeader(http.StatusOK)
 		responseEncoder := json.NewEncoder(resp)
 		responseEncoder.Encode(sensor)
+	}
+}
+
+// CreateSensor creates a new sensor record in the database with a generated ID
+func (m *SensorHandler) CreateSensor(resp http.ResponseWriter, req *http.Request) {
+	// bind the request to a sensor model
+	sensor := new(db.Sensor)
+	errs := binding.Bind(req, sensor)
+	if errs.Handle(resp) {
+		log.Printf("Error while binding request to model: %s", errs.Error())
+		http.Error(resp,
+			"Invalid request",
+			http.StatusBadRequest)
+		return
+	}
+	if sensor.AccountID == "" {
+		sensor.AccountID = callerAccountID(req)
+	}
+	if sensor.AccountID == "" {
+		log.Printf("Sensor create request has no account")
+		http.Error(resp,
+			"Account is required",
+			http.StatusBadRequest)
+		return
+	}
+	if !verifyAccountOwner(resp, req, sensor.AccountID) || !verifyAccountActive(resp, m.accountManager, sensor.AccountID) {
+		return
+	}
+
+	if createdSensor, err := m.database.CreateSensor(sensor); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Location", fmt.Sprintf("/data-access/v1/sensor/%s", createdSensor.ID))
+		resp.WriteHeader(http.StatusCreated)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(createdSensor)
+	} else if err == db.ErrAlreadyExists {
+		log.Printf("Generated sensor ID already exists: %s", sensor.ID)
+		http.Error(resp,
+			"Sensor already exists",
+			http.StatusConflict)
 	} else {
-		log.Printf("Error getting sensor: %s", err.Error())
+		log.Printf("Error creating sensor: %s", err.Error())
 		http.Error(resp,
-			"Error getting sensor",
+			"Error creating sensor",
 			http.StatusInternalServerError)
 	}
 }
@@ -57,22 +122,389 @@ func (m *SensorHandler) UpdateSensor(resp http.ResponseWriter, req *http.Request
 	}
 
 	sensorID := mux.Vars(req)["sensor_id"]
-	if _, err := m.database.GetSensor(sensorID); err != nil {
-		log.Printf("Error getting sensor for update: %s", err.Error())
+	expectedVersion, ok := m.checkSensorUpdatable(resp, req, sensorID)
+	if !ok {
+		return
+	}
+	if sensor, err := m.database.UpdateSensor(sensorID, sensorUpdates, expectedVersion); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("ETag", formatETag(sensor.Version))
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(sensor)
+	} else if err == db.ErrSensorNotFound {
+		log.Printf("Sensor was removed concurrently: %s", sensorID)
+		http.Error(resp,
+			"Sensor not found",
+			http.StatusNotFound)
+	} else if err == db.ErrVersionMismatch {
+		log.Printf("Sensor was modified concurrently: %s", sensorID)
+		http.Error(resp,
+			"Sensor has been modified",
+			http.StatusPreconditionFailed)
+	} else {
+		log.Printf("Error getting sensor: %s", err.Error())
+		http.Error(resp,
+			"Error getting sensor",
+			http.StatusInternalServerError)
+	}
+}
+
+// PatchSensor updates only the sensor fields present in the request
+func (m *SensorHandler) PatchSensor(resp http.ResponseWriter, req *http.Request) {
+	// bind the request to a sensor patch model
+	patch := new(db.SensorPatch)
+	errs := binding.Bind(req, patch)
+	if errs.Handle(resp) {
+		log.Printf("Error while binding request to model: %s", errs.Error())
 		http.Error(resp,
-			"Error getting sensor for update",
+			"Invalid request",
 			http.StatusBadRequest)
 		return
 	}
-	if sensor, err := m.database.UpdateSensor(sensorID, sensorUpdates); err == nil {
+
+	sensorID := mux.Vars(req)["sensor_id"]
+	expectedVersion, ok := m.checkSensorUpdatable(resp, req, sensorID)
+	if !ok {
+		return
+	}
+	if sensor, err := m.database.PatchSensor(sensorID, patch, expectedVersion); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("ETag", formatETag(sensor.Version))
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(sensor)
+	} else if err == db.ErrSensorNotFound {
+		log.Printf("Sensor was removed concurrently: %s", sensorID)
+		http.Error(resp,
+			"Sensor not found",
+			http.StatusNotFound)
+	} else if err == db.ErrVersionMismatch {
+		log.Printf("Sensor was modified concurrently: %s", sensorID)
+		http.Error(resp,
+			"Sensor has been modified",
+			http.StatusPreconditionFailed)
+	} else {
+		log.Printf("Error patching sensor: %s", err.Error())
+		http.Error(resp,
+			"Error patching sensor",
+			http.StatusInternalServerError)
+	}
+}
+
+// checkSensorUpdatable verifies the sensor exists, belongs to the caller, isn't
+// deleted and matches any If-Match precondition. It returns the version the
+// update must be applied to, or writes an error response and returns false.
+func (m *SensorHandler) checkSensorUpdatable(resp http.ResponseWriter, req *http.Request, sensorID string) (int64, bool) {
+	expectedVersion, err := parseIfMatch(req.Header.Get("If-Match"))
+	if err != nil {
+		log.Printf("Invalid If-Match header: %s", err.Error())
+		http.Error(resp,
+			"Invalid If-Match header",
+			http.StatusBadRequest)
+		return expectedVersion, false
+	}
+
+	sensor, ok := m.getOwnedSensor(resp, req)
+	if !ok {
+		return expectedVersion, false
+	}
+	if sensor.DeletedAt != 0 {
+		log.Printf("Attempted update of deleted sensor: %s", sensorID)
+		http.Error(resp,
+			"Sensor has been deleted",
+			http.StatusConflict)
+		return expectedVersion, false
+	}
+	if expectedVersion != db.AnyVersion && expectedVersion != sensor.Version {
+		log.Printf("Sensor version %d does not match If-Match version %d: %s", sensor.Version, expectedVersion, sensorID)
+		http.Error(resp,
+			"Sensor has been modified",
+			http.StatusPreconditionFailed)
+		return expectedVersion, false
+	}
+	return expectedVersion, true
+}
+
+// DeleteSensor soft-deletes a sensor, optionally purging its measurements. The
+// measurements are purged before the sensor is deleted, so a failed purge
+// leaves the sensor in place to be retried, and the measurements of a sensor
+// that is already deleted may still be purged.
+func (m *SensorHandler) DeleteSensor(resp http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	purgeMeasurements := parseOptionalBoolParam(q.Get("purge_measurements"), false)
+
+	existing, ok := m.getOwnedSensor(resp, req)
+	if !ok {
+		return
+	}
+
+	if purgeMeasurements {
+		if err := m.measurementsDatabase.DeleteSensorReadings(existing.AccountID, existing.ID); err != nil {
+			log.Printf("Error purging sensor measurements: %s", err.Error())
+			http.Error(resp,
+				"Error purging sensor measurements, sensor was not deleted",
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sensor, err := m.database.DeleteSensor(existing.ID)
+	if err == db.ErrSensorDeleted && purgeMeasurements {
+		// the sensor was deleted earlier without purging its measurements
+		sensor = existing
+	} else if err == db.ErrSensorDeleted {
+		log.Printf("Sensor already deleted: %s", existing.ID)
+		http.Error(resp,
+			"Sensor already deleted",
+			http.StatusConflict)
+		return
+	} else if err != nil && purgeMeasurements {
+		log.Printf("Error deleting sensor after purging its measurements: %s", err.Error())
+		http.Error(resp,
+			"Sensor measurements were purged but the sensor could not be deleted",
+			http.StatusInternalServerError)
+		return
+	} else if err != nil {
+		log.Printf("Error deleting sensor: %s", err.Error())
+		http.Error(resp,
+			"Error deleting sensor",
+			http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	responseEncoder := json.NewEncoder(resp)
+	responseEncoder.Encode(sensor)
+}
+
+// RestoreSensor undoes a sensor soft-delete within the restore window
+func (m *SensorHandler) RestoreSensor(resp http.ResponseWriter, req *http.Request) {
+	sensorID := mux.Vars(req)["sensor_id"]
+	if _, ok := m.getOwnedSensor(resp, req); !ok {
+		return
+	}
+
+	if sensor, err := m.database.RestoreSensor(sensorID, m.restoreWindow); err == nil {
 		resp.Header().Set("Content-Type", "application/json")
 		resp.WriteHeader(http.StatusOK)
 		responseEncoder := json.NewEncoder(resp)
 		responseEncoder.Encode(sensor)
+	} else if err == db.ErrSensorNotDeleted {
+		log.Printf("Attempted restore of sensor that isn't deleted: %s", sensorID)
+		http.Error(resp,
+			"Sensor is not deleted",
+			http.StatusConflict)
+	} else if err == db.ErrRestoreWindowExpired {
+		log.Printf("Restore window expired for sensor: %s", sensorID)
+		http.Error(resp,
+			"Sensor restore window has expired",
+			http.StatusGone)
+	} else {
+		log.Printf("Error restoring sensor: %s", err.Error())
+		http.Error(resp,
+			"Error restoring sensor",
+			http.StatusInternalServerError)
+	}
+}
+
+// GetSensorExtremes retrieves the minimum and maximum of each measurement of a
+// sensor within a time range
+func (m *SensorHandler) GetSensorExtremes(resp http.ResponseWriter, req *http.Request) {
+	startTime, endTime, ok := parseTimeRange(resp, req.URL.Query())
+	if !ok {
+		return
+	}
+
+	sensor, ok := m.getOwnedSensor(resp, req)
+	if !ok {
+		return
+	}
+
+	if extremes, err := m.measurementsDatabase.GetSensorExtremes(sensor.AccountID, sensor.ID, startTime, endTime); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(&GetSensorExtremesResponse{sensor.ID, sensor.AccountID, startTime, endTime, extremes})
+	} else {
+		log.Printf("Error getting sensor extremes: %s", err.Error())
+		http.Error(resp,
+			"Error getting sensor extremes",
+			http.StatusInternalServerError)
+	}
+}
+
+// GetDailySummaries retrieves the minimum, mean and maximum of each measurement
+// of a sensor for each calendar day in the sensor's time zone. Days are given
+// by the start_date and end_date parameters as YYYY-MM-DD, defaulting to the
+// last week.
+func (m *SensorHandler) GetDailySummaries(resp http.ResponseWriter, req *http.Request) {
+	sensor, ok := m.getOwnedSensor(resp, req)
+	if !ok {
+		return
+	}
+
+	location := time.UTC
+	if sensor.TimeZoneID != "" {
+		if sensorLocation, err := time.LoadLocation(sensor.TimeZoneID); err == nil {
+			location = sensorLocation
+		} else {
+			log.Printf("Unable to load time zone %s, summarizing in UTC: %s", sensor.TimeZoneID, err.Error())
+		}
+	}
+
+	q := req.URL.Query()
+	lastDay := time.Now().In(location)
+	if q.Get("end_date") != "" {
+		var err error
+		if lastDay, err = time.ParseInLocation(db.DailySummaryDateFormat, q.Get("end_date"), location); err != nil {
+			log.Printf("Unable to parse end_date: %s", err.Error())
+			http.Error(resp, "end_date must be a date formatted as YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	firstDay := lastDay.AddDate(0, 0, -defaultDailySummaryDays+1)
+	if q.Get("start_date") != "" {
+		var err error
+		if firstDay, err = time.ParseInLocation(db.DailySummaryDateFormat, q.Get("start_date"), location); err != nil {
+			log.Printf("Unable to parse start_date: %s", err.Error())
+			http.Error(resp, "start_date must be a date formatted as YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if firstDay.After(lastDay) || firstDay.AddDate(0, 0, maxDailySummaryDays).Before(lastDay) {
+		log.Printf("Daily summary range out of bounds: %s to %s", q.Get("start_date"), q.Get("end_date"))
+		http.Error(resp,
+			fmt.Sprintf("start_date must be on or before end_date, and at most %d days earlier", maxDailySummaryDays),
+			http.StatusBadRequest)
+		return
+	}
+
+	if summaries, err := m.measurementsDatabase.GetDailySummaries(sensor.AccountID, sensor.ID, firstDay, lastDay); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(&GetDailySummariesResponse{sensor.ID, sensor.AccountID, location.String(), summaries})
 	} else {
+		log.Printf("Error getting daily summaries: %s", err.Error())
+		http.Error(resp,
+			"Error getting daily summaries",
+			http.StatusInternalServerError)
+	}
+}
+
+// getOwnedSensor retrieves the sensor named in the request path, writing an
+// error response and returning false if it doesn't exist or belongs to an
+// account other than the caller's
+func (m *SensorHandler) getOwnedSensor(resp http.ResponseWriter, req *http.Request) (*db.Sensor, bool) {
+	sensorID := mux.Vars(req)["sensor_id"]
+	sensor, err := m.database.GetSensor(sensorID)
+	if err == db.ErrSensorNotFound {
+		log.Printf("Sensor not found: %s", sensorID)
+		http.Error(resp,
+			"Sensor not found",
+			http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
 		log.Printf("Error getting sensor: %s", err.Error())
 		http.Error(resp,
 			"Error getting sensor",
 			http.StatusInternalServerError)
+		return nil, false
 	}
+	return sensor, verifySensorOwner(resp, req, sensor)
+}
+
+// WriteSensorReadings records a batch of readings for an active sensor
+func (m *SensorHandler) WriteSensorReadings(resp http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxWrittenReadingsBytes))
+	if err != nil && isRequestBodyTooLarge(err) {
+		log.Printf("Sensor readings are too large: %s", err.Error())
+		http.Error(resp,
+			fmt.Sprintf("Readings must be at most %d bytes", maxWrittenReadingsBytes),
+			http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Printf("Error reading sensor readings: %s", err.Error())
+		http.Error(resp,
+			"Invalid request",
+			http.StatusBadRequest)
+		return
+	}
+	var request WriteSensorReadingsRequest
+	if err = json.Unmarshal(body, &request); err != nil {
+		log.Printf("Error decoding sensor readings: %s", err.Error())
+		http.Error(resp,
+			"Invalid request",
+			http.StatusBadRequest)
+		return
+	}
+	if len(request.Readings) == 0 || len(request.Readings) > maxWrittenReadings {
+		log.Printf("Number of sensor readings out of range: %d", len(request.Readings))
+		http.Error(resp,
+			fmt.Sprintf("readings must have between 1 and %d readings", maxWrittenReadings),
+			http.StatusBadRequest)
+		return
+	}
+
+	sensor, ok := m.getOwnedSensor(resp, req)
+	if !ok {
+		return
+	}
+	if sensor.State != db.SensorStateActive || sensor.DeletedAt != 0 {
+		log.Printf("Readings written for inactive sensor: %s", sensor.ID)
+		http.Error(resp,
+			"Sensor is not active",
+			http.StatusConflict)
+		return
+	}
+
+	if err = m.measurementsDatabase.WriteSensorReadings(sensor.AccountID, sensor.ID, request.Readings); err == nil {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusCreated)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(&WriteSensorReadingsResponse{sensor.ID, sensor.AccountID, len(request.Readings)})
+	} else if err == db.ErrInvalidReading {
+		log.Printf("Invalid readings written for sensor: %s", sensor.ID)
+		http.Error(resp,
+			"Readings must have a timestamp and measurements matching their types",
+			http.StatusBadRequest)
+	} else {
+		log.Printf("Error writing sensor readings: %s", err.Error())
+		http.Error(resp,
+			"Error writing sensor readings",
+			http.StatusInternalServerError)
+	}
+}
+
+// GetSensorExtremesResponse has the extremes of a sensor's measurements over a
+// time range
+type GetSensorExtremesResponse struct {
+	SensorID     string                  `json:"sensor_id"`
+	AccountID    string                  `json:"account_id"`
+	StartTime    int64                   `json:"start_time"`
+	EndTime      int64                   `json:"end_time"`
+	Measurements []*db.MinMaxMeasurement `json:"measurements"`
+}
+
+// GetDailySummariesResponse has the daily summaries of a sensor's measurements
+// and the time zone the days are in
+type GetDailySummariesResponse struct {
+	SensorID   string             `json:"sensor_id"`
+	AccountID  string             `json:"account_id"`
+	TimeZoneID string             `json:"timezone_id"`
+	Days       []*db.DailySummary `json:"days"`
+}
+
+// WriteSensorReadingsRequest has a batch of readings to record for a sensor
+type WriteSensorReadingsRequest struct {
+	Readings []*db.MinimalReading `json:"readings"`
+}
+
+// WriteSensorReadingsResponse has the number of readings recorded for a sensor
+type WriteSensorReadingsResponse struct {
+	SensorID  string `json:"sensor_id"`
+	AccountID string `json:"account_id"`
+	Written   int    `json:"written"`
 }
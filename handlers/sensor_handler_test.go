@@ -0,0 +1,668 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/skidder/streammarker-data-access/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSensorTestRouter(database db.DeviceManager) *mux.Router {
+	return newSensorTestRouterWithMeasurements(database, newFakeMeasurementsDatabase())
+}
+
+func newSensorTestRouterWithMeasurements(database db.DeviceManager, measurementsDatabase db.MeasurementsDatabase) *mux.Router {
+	return newSensorTestRouterWithAccounts(database, newFakeAccountManager("account1", "account2"), measurementsDatabase)
+}
+
+func newSensorTestRouterWithAccounts(database db.DeviceManager, accountManager db.AccountManager, measurementsDatabase db.MeasurementsDatabase) *mux.Router {
+	r := mux.NewRouter()
+	InitializeRouterForSensorHandler(r, database, accountManager, measurementsDatabase, 24*time.Hour)
+	return r
+}
+
+func TestCreateSensorAppliesDefaults(t *testing.T) {
+	database := newFakeDeviceManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"account_id":"account1","name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var sensor db.Sensor
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&sensor))
+	assert.NotEmpty(t, sensor.ID)
+	assert.Equal(t, "/data-access/v1/sensor/"+sensor.ID, rec.Header().Get("Location"))
+	assert.Equal(t, "account1", sensor.AccountID)
+	assert.Equal(t, db.SensorStateActive, sensor.State)
+	assert.Equal(t, int64(1), sensor.SampleFrequency)
+}
+
+func TestCreateSensorAlreadyExists(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.err = db.ErrAlreadyExists
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"account_id":"account1","name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestCreateSensorDefaultsToCallerAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, withCallerAccount(req, "account2"))
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var sensor db.Sensor
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&sensor))
+	assert.Equal(t, "account2", sensor.AccountID)
+}
+
+func TestCreateSensorWithoutAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, database.sensors)
+}
+
+func TestCreateSensorInMissingAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"account_id":"account9","name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, database.sensors)
+}
+
+func TestCreateSensorInSuspendedAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+	accounts := newFakeAccountManager()
+	accounts.accounts["account1"] = &db.Account{ID: "account1", State: db.AccountStateSuspended}
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"account_id":"account1","name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouterWithAccounts(database, accounts, newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, database.sensors)
+}
+
+func TestCreateSensorWithUnknownState(t *testing.T) {
+	database := newFakeDeviceManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"account_id":"account1","name":"Tomatoes","state":"exploded"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Empty(t, database.sensors)
+}
+
+func TestDeleteSensor(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	measurements := newFakeMeasurementsDatabase()
+	measurements.readings["sensor1"] = []*db.MinimalReading{{Timestamp: 1}}
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/sensor/sensor1", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouterWithMeasurements(database, measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotZero(t, database.sensors["sensor1"].DeletedAt)
+	assert.Contains(t, measurements.readings, "sensor1")
+
+	sensors, _ := database.GetSensors("account1", "", false)
+	assert.Empty(t, sensors)
+	sensors, _ = database.GetSensors("account1", "", true)
+	assert.Len(t, sensors, 1)
+}
+
+func TestDeleteSensorWithPurge(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	measurements := newFakeMeasurementsDatabase()
+	measurements.readings["sensor1"] = []*db.MinimalReading{{Timestamp: 1}}
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/sensor/sensor1?purge_measurements=true", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouterWithMeasurements(database, measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, measurements.readings, "sensor1")
+}
+
+func TestDeleteSensorAlreadyDeleted(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active", DeletedAt: time.Now().Unix()}
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/sensor/sensor1", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestDeleteSensorWithFailedPurgeKeepsSensor(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	measurements := newFakeMeasurementsDatabase()
+	measurements.err = errors.New("InfluxDB unavailable")
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/sensor/sensor1?purge_measurements=true", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouterWithMeasurements(database, measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Zero(t, database.sensors["sensor1"].DeletedAt)
+}
+
+func TestDeleteSensorPurgesAlreadyDeletedSensor(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active", DeletedAt: time.Now().Unix()}
+	measurements := newFakeMeasurementsDatabase()
+	measurements.readings["sensor1"] = []*db.MinimalReading{{Timestamp: 1}}
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/sensor/sensor1?purge_measurements=true", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouterWithMeasurements(database, measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, measurements.readings, "sensor1")
+}
+
+func TestRestoreSensor(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active", DeletedAt: time.Now().Unix()}
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensor/sensor1/restore", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Zero(t, database.sensors["sensor1"].DeletedAt)
+}
+
+func TestRestoreSensorOutsideWindow(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active", DeletedAt: time.Now().Add(-48 * time.Hour).Unix()}
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensor/sensor1/restore", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusGone, rec.Code)
+	assert.NotZero(t, database.sensors["sensor1"].DeletedAt)
+}
+
+func TestUpdateDeletedSensor(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active", DeletedAt: time.Now().Unix()}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Tomatoes","state":"active"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestPatchSensorOnlyChangesSuppliedFields(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", LocationEnabled: true, Latitude: 38.09, Longitude: -122.18}
+
+	req, _ := http.NewRequest("PATCH", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	sensor := database.sensors["sensor1"]
+	assert.Equal(t, "Tomatoes", sensor.Name)
+	assert.True(t, sensor.LocationEnabled)
+	assert.Equal(t, 38.09, sensor.Latitude)
+	assert.Equal(t, -122.18, sensor.Longitude)
+}
+
+func TestPatchSensorClearsLocation(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", LocationEnabled: true, Latitude: 38.09, Longitude: -122.18}
+
+	req, _ := http.NewRequest("PATCH", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"clear_location":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	sensor := database.sensors["sensor1"]
+	assert.False(t, sensor.LocationEnabled)
+	assert.Zero(t, sensor.Latitude)
+}
+
+func TestPatchSensorRejectsConflictingLocation(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active"}
+
+	req, _ := http.NewRequest("PATCH", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"clear_location":true,"latitude":10}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.NotEqual(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Sensor X", database.sensors["sensor1"].Name)
+}
+
+func TestGetSensorReturnsETag(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", Version: 4}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor/sensor1", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"4"`, rec.Header().Get("ETag"))
+}
+
+func TestUpdateSensorWithMatchingVersion(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", Version: 4}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Tomatoes","state":"active"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"4"`)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"5"`, rec.Header().Get("ETag"))
+	assert.Equal(t, "Tomatoes", database.sensors["sensor1"].Name)
+}
+
+func TestUpdateSensorWithStaleVersion(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", Version: 5}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Tomatoes","state":"active"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"4"`)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+	assert.Equal(t, "Sensor X", database.sensors["sensor1"].Name)
+}
+
+func TestUpdateSensorWithMalformedVersion(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", Version: 4}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Tomatoes","state":"active"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"four"`)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "Sensor X", database.sensors["sensor1"].Name)
+}
+
+func TestUpdateSensorWithConcurrentModification(t *testing.T) {
+	database := &racingDeviceManager{newFakeDeviceManager()}
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", Version: 4}
+
+	req, _ := http.NewRequest("PATCH", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", `"4"`)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+}
+
+// racingDeviceManager simulates another client updating a sensor between the
+// handler reading it and writing the update
+type racingDeviceManager struct {
+	*fakeDeviceManager
+}
+
+func (r *racingDeviceManager) PatchSensor(sensorID string, patch *db.SensorPatch, expectedVersion int64) (*db.Sensor, error) {
+	r.sensors[sensorID].Version++
+	return r.fakeDeviceManager.PatchSensor(sensorID, patch, expectedVersion)
+}
+
+func TestUpdateSensorRemovedConcurrently(t *testing.T) {
+	for _, method := range []string{"PUT", "PATCH"} {
+		database := &vanishingDeviceManager{newFakeDeviceManager()}
+		database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Sensor X", State: "active", Version: 4}
+
+		req, _ := http.NewRequest(method, "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Tomatoes","state":"active"}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		newSensorTestRouter(database).ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code, method)
+	}
+}
+
+// vanishingDeviceManager simulates a sensor being removed between the handler
+// reading it and writing the update
+type vanishingDeviceManager struct {
+	*fakeDeviceManager
+}
+
+func (v *vanishingDeviceManager) UpdateSensor(sensorID string, sensorUpdates *db.Sensor, expectedVersion int64) (*db.Sensor, error) {
+	delete(v.sensors, sensorID)
+	return v.fakeDeviceManager.UpdateSensor(sensorID, sensorUpdates, expectedVersion)
+}
+
+func (v *vanishingDeviceManager) PatchSensor(sensorID string, patch *db.SensorPatch, expectedVersion int64) (*db.Sensor, error) {
+	delete(v.sensors, sensorID)
+	return v.fakeDeviceManager.PatchSensor(sensorID, patch, expectedVersion)
+}
+
+func TestGetSensorInOtherAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor/sensor1", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, withCallerAccount(req, "account2"))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGetSensorMissing(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor/sensor1", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(newFakeDeviceManager()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestUpdateSensorInOtherAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Tomatoes", State: "active"}
+
+	req, _ := http.NewRequest("PUT", "/data-access/v1/sensor/sensor1", strings.NewReader(`{"name":"Peppers","state":"active","sample_frequency":60}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, withCallerAccount(req, "account2"))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "Tomatoes", database.sensors["sensor1"].Name)
+}
+
+func TestSensorInOtherAccountLooksMissing(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Tomatoes", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", Name: "Peppers", State: "active", DeletedAt: time.Now().Unix()}
+	router := newSensorTestRouter(database)
+
+	for _, tc := range []struct {
+		method   string
+		sensorID string
+		suffix   string
+		body     string
+	}{
+		{"GET", "sensor1", "", ""},
+		{"PUT", "sensor1", "", `{"name":"Peppers","state":"active","sample_frequency":60}`},
+		{"PATCH", "sensor1", "", `{"name":"Peppers"}`},
+		{"DELETE", "sensor1", "", ""},
+		{"POST", "sensor2", "/restore", ""},
+	} {
+		req, _ := http.NewRequest(tc.method, "/data-access/v1/sensor/"+tc.sensorID+tc.suffix, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		otherAccount := httptest.NewRecorder()
+		router.ServeHTTP(otherAccount, withCallerAccount(req, "account2"))
+
+		req, _ = http.NewRequest(tc.method, "/data-access/v1/sensor/sensor9"+tc.suffix, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		missing := httptest.NewRecorder()
+		router.ServeHTTP(missing, withCallerAccount(req, "account2"))
+
+		assert.Equal(t, http.StatusNotFound, otherAccount.Code, tc.method)
+		assert.Equal(t, missing.Code, otherAccount.Code, tc.method)
+		assert.Equal(t, missing.Body.String(), otherAccount.Body.String(), tc.method)
+	}
+	assert.Equal(t, "Tomatoes", database.sensors["sensor1"].Name)
+	assert.Equal(t, "active", database.sensors["sensor1"].State)
+	assert.NotZero(t, database.sensors["sensor2"].DeletedAt)
+}
+
+func TestDeleteSensorDatabaseError(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.err = errors.New("dynamodb is down")
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/sensor/sensor1", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestCreateSensorInOtherAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensors", strings.NewReader(`{"account_id":"account1","name":"Tomatoes"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, withCallerAccount(req, "account2"))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, database.sensors)
+}
+
+func TestDeleteSensorWithPurgeBindsHostileIDs(t *testing.T) {
+	hostileSensorID := "1' or account_id = 'account2"
+	database := newFakeDeviceManager()
+	database.sensors[hostileSensorID] = &db.Sensor{ID: hostileSensorID, AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{}
+	router := newSensorTestRouterWithMeasurements(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("DELETE", "/data-access/v1/sensor/"+url.PathEscape(hostileSensorID)+"?purge_measurements=true", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, influx.queries, 1)
+	assert.NotContains(t, influx.queries[0].Command, "account2")
+	assert.Equal(t, hostileSensorID, influx.queries[0].Parameters["sensor_id"])
+}
+
+func TestGetSensorExtremes(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{results: [][]client.Result{
+		{{Series: []models.Row{{Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{
+			{"temperature", "float"},
+			{"door_open", "boolean"},
+		}}}}},
+		{
+			{Series: []models.Row{{Columns: []string{"time", "min"}, Values: [][]interface{}{{"2016-05-01T04:00:00Z", json.Number("12.5")}}}}},
+			{Series: []models.Row{{Columns: []string{"time", "max"}, Values: [][]interface{}{{"2016-05-01T15:00:00Z", json.Number("27")}}}}},
+		},
+	}}
+	router := newSensorTestRouterWithMeasurements(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor/sensor1/extremes?start_time=1462060800&end_time=1462147200", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, influx.queries, 2)
+	assert.Equal(t, `SELECT min("temperature") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time; SELECT max("temperature") FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time`, influx.queries[1].Command)
+	var response GetSensorExtremesResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, []*db.MinMaxMeasurement{{
+		Name: "temperature",
+		Min:  db.Measurement{Name: "temperature", Value: 12.5, Unit: "Celsius", Timestamp: 1462075200},
+		Max:  db.Measurement{Name: "temperature", Value: 27, Unit: "Celsius", Timestamp: 1462114800},
+	}}, response.Measurements)
+}
+
+func TestGetSensorExtremesInOtherAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor/sensor1/extremes", nil)
+	rec := httptest.NewRecorder()
+	newSensorTestRouter(database).ServeHTTP(rec, withCallerAccount(req, "account2"))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestWriteSensorReadings(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{}
+	router := newSensorTestRouterWithMeasurements(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	body := `{"readings":[{"timestamp":1462060800,"measurements":[{"name":"temperature","value":21.5},{"name":"humidity","value":60}]},{"timestamp":1462060860,"measurements":[{"name":"temperature","value":21.6}]}]}`
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensor/sensor1/readings", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var response WriteSensorReadingsResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, WriteSensorReadingsResponse{"sensor1", "account1", 2}, response)
+	if assert.Len(t, influx.writes, 1) {
+		batch := influx.writes[0]
+		assert.Equal(t, "streammarker_measurements", batch.Database())
+		assert.Equal(t, "ns", batch.Precision())
+		assert.Len(t, batch.Points(), 2)
+		point := batch.Points()[0]
+		assert.Equal(t, "sensor_measurements", point.Name())
+		assert.Equal(t, map[string]string{"account_id": "account1", "sensor_id": "sensor1"}, point.Tags())
+		assert.Equal(t, int64(1462060800), point.Time().Unix())
+		fields, _ := point.Fields()
+		assert.Equal(t, map[string]interface{}{"temperature": 21.5, "humidity": 60.0}, fields)
+	}
+}
+
+func TestWriteSensorReadingsRejected(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", State: "inactive"}
+	influx := &fakeInfluxClient{}
+	router := newSensorTestRouterWithMeasurements(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+	reading := `{"readings":[{"timestamp":1462060800,"measurements":[{"name":"temperature","value":21.5}]}]}`
+
+	for _, tc := range []struct {
+		sensorID string
+		account  string
+		body     string
+		code     int
+	}{
+		{"sensor1", "", `{"readings":[]}`, http.StatusBadRequest},
+		{"sensor1", "", `not json`, http.StatusBadRequest},
+		{"sensor1", "", `{"readings":[{"measurements":[{"name":"temperature","value":21.5}]}]}`, http.StatusBadRequest},
+		{"sensor1", "", `{"readings":[{"timestamp":1462060800,"measurements":[{"name":"account_id","value":1}]}]}`, http.StatusBadRequest},
+		{"sensor1", "", `{"readings":[{"timestamp":1462060800,"measurements":[{"name":"humidity","value":11.5,"unit":"g/m³"}]}]}`, http.StatusBadRequest},
+		{"sensor1", "", `{"readings":[` + strings.Repeat(`{"timestamp":1462060800},`, maxWrittenReadingsBytes/24) + `]}`, http.StatusRequestEntityTooLarge},
+		{"sensor2", "", reading, http.StatusConflict},
+		{"sensor3", "", reading, http.StatusNotFound},
+		{"sensor1", "account2", reading, http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("POST", "/data-access/v1/sensor/"+tc.sensorID+"/readings", strings.NewReader(tc.body))
+		if tc.account != "" {
+			req = withCallerAccount(req, tc.account)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, tc.body)
+	}
+	assert.Empty(t, influx.writes)
+}
+
+func TestWriteSensorReadingsWithUnreadableBody(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{}
+	router := newSensorTestRouterWithMeasurements(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("POST", "/data-access/v1/sensor/sensor1/readings", iotest.ErrReader(errors.New("connection reset")))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, influx.writes)
+}
+
+func TestGetDailySummariesAcrossDaylightSavingTransition(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active", TimeZoneID: "America/Los_Angeles"}
+	influx := &fakeInfluxClient{results: [][]client.Result{{
+		{Series: []models.Row{{
+			Columns: []string{"time", "min_temperature", "mean_temperature", "max_temperature", "min_door_open"},
+			Values:  [][]interface{}{{"2016-03-12T08:00:00Z", json.Number("4"), json.Number("9.5"), json.Number("15"), false}},
+		}}},
+		{},
+		{},
+	}}}
+	router := newSensorTestRouterWithMeasurements(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor/sensor1/daily_summaries?start_date=2016-03-12&end_date=2016-03-14", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	params := influx.queries[0].Parameters
+	assert.Equal(t, "2016-03-12T08:00:00Z", params["day0_start"])
+	assert.Equal(t, "2016-03-13T08:00:00Z", params["day0_end"])
+	// clocks go forward on the 13th, so local midnight moves an hour earlier in UTC
+	assert.Equal(t, "2016-03-13T08:00:00Z", params["day1_start"])
+	assert.Equal(t, "2016-03-14T07:00:00Z", params["day1_end"])
+	assert.Equal(t, "2016-03-15T07:00:00Z", params["day2_end"])
+
+	var response GetDailySummariesResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, "America/Los_Angeles", response.TimeZoneID)
+	assert.Len(t, response.Days, 3)
+	assert.Equal(t, "2016-03-13", response.Days[1].Date)
+	assert.Equal(t, int64(23*60*60), response.Days[1].EndTime-response.Days[1].StartTime)
+	assert.Equal(t, []*db.DailyMeasurementSummary{{Name: "temperature", Unit: "Celsius", Min: 4, Mean: 9.5, Max: 15}}, response.Days[0].Measurements)
+	assert.Empty(t, response.Days[1].Measurements)
+}
+
+func TestGetDailySummariesRejectsInvalidRange(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	router := newSensorTestRouter(database)
+
+	for _, params := range []string{"start_date=2016-03-14&end_date=2016-03-12", "start_date=2014-01-01&end_date=2016-01-01", "start_date=yesterday"} {
+		req, _ := http.NewRequest("GET", "/data-access/v1/sensor/sensor1/daily_summaries?"+params, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, params)
+	}
+}
@@ -2,29 +2,45 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/skidder/streammarker-data-access/db"
 )
 
+const (
+	defaultSensorPageSize = 100
+	maxSensorPageSize     = 1000
+
+	// allSensorsID queries the readings of every sensor in the account
+	allSensorsID = "all"
+	// maxReadingsQuerySensors limits how many sensors may be queried at once,
+	// whether named or included in all
+	maxReadingsQuerySensors = 100
+
+	// maxReadingBuckets limits how many intervals an aggregated readings query
+	// may span
+	maxReadingBuckets = 10000
+)
+
 // SensorReadingsHandler instance for retrieving readings
 type SensorReadingsHandler struct {
 	deviceManager        db.DeviceManager
 	measurementsDatabase db.MeasurementsDatabase
+	accountManager       db.AccountManager
 }
 
 // NewSensorReadingsHandler creates a new SensorReadingsHandler
-func NewSensorReadingsHandler(deviceManager db.DeviceManager, measurementsDatabase db.MeasurementsDatabase) *SensorReadingsHandler {
-	return &SensorReadingsHandler{deviceManager, measurementsDatabase}
+func NewSensorReadingsHandler(deviceManager db.DeviceManager, measurementsDatabase db.MeasurementsDatabase, accountManager db.AccountManager) *SensorReadingsHandler {
+	return &SensorReadingsHandler{deviceManager, measurementsDatabase, accountManager}
 }
 
 // InitializeRouterForSensorsDataRetrieval creates a SensorReadingsHandler on the given router
-func InitializeRouterForSensorsDataRetrieval(r *mux.Router, deviceManager db.DeviceManager, measurementsDatabase db.MeasurementsDatabase) {
-	m := NewSensorReadingsHandler(deviceManager, measurementsDatabase)
+func InitializeRouterForSensorsDataRetrieval(r *mux.Router, deviceManager db.DeviceManager, measurementsDatabase db.MeasurementsDatabase, accountManager db.AccountManager) {
+	m := NewSensorReadingsHandler(deviceManager, measurementsDatabase, accountManager)
 	r.HandleFunc("/data-access/v1/sensors/account/{account_id}", m.GetSensors).Methods("GET")
 	r.HandleFunc("/data-access/v1/last_sensor_readings/account/{account_id}", m.GetLastSensorReadings).Methods("GET")
 	r.HandleFunc("/data-access/v1/sensor_readings", m.QueryForSensorReadings).Methods("GET")
@@ -33,14 +49,39 @@ func InitializeRouterForSensorsDataRetrieval(r *mux.Router, deviceManager db.Dev
 // GetSensors retrieves a list of sensors in an account
 func (m *SensorReadingsHandler) GetSensors(resp http.ResponseWriter, req *http.Request) {
 	q := req.URL.Query()
-	state := q.Get("state")
+	limit, err := parseLimitParam(q.Get("limit"), defaultSensorPageSize, maxSensorPageSize)
+	if err != nil {
+		log.Printf("Invalid sensor page size: %s", q.Get("limit"))
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options := &db.SensorListOptions{
+		State:          q.Get("state"),
+		IncludeDeleted: parseOptionalBoolParam(q.Get("include_deleted"), false),
+		Sort:           q.Get("sort"),
+		Limit:          limit,
+		Cursor:         q.Get("cursor"),
+	}
 
 	accountID := mux.Vars(req)["account_id"]
-	if sensors, err := m.deviceManager.GetSensors(accountID, state); err == nil {
+	if !verifyAccountOwner(resp, req, accountID) || !verifyAccountActive(resp, m.accountManager, accountID) {
+		return
+	}
+	if page, err := m.deviceManager.ListSensors(accountID, options); err == nil {
 		resp.Header().Set("Content-Type", "application/json")
 		resp.WriteHeader(http.StatusOK)
 		responseEncoder := json.NewEncoder(resp)
-		responseEncoder.Encode(&GetSensorsResponse{sensors})
+		responseEncoder.Encode(&GetSensorsResponse{page.Sensors, page.NextCursor})
+	} else if err == db.ErrInvalidCursor {
+		log.Printf("Invalid sensors cursor for account: %s", accountID)
+		http.Error(resp,
+			"Invalid cursor",
+			http.StatusBadRequest)
+	} else if err == db.ErrInvalidSort {
+		log.Printf("Invalid sensors sort order: %s", options.Sort)
+		http.Error(resp,
+			"sort must be one of name, -name, state or -state",
+			http.StatusBadRequest)
 	} else {
 		log.Printf("Error getting sensors for account: %s", err.Error())
 		http.Error(resp,
@@ -53,9 +94,24 @@ func (m *SensorReadingsHandler) GetSensors(resp http.ResponseWriter, req *http.R
 func (m *SensorReadingsHandler) GetLastSensorReadings(resp http.ResponseWriter, req *http.Request) {
 	q := req.URL.Query()
 	state := q.Get("state")
+	includeDeleted := parseOptionalBoolParam(q.Get("include_deleted"), false)
+	measurements := parseMeasurementsParam(q.Get("measurements"))
+	units, err := parseUnitOptions(q)
+	if err != nil {
+		log.Printf("Invalid units requested: %s", err.Error())
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	accountID := mux.Vars(req)["account_id"]
-	if sensors, err := m.measurementsDatabase.GetLastSensorReadings(accountID, state); err == nil {
+	if !verifyAccountOwner(resp, req, accountID) || !verifyAccountActive(resp, m.accountManager, accountID) {
+		return
+	}
+	if sensors, err := m.measurementsDatabase.GetLastSensorReadings(accountID, state, includeDeleted, measurements); err == nil {
+		if sensors.Partial {
+			log.Printf("Returning partial last sensor readings for account: %s", accountID)
+		}
+		units.ConvertLatestReadings(sensors)
 		resp.Header().Set("Content-Type", "application/json")
 		resp.WriteHeader(http.StatusOK)
 		responseEncoder := json.NewEncoder(resp)
@@ -68,37 +124,111 @@ func (m *SensorReadingsHandler) GetLastSensorReadings(resp http.ResponseWriter,
 	}
 }
 
-// QueryForSensorReadings retrieves readings for a sensor in an account matching certain criteria
+// QueryForSensorReadings retrieves readings for a sensor in an account matching certain criteria.
+// Clients accepting NDJSON or CSV are sent every reading in the time range as a stream. Several
+// sensor_id values, or sensor_id=all, return the readings of each sensor keyed by sensor ID.
 func (m *SensorReadingsHandler) QueryForSensorReadings(resp http.ResponseWriter, req *http.Request) {
 	q := req.URL.Query()
 	accountID := q.Get("account_id")
 	sensorID := q.Get("sensor_id")
-	var err error
-	var startTime, endTime int64
-	if q.Get("start_time") != "" {
-		if startTime, err = strconv.ParseInt(q.Get("start_time"), 10, 32); err != nil {
-			log.Printf("Unable to parse start_time as int: %s", err.Error())
-			http.Error(resp, "Unable to parse start_time as int", http.StatusBadRequest)
+	units, err := parseUnitOptions(q)
+	if err != nil {
+		log.Printf("Invalid units requested: %s", err.Error())
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	startTime, endTime, ok := parseTimeRange(resp, q)
+	if !ok {
+		return
+	}
+
+	limit, err := parseLimitParam(q.Get("limit"), db.DefaultReadingsPageSize, db.MaxReadingsPageSize)
+	if err != nil {
+		log.Printf("Invalid readings page size: %s", q.Get("limit"))
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options := &db.ReadingsQueryOptions{
+		Aggregate:    q.Get("agg"),
+		Fill:         q.Get("fill"),
+		Limit:        limit,
+		Cursor:       q.Get("cursor"),
+		Measurements: parseMeasurementsParam(q.Get("measurements")),
+	}
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		options.Ascending = true
+	default:
+		log.Printf("Invalid readings order: %s", q.Get("order"))
+		http.Error(resp,
+			"order must be asc or desc",
+			http.StatusBadRequest)
+		return
+	}
+	if q.Get("interval") != "" {
+		if options.Interval, err = parseInterval(q.Get("interval")); err != nil {
+			log.Printf("Unable to parse interval: %s", err.Error())
+			http.Error(resp, "interval must be a duration such as 5m, 1h or 1d", http.StatusBadRequest)
 			return
 		}
-	} else {
-		// default start-time is one month ago
-		startTime = time.Now().AddDate(0, -1, 0).Unix()
+		if options.Aggregate == "" {
+			options.Aggregate = db.AggregateMean
+		}
+		if time.Duration(endTime-startTime)*time.Second/options.Interval > maxReadingBuckets {
+			log.Printf("Readings query spans too many intervals: %s", q.Get("interval"))
+			http.Error(resp, fmt.Sprintf("interval must divide the time range into at most %d buckets", maxReadingBuckets), http.StatusBadRequest)
+			return
+		}
+	}
+	if err = options.Validate(); err != nil {
+		log.Printf("Invalid readings aggregation: interval=%s agg=%s fill=%s", q.Get("interval"), options.Aggregate, options.Fill)
+		http.Error(resp, "Invalid interval, agg or fill", http.StatusBadRequest)
+		return
+	}
+
+	if !verifyAccountOwner(resp, req, accountID) {
+		return
 	}
-	if q.Get("end_time") != "" {
-		if endTime, err = strconv.ParseInt(q.Get("end_time"), 10, 32); err != nil {
-			log.Printf("Unable to parse end_time as int: %s", err.Error())
-			http.Error(resp, "Unable to parse end_time as int", http.StatusBadRequest)
+	if sensorIDs := q["sensor_id"]; len(sensorIDs) > 1 || sensorID == allSensorsID {
+		m.queryForMultipleSensorReadings(resp, req, accountID, sensorIDs, startTime, endTime, options, units)
+		return
+	}
+	if sensor, err := m.deviceManager.GetSensor(sensorID); err == db.ErrSensorNotFound || (err == nil && sensor.AccountID != accountID) {
+		log.Printf("Sensor %s not found in account %s", sensorID, accountID)
+		http.Error(resp,
+			"Sensor not found",
+			http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error getting sensor for readings query: %s", err.Error())
+		http.Error(resp,
+			"Error getting sensor",
+			http.StatusInternalServerError)
+		return
+	}
+	if contentType := exportContentType(req.Header.Get("Accept")); contentType != "" {
+		if q.Get("limit") != "" || options.Cursor != "" {
+			log.Printf("Paged export requested for sensor: %s", sensorID)
+			http.Error(resp,
+				"Exports include every reading, so limit and cursor aren't supported",
+				http.StatusBadRequest)
 			return
 		}
-	} else {
-		endTime = time.Now().Unix()
+		m.exportSensorReadings(resp, newReadingsExportWriter(resp, contentType, units, accountID, sensorID), startTime, endTime, options)
+		return
 	}
-	if sensorReadings, err := m.measurementsDatabase.QueryForSensorReadings(accountID, sensorID, startTime, endTime); err == nil {
+	if sensorReadings, err := m.measurementsDatabase.QueryForSensorReadings(accountID, sensorID, startTime, endTime, options); err == nil {
+		units.ConvertSensorReadings(sensorReadings)
 		resp.Header().Set("Content-Type", "application/json")
 		resp.WriteHeader(http.StatusOK)
 		responseEncoder := json.NewEncoder(resp)
 		responseEncoder.Encode(sensorReadings)
+	} else if err == db.ErrInvalidCursor {
+		log.Printf("Invalid readings cursor for sensor: %s", sensorID)
+		http.Error(resp,
+			"Invalid cursor",
+			http.StatusBadRequest)
 	} else {
 		log.Printf("Error querying for sensor readings for account: %s", err.Error())
 		http.Error(resp,
@@ -107,7 +237,105 @@ func (m *SensorReadingsHandler) QueryForSensorReadings(resp http.ResponseWriter,
 	}
 }
 
-// GetSensorsResponse has a set of sensors
+// queryForMultipleSensorReadings retrieves the readings of several sensors, or
+// of every sensor in the account, after checking they all belong to it
+func (m *SensorReadingsHandler) queryForMultipleSensorReadings(resp http.ResponseWriter, req *http.Request, accountID string, sensorIDs []string, startTime, endTime int64, options *db.ReadingsQueryOptions, units *db.UnitOptions) {
+	if options.Cursor != "" {
+		log.Printf("Cursor given for readings of multiple sensors in account: %s", accountID)
+		http.Error(resp,
+			"cursor is only supported for a single sensor",
+			http.StatusBadRequest)
+		return
+	}
+	if exportContentType(req.Header.Get("Accept")) != "" {
+		log.Printf("Export requested for readings of multiple sensors in account: %s", accountID)
+		http.Error(resp,
+			"Exports are only supported for a single sensor",
+			http.StatusNotAcceptable)
+		return
+	}
+	// deleted sensors may be named, as when querying a single sensor, but
+	// aren't included in all
+	allSensors := len(sensorIDs) == 1 && sensorIDs[0] == allSensorsID
+	sensors, err := m.deviceManager.GetSensors(accountID, "", !allSensors)
+	if err != nil {
+		log.Printf("Error getting sensors for readings query: %s", err.Error())
+		http.Error(resp,
+			"Error getting sensors",
+			http.StatusInternalServerError)
+		return
+	}
+	accountSensors := make(map[string]bool)
+	for _, sensor := range sensors {
+		accountSensors[sensor.ID] = true
+	}
+	if allSensors {
+		sensorIDs = make([]string, 0, len(sensors))
+		for _, sensor := range sensors {
+			sensorIDs = append(sensorIDs, sensor.ID)
+		}
+	}
+	if len(sensorIDs) > maxReadingsQuerySensors {
+		log.Printf("Readings requested for too many sensors: %d", len(sensorIDs))
+		http.Error(resp,
+			fmt.Sprintf("At most %d sensors may be queried at once", maxReadingsQuerySensors),
+			http.StatusBadRequest)
+		return
+	}
+	for _, sensorID := range sensorIDs {
+		if !accountSensors[sensorID] {
+			log.Printf("Sensor %s not found in account %s", sensorID, accountID)
+			http.Error(resp,
+				"Sensor not found",
+				http.StatusNotFound)
+			return
+		}
+	}
+
+	if sensorReadings, err := m.measurementsDatabase.QueryForMultipleSensorReadings(accountID, sensorIDs, startTime, endTime, options); err == nil {
+		for _, results := range sensorReadings {
+			units.ConvertSensorReadings(results)
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusOK)
+		responseEncoder := json.NewEncoder(resp)
+		responseEncoder.Encode(&QueryForMultipleSensorReadingsResponse{accountID, sensorReadings})
+	} else {
+		log.Printf("Error querying for readings of multiple sensors for account: %s", err.Error())
+		http.Error(resp,
+			"Error querying for sensor readings for account",
+			http.StatusInternalServerError)
+	}
+}
+
+// exportSensorReadings streams every reading in the time range to the
+// response. Errors after the first line has been written can only be logged.
+func (m *SensorReadingsHandler) exportSensorReadings(resp http.ResponseWriter, writer *readingsExportWriter, startTime, endTime int64, options *db.ReadingsQueryOptions) {
+	err := m.measurementsDatabase.StreamSensorReadings(writer.accountID, writer.sensorID, startTime, endTime, options, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("Error exporting sensor readings for sensor %s: %s", writer.sensorID, err.Error())
+	if !writer.started {
+		http.Error(resp,
+			"Error exporting sensor readings",
+			http.StatusInternalServerError)
+	}
+}
+
+// GetSensorsResponse has a page of sensors, and a cursor for the next page if
+// there may be more
 type GetSensorsResponse struct {
-	Sensors []*db.Sensor `json:"sensors"`
+	Sensors    []*db.Sensor `json:"sensors"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// QueryForMultipleSensorReadingsResponse has the readings of several sensors,
+// keyed by sensor ID
+type QueryForMultipleSensorReadingsResponse struct {
+	AccountID string                                       `json:"account_id"`
+	Sensors   map[string]*db.QueryForSensorReadingsResults `json:"sensors"`
 }
@@ -0,0 +1,673 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/skidder/streammarker-data-access/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSensorReadingsTestRouter(deviceManager db.DeviceManager, measurementsDatabase db.MeasurementsDatabase) *mux.Router {
+	return newSensorReadingsTestRouterWithAccounts(deviceManager, measurementsDatabase, newFakeAccountManager("account1"))
+}
+
+func newSensorReadingsTestRouterWithAccounts(deviceManager db.DeviceManager, measurementsDatabase db.MeasurementsDatabase, accountManager db.AccountManager) *mux.Router {
+	r := mux.NewRouter()
+	InitializeRouterForSensorsDataRetrieval(r, deviceManager, measurementsDatabase, accountManager)
+	return r
+}
+
+func TestGetSensorsPaginates(t *testing.T) {
+	database := newFakeDeviceManager()
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("sensor%d", i)
+		database.sensors[id] = &db.Sensor{ID: id, AccountID: "account1", State: "active"}
+	}
+	router := newSensorReadingsTestRouter(database, newFakeMeasurementsDatabase())
+
+	var seen []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account1?limit=2&cursor="+cursor, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var page GetSensorsResponse
+		assert.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+		assert.True(t, len(page.Sensors) <= 2)
+		for _, sensor := range page.Sensors {
+			seen = append(seen, sensor.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"sensor0", "sensor1", "sensor2", "sensor3", "sensor4"}, seen)
+}
+
+func TestGetSensorsRejectsOversizedLimit(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account1?limit=100000", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestGetSensorsRejectsMalformedLimit(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account1?limit=abc", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestGetSensorsRejectsInvalidCursor(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account1?cursor=bogus", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestGetSensorsSortedByNameDescending(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", Name: "Basil", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", Name: "Tomatoes", State: "active"}
+	database.sensors["sensor3"] = &db.Sensor{ID: "sensor3", AccountID: "account1", Name: "Lettuce", State: "inactive"}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account1?sort=-name", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(database, newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var page GetSensorsResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	if assert.Len(t, page.Sensors, 3) {
+		assert.Equal(t, "Tomatoes", page.Sensors[0].Name)
+		assert.Equal(t, "Lettuce", page.Sensors[1].Name)
+		assert.Equal(t, "Basil", page.Sensors[2].Name)
+	}
+}
+
+func TestGetSensorsRejectsInvalidSort(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account1?sort=timestamp", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestGetSensorsForMissingAccount(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account9", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGetLastSensorReadingsForSuspendedAccount(t *testing.T) {
+	accounts := newFakeAccountManager()
+	accounts.accounts["account1"] = &db.Account{ID: "account1", State: db.AccountStateSuspended}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/last_sensor_readings/account/account1", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouterWithAccounts(newFakeDeviceManager(), newFakeMeasurementsDatabase(), accounts).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestQueryForSensorReadingsInOtherAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	router := newSensorReadingsTestRouter(database, newFakeMeasurementsDatabase())
+
+	// a caller bound to another account is refused even when naming the owner
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, withCallerAccount(req, "account2"))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// as is a caller naming its own account with another account's sensor
+	req, _ = http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account2&sensor_id=sensor1", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, withCallerAccount(req, "account2"))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestQueryForSensorReadingsInOwnAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(database, newFakeMeasurementsDatabase()).ServeHTTP(rec, withCallerAccount(req, "account1"))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestGetSensorsForOtherAccount(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensors/account/account1", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), newFakeMeasurementsDatabase()).ServeHTTP(rec, withCallerAccount(req, "account2"))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestQueryForSensorReadingsBindsHostileIDs(t *testing.T) {
+	hostileSensorID := "1' or account_id = 'account2"
+	database := newFakeDeviceManager()
+	database.sensors[hostileSensorID] = &db.Sensor{ID: hostileSensorID, AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id="+url.QueryEscape(hostileSensorID), nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, influx.queries, 1)
+	assert.NotContains(t, influx.queries[0].Command, "account2")
+	assert.Equal(t, hostileSensorID, influx.queries[0].Parameters["sensor_id"])
+	assert.Equal(t, "account1", influx.queries[0].Parameters["account_id"])
+}
+
+func TestQueryForSensorReadingsUnknownHostileID(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["1"] = &db.Sensor{ID: "1", AccountID: "account2", State: "active"}
+	influx := &fakeInfluxClient{}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id="+url.QueryEscape("1' or account_id = 'account2"), nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, influx.queries)
+}
+
+func TestGetLastSensorReadingsInSingleQuery(t *testing.T) {
+	hostileSensorID := "1' or account_id = 'account2"
+	database := newFakeDeviceManager()
+	database.sensors[hostileSensorID] = &db.Sensor{ID: hostileSensorID, AccountID: "account1", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{results: [][]client.Result{{{Series: []models.Row{
+		{Tags: map[string]string{"sensor_id": hostileSensorID}, Columns: []string{"time", "temperature"}, Values: [][]interface{}{{"2016-05-01T00:00:00Z", json.Number("21")}}},
+		{Tags: map[string]string{"sensor_id": "sensor2"}, Columns: []string{"time", "temperature"}, Values: [][]interface{}{{"2016-05-01T00:01:00Z", json.Number("22")}}},
+	}}}}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/last_sensor_readings/account/account1", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, influx.queries, 1)
+	assert.Equal(t, `SELECT * FROM "sensor_measurements" WHERE "account_id" = $account_id GROUP BY "sensor_id" ORDER BY time DESC LIMIT 1`, influx.queries[0].Command)
+	assert.Equal(t, "account1", influx.queries[0].Parameters["account_id"])
+	var results db.LatestSensorReadings
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Equal(t, 21.0, results.Sensors[hostileSensorID].Measurements[0].Value)
+	assert.Equal(t, 22.0, results.Sensors["sensor2"].Measurements[0].Value)
+}
+
+func TestGetLastSensorReadingsProjectsMeasurements(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{results: [][]client.Result{{{Series: []models.Row{
+		{Tags: map[string]string{"sensor_id": "sensor1"}, Columns: []string{"time", "soil_moisture"}, Values: [][]interface{}{{"2016-05-01T00:00:00Z", json.Number("0.3")}}},
+	}}}}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/last_sensor_readings/account/account1?measurements=soil_moisture,,soil_moisture", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `SELECT "soil_moisture" FROM "sensor_measurements" WHERE "account_id" = $account_id GROUP BY "sensor_id" ORDER BY time DESC LIMIT 1`, influx.queries[0].Command)
+	var results db.LatestSensorReadings
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Equal(t, []db.Measurement{{Name: "soil_moisture", Value: 0.3, Unit: "VWC"}}, results.Sensors["sensor1"].Measurements)
+}
+
+func TestQueryForSensorReadingsProjectsMeasurements(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	measurements := newFakeMeasurementsDatabase()
+	measurements.readings["sensor1"] = []*db.MinimalReading{
+		{Timestamp: 1, Measurements: []db.Measurement{{Name: "temperature", Value: 20, Unit: db.UnitCelsius}, {Name: "soil_moisture", Value: 0.3, Unit: "VWC"}}},
+	}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=0&end_time=10&measurements=soil_moisture", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(database, measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var results db.QueryForSensorReadingsResults
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Equal(t, []db.Measurement{{Name: "soil_moisture", Value: 0.3, Unit: "VWC"}}, results.Readings[0].Measurements)
+}
+
+func TestQueryForSensorReadingsImperialUnits(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	measurements := newFakeMeasurementsDatabase()
+	measurements.readings["sensor1"] = []*db.MinimalReading{
+		{Timestamp: time.Now().Unix(), Measurements: []db.Measurement{{Name: "temperature", Value: 100, Unit: db.UnitCelsius}}},
+	}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&units=imperial", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(database, measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var results db.QueryForSensorReadingsResults
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Equal(t, []db.Measurement{{Name: "temperature", Value: 212, Unit: db.UnitFahrenheit}}, results.Readings[0].Measurements)
+}
+
+func TestGetLastSensorReadingsTemperatureUnitOverride(t *testing.T) {
+	measurements := newFakeMeasurementsDatabase()
+	measurements.readings["sensor1"] = []*db.MinimalReading{
+		{Timestamp: 1, Measurements: []db.Measurement{{Name: "temperature", Value: 0, Unit: db.UnitCelsius}}},
+	}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/last_sensor_readings/account/account1?units=imperial&temperature_unit=Kelvin", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var results db.LatestSensorReadings
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Equal(t, []db.Measurement{{Name: "temperature", Value: 273.15, Unit: db.UnitKelvin}}, results.Sensors["sensor1"].Measurements)
+}
+
+func TestGetLastSensorReadingsRejectsUnknownUnits(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/data-access/v1/last_sensor_readings/account/account1?units=nautical", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(newFakeDeviceManager(), newFakeMeasurementsDatabase()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestQueryForSensorReadingsAggregatesByInterval(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{results: [][]client.Result{{{Series: []models.Row{{
+		Name:    "sensor_measurements",
+		Columns: []string{"time", "max_temperature", "max_humidity"},
+		Values: [][]interface{}{
+			{"2016-05-01T01:00:00Z", json.Number("24.5"), json.Number("60")},
+			{"2016-05-01T00:00:00Z", nil, nil},
+		},
+	}}}}}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000&interval=1h&agg=max&fill=null", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `SELECT max(*) FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time GROUP BY time(3600s) fill(null) ORDER BY time DESC LIMIT 1000`, influx.queries[0].Command)
+	var results db.QueryForSensorReadingsResults
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Len(t, results.Readings, 2)
+	assert.Equal(t, []db.Measurement{{Name: "temperature", Value: 24.5, Unit: "Celsius"}, {Name: "humidity", Value: 60, Unit: "%"}}, results.Readings[0].Measurements)
+	assert.Empty(t, results.Readings[1].Measurements)
+}
+
+func TestQueryForSensorReadingsRejectsInvalidAggregation(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	router := newSensorReadingsTestRouter(database, newFakeMeasurementsDatabase())
+
+	for _, params := range []string{"interval=5x", "interval=1h&agg=median", "interval=1h&fill=sideways", "agg=max", "start_time=0&end_time=1000000&interval=1s"} {
+		req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&"+params, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, params)
+	}
+}
+
+func TestQueryForSensorReadingsPaginates(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	page := func(values ...[]interface{}) []client.Result {
+		return []client.Result{{Series: []models.Row{{
+			Name:    "sensor_measurements",
+			Columns: []string{"time", "temperature"},
+			Values:  values,
+		}}}}
+	}
+	influx := &fakeInfluxClient{results: [][]client.Result{
+		page([]interface{}{"2016-05-01T00:00:00Z", json.Number("20")}, []interface{}{"2016-05-01T00:00:01.5Z", json.Number("21")}),
+		page([]interface{}{"2016-05-01T00:00:02Z", json.Number("22")}),
+	}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000&limit=2&order=asc", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time ORDER BY time ASC LIMIT 2`, influx.queries[0].Command)
+	var first db.QueryForSensorReadingsResults
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&first))
+	assert.Len(t, first.Readings, 2)
+	assert.NotEmpty(t, first.NextCursor)
+
+	req, _ = http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000&limit=2&order=asc&cursor="+first.NextCursor, nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time AND time > $cursor_time ORDER BY time ASC LIMIT 2`, influx.queries[1].Command)
+	assert.Equal(t, "2016-05-01T00:00:01.5Z", influx.queries[1].Parameters["cursor_time"])
+	var second db.QueryForSensorReadingsResults
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&second))
+	assert.Len(t, second.Readings, 1)
+	assert.Empty(t, second.NextCursor)
+}
+
+func TestQueryForSensorReadingsPaginatesAggregatesAfterCursorBucket(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{results: [][]client.Result{{{Series: []models.Row{{
+		Name:    "sensor_measurements",
+		Columns: []string{"time", "mean_temperature"},
+		Values:  [][]interface{}{{"2016-05-01T00:00:00Z", json.Number("20")}},
+	}}}}}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000&interval=1h&limit=1&order=asc", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	var first db.QueryForSensorReadingsResults
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&first))
+	assert.NotEmpty(t, first.NextCursor)
+
+	req, _ = http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000&interval=1h&limit=1&order=asc&cursor="+first.NextCursor, nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `SELECT mean(*) FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time AND time >= $cursor_time GROUP BY time(3600s) ORDER BY time ASC LIMIT 1`, influx.queries[1].Command)
+	assert.Equal(t, "2016-05-01T01:00:00Z", influx.queries[1].Parameters["cursor_time"])
+}
+
+func TestQueryForSensorReadingsRejectsInvalidPage(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(&fakeInfluxClient{}, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	for _, params := range []string{"limit=0", "limit=10001", "limit=abc", "limit=2.5", "order=sideways", "cursor=bogus", "order=asc&cursor=eyJzIjoic2Vuc29yMSIsImQiOnRydWUsInQiOjF9"} {
+		req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&"+params, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, params)
+	}
+}
+
+func TestGetLastSensorReadingsWithFailingSensor(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{fail: func(q client.Query) error {
+		// the account-wide query and sensor2's query both fail
+		if sensorID, ok := q.Parameters["sensor_id"]; !ok || sensorID == "sensor2" {
+			return errors.New("series is corrupt")
+		}
+		return nil
+	}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/last_sensor_readings/account/account1", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, influx.queries, 3)
+	var results db.LatestSensorReadings
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.True(t, results.Partial)
+	assert.Empty(t, results.Sensors["sensor1"].Error)
+	assert.Equal(t, "series is corrupt", results.Sensors["sensor2"].Error)
+}
+
+func TestGetLastSensorReadingsWithEverySensorFailing(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{fail: func(q client.Query) error {
+		return errors.New("influxdb is down")
+	}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/last_sensor_readings/account/account1", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Len(t, influx.queries, 3)
+}
+
+func newExportTestRouter() (*fakeInfluxClient, *mux.Router) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	chunk := func(values ...[]interface{}) client.Result {
+		return client.Result{Series: []models.Row{{
+			Name:    "sensor_measurements",
+			Columns: []string{"time", "account_id", "humidity", "sensor_id", "temperature"},
+			Values:  values,
+		}}}
+	}
+	influx := &fakeInfluxClient{results: [][]client.Result{{
+		chunk([]interface{}{"2016-05-01T00:00:00Z", "account1", json.Number("60"), "sensor1", json.Number("100")}),
+		chunk([]interface{}{"2016-05-01T00:01:00Z", "account1", nil, "sensor1", json.Number("0")}),
+	}}}
+	return influx, newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+}
+
+func TestQueryForSensorReadingsStreamsNDJSON(t *testing.T) {
+	influx, router := newExportTestRouter()
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000&units=imperial", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.True(t, influx.queries[0].Chunked)
+	assert.Equal(t, `SELECT * FROM "sensor_measurements" WHERE "sensor_id" = $sensor_id AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time ORDER BY time DESC`, influx.queries[0].Command)
+	assert.Equal(t, `{"account_id":"account1","sensor_id":"sensor1","measurements":[{"name":"humidity","unit":"%"},{"name":"temperature","unit":"Fahrenheit"}]}
+{"timestamp":1462060800,"measurements":[{"name":"humidity","value":60,"unit":"%"},{"name":"temperature","value":212,"unit":"Fahrenheit"}]}
+{"timestamp":1462060860,"measurements":[{"name":"temperature","value":32,"unit":"Fahrenheit"}]}
+`, rec.Body.String())
+}
+
+func TestQueryForSensorReadingsStreamsCSV(t *testing.T) {
+	_, router := newExportTestRouter()
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000", nil)
+	req.Header.Set("Accept", "text/csv; charset=utf-8, application/json;q=0.5")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "timestamp,humidity (%),temperature (Celsius)\n1462060800,60,100\n1462060860,,0\n", rec.Body.String())
+}
+
+// flushRecorder records the body written before each flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushed = append(r.flushed, r.Body.String())
+	r.ResponseRecorder.Flush()
+}
+
+func TestQueryForSensorReadingsExportFlushesEachChunk(t *testing.T) {
+	_, router := newExportTestRouter()
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&start_time=1462060800&end_time=1462068000", nil)
+	req.Header.Set("Accept", "text/csv")
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{
+		"timestamp,humidity (%),temperature (Celsius)\n1462060800,60,100\n",
+		"timestamp,humidity (%),temperature (Celsius)\n1462060800,60,100\n1462060860,,0\n",
+		"timestamp,humidity (%),temperature (Celsius)\n1462060800,60,100\n1462060860,,0\n",
+	}, rec.flushed)
+}
+
+func TestQueryForSensorReadingsExportRejectsPaging(t *testing.T) {
+	influx, router := newExportTestRouter()
+
+	for _, params := range []string{"&limit=10", "&cursor=abc"} {
+		req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1"+params, nil)
+		req.Header.Set("Accept", "application/x-ndjson")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, params)
+	}
+	assert.Empty(t, influx.queries)
+}
+
+func TestSkipCompressionForExports(t *testing.T) {
+	compressed := false
+	middleware := SkipCompressionForExports(negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		compressed = true
+		next(rw, r)
+	}))
+
+	for _, tc := range []struct {
+		accept     string
+		compressed bool
+	}{
+		{"application/json", true},
+		{"", true},
+		{"application/x-ndjson", false},
+		{"text/csv; charset=utf-8, application/json;q=0.5", false},
+	} {
+		compressed = false
+		served := false
+		req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings", nil)
+		req.Header.Set("Accept", tc.accept)
+		middleware.ServeHTTP(httptest.NewRecorder(), req, func(rw http.ResponseWriter, r *http.Request) {
+			served = true
+		})
+		assert.True(t, served, tc.accept)
+		assert.Equal(t, tc.compressed, compressed, tc.accept)
+	}
+}
+
+func TestQueryForSensorReadingsExportFailure(t *testing.T) {
+	influx, router := newExportTestRouter()
+	influx.fail = func(q client.Query) error {
+		return fmt.Errorf("influxdb is down")
+	}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1", nil)
+	req.Header.Set("Accept", "text/csv")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestQueryForMultipleSensorReadings(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", State: "active"}
+	influx := &fakeInfluxClient{results: [][]client.Result{{{Series: []models.Row{
+		{Name: "sensor_measurements", Tags: map[string]string{"sensor_id": "sensor1"}, Columns: []string{"time", "mean_temperature"}, Values: [][]interface{}{{"2016-05-01T01:00:00Z", json.Number("21")}}},
+		{Name: "sensor_measurements", Tags: map[string]string{"sensor_id": "sensor2"}, Columns: []string{"time", "mean_temperature"}, Values: [][]interface{}{{"2016-05-01T01:00:00Z", json.Number("22")}}},
+	}}}}}
+	router := newSensorReadingsTestRouter(database, db.NewInfluxDAOWithClient(influx, "streammarker_measurements", database, db.DefaultMeasurementRegistry()))
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&sensor_id=sensor2&start_time=1462060800&end_time=1462068000&interval=1h", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, influx.queries, 1)
+	assert.Equal(t, `SELECT mean(*) FROM "sensor_measurements" WHERE ("sensor_id" = $sensor_id OR "sensor_id" = $sensor_id_1) AND "account_id" = $account_id AND time >= $start_time AND time <= $end_time GROUP BY time(3600s), "sensor_id" ORDER BY time DESC LIMIT 1000`, influx.queries[0].Command)
+	var results QueryForMultipleSensorReadingsResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Equal(t, "account1", results.AccountID)
+	assert.Equal(t, 21.0, results.Sensors["sensor1"].Readings[0].Measurements[0].Value)
+	assert.Equal(t, 22.0, results.Sensors["sensor2"].Readings[0].Measurements[0].Value)
+}
+
+func TestQueryForAllSensorReadings(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account1", State: "active", DeletedAt: 1}
+	database.sensors["sensor3"] = &db.Sensor{ID: "sensor3", AccountID: "account2", State: "active"}
+	measurements := newFakeMeasurementsDatabase()
+	measurements.readings["sensor1"] = []*db.MinimalReading{{Timestamp: 1, Measurements: []db.Measurement{{Name: "temperature", Value: 20, Unit: db.UnitCelsius}}}}
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=all&start_time=0&end_time=10", nil)
+	rec := httptest.NewRecorder()
+	newSensorReadingsTestRouter(database, measurements).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var results QueryForMultipleSensorReadingsResponse
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	assert.Len(t, results.Sensors, 1)
+	assert.Len(t, results.Sensors["sensor1"].Readings, 1)
+}
+
+func TestQueryForTooManySensorReadings(t *testing.T) {
+	database := newFakeDeviceManager()
+	params := url.Values{"account_id": {"account1"}}
+	for k := 0; k <= maxReadingsQuerySensors; k++ {
+		sensorID := fmt.Sprintf("sensor%d", k)
+		database.sensors[sensorID] = &db.Sensor{ID: sensorID, AccountID: "account1", State: "active"}
+		params.Add("sensor_id", sensorID)
+	}
+	router := newSensorReadingsTestRouter(database, newFakeMeasurementsDatabase())
+
+	for _, query := range []string{params.Encode(), "account_id=account1&sensor_id=all"} {
+		req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?"+query, nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestQueryForMultipleSensorReadingsInOtherAccount(t *testing.T) {
+	database := newFakeDeviceManager()
+	database.sensors["sensor1"] = &db.Sensor{ID: "sensor1", AccountID: "account1", State: "active"}
+	database.sensors["sensor2"] = &db.Sensor{ID: "sensor2", AccountID: "account2", State: "active"}
+	router := newSensorReadingsTestRouter(database, newFakeMeasurementsDatabase())
+
+	req, _ := http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&sensor_id=sensor2", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	req, _ = http.NewRequest("GET", "/data-access/v1/sensor_readings?account_id=account1&sensor_id=sensor1&sensor_id=sensor1&cursor=abc", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -1,15 +1,28 @@
 package handlers
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"strings"
 )
 
-// TokenVerificationMiddleware with set of allowed tokens
+type contextKey int
+
+const (
+	callerAccountKey contextKey = iota
+	callerRelayKey
+)
+
+// TokenVerificationMiddleware with set of allowed tokens. Service tokens may
+// act on any account, optionally binding the request to one with the
+// X-Account-ID header; account tokens are bound to a single account. Relay
+// tokens are held by a relay's devices and may only write points for it.
 type TokenVerificationMiddleware struct {
-	apiTokens []string
+	apiTokens     []string
+	accountTokens map[string]string
+	relayTokens   map[string]string
 }
 
 // NewTokenVerificationMiddleware constructs a new TokenVerificationMiddleware instance
@@ -20,11 +33,49 @@ func NewTokenVerificationMiddleware() *TokenVerificationMiddleware {
 // Initialize will prepare the instance for use
 func (t *TokenVerificationMiddleware) Initialize() {
 	t.apiTokens = strings.Split(os.Getenv("STREAMMARKER_DATA_ACCESS_API_TOKENS"), ",")
+	t.accountTokens = parseBoundTokens(os.Getenv("STREAMMARKER_DATA_ACCESS_ACCOUNT_API_TOKENS"))
+	t.relayTokens = parseBoundTokens(os.Getenv("STREAMMARKER_DATA_ACCESS_RELAY_API_TOKENS"))
+}
+
+// parseBoundTokens parses a comma-separated list of token:id pairs, binding
+// each token to an account or relay
+func parseBoundTokens(val string) map[string]string {
+	boundTokens := make(map[string]string)
+	for _, pair := range strings.Split(val, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		boundTokens[parts[0]] = parts[1]
+	}
+	return boundTokens
 }
 
 // Run the middleware to verify the request includes a valid token
 func (t *TokenVerificationMiddleware) Run(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
 	suppliedAPIToken := r.Header.Get("X-API-KEY")
+	requestedAccountID := r.Header.Get("X-Account-ID")
+
+	if accountID, ok := t.accountTokens[suppliedAPIToken]; ok {
+		if requestedAccountID != "" && requestedAccountID != accountID {
+			log.Printf("API key for account %s used with X-Account-ID %s, rejecting at middleware", accountID, requestedAccountID)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, withCallerAccount(r, accountID))
+		return
+	}
+
+	if relayID, ok := t.relayTokens[suppliedAPIToken]; ok {
+		if r.Method != "POST" || r.URL.Path != relayWritePath(relayID) {
+			log.Printf("API key for relay %s used for %s %s, rejecting at middleware", relayID, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, withCallerRelay(r, relayID))
+		return
+	}
+
 	found := false
 	for _, token := range t.apiTokens {
 		if suppliedAPIToken == token {
@@ -38,5 +89,38 @@ func (t *TokenVerificationMiddleware) Run(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if requestedAccountID != "" {
+		r = withCallerAccount(r, requestedAccountID)
+	}
 	next(w, r)
 }
+
+// withCallerAccount binds the request to the account of the caller
+func withCallerAccount(r *http.Request, accountID string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerAccountKey, accountID))
+}
+
+// callerAccountID returns the account the caller is bound to, or an empty
+// string if the caller may access any account
+func callerAccountID(r *http.Request) string {
+	accountID, _ := r.Context().Value(callerAccountKey).(string)
+	return accountID
+}
+
+// callerOwnsAccount reports whether the caller may access records in the account
+func callerOwnsAccount(r *http.Request, accountID string) bool {
+	caller := callerAccountID(r)
+	return caller == "" || caller == accountID
+}
+
+// withCallerRelay binds the request to the relay whose device is calling
+func withCallerRelay(r *http.Request, relayID string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerRelayKey, relayID))
+}
+
+// callerRelayID returns the relay whose device is calling, or an empty string
+// if the caller isn't a device
+func callerRelayID(r *http.Request) string {
+	relayID, _ := r.Context().Value(callerRelayKey).(string)
+	return relayID
+}
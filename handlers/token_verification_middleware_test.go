@@ -109,5 +109,101 @@ func TestTokenVerificationMiddlewareGetWithTokenAndTokenEnforcement(t *testing.T
 	assert.Equal(t, http.StatusOK, rec.Code)
 }
 
+func TestTokenVerificationMiddlewareAccountTokenBindsCaller(t *testing.T) {
+	os.Setenv("STREAMMARKER_DATA_ACCESS_API_TOKENS", "abc123")
+	os.Setenv("STREAMMARKER_DATA_ACCESS_ACCOUNT_API_TOKENS", "def456:account1")
+	defer os.Setenv("STREAMMARKER_DATA_ACCESS_API_TOKENS", "")
+	defer os.Setenv("STREAMMARKER_DATA_ACCESS_ACCOUNT_API_TOKENS", "")
+
+	h := NewTokenVerificationMiddleware()
+	h.Initialize()
+
+	r, _ := http.NewRequest("GET", "/", strings.NewReader(""))
+	r.Header.Add("X-API-KEY", "def456")
+	rec := httptest.NewRecorder()
+
+	var caller string
+	h.Run(rec, r, func(resp http.ResponseWriter, req *http.Request) {
+		caller = callerAccountID(req)
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "account1", caller)
+}
+
+func TestTokenVerificationMiddlewareAccountTokenWithOtherAccountHeader(t *testing.T) {
+	os.Setenv("STREAMMARKER_DATA_ACCESS_ACCOUNT_API_TOKENS", "def456:account1")
+	defer os.Setenv("STREAMMARKER_DATA_ACCESS_ACCOUNT_API_TOKENS", "")
+
+	h := NewTokenVerificationMiddleware()
+	h.Initialize()
+
+	r, _ := http.NewRequest("GET", "/", strings.NewReader(""))
+	r.Header.Add("X-API-KEY", "def456")
+	r.Header.Add("X-Account-ID", "account2")
+	rec := httptest.NewRecorder()
+
+	h.Run(rec, r, DummyHandler)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestTokenVerificationMiddlewareServiceTokenWithAccountHeader(t *testing.T) {
+	os.Setenv("STREAMMARKER_DATA_ACCESS_API_TOKENS", "abc123")
+	defer os.Setenv("STREAMMARKER_DATA_ACCESS_API_TOKENS", "")
+
+	h := NewTokenVerificationMiddleware()
+	h.Initialize()
+
+	r, _ := http.NewRequest("GET", "/", strings.NewReader(""))
+	r.Header.Add("X-API-KEY", "abc123")
+	r.Header.Add("X-Account-ID", "account2")
+	rec := httptest.NewRecorder()
+
+	var caller string
+	h.Run(rec, r, func(resp http.ResponseWriter, req *http.Request) {
+		caller = callerAccountID(req)
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "account2", caller)
+}
+
+func TestTokenVerificationMiddlewareRelayToken(t *testing.T) {
+	os.Setenv("STREAMMARKER_DATA_ACCESS_RELAY_API_TOKENS", "ghi789:relay1")
+	defer os.Setenv("STREAMMARKER_DATA_ACCESS_RELAY_API_TOKENS", "")
+
+	h := NewTokenVerificationMiddleware()
+	h.Initialize()
+
+	r, _ := http.NewRequest("POST", "/data-access/v1/relay/relay1/write", strings.NewReader(""))
+	r.Header.Add("X-API-KEY", "ghi789")
+	rec := httptest.NewRecorder()
+
+	var relay, account string
+	h.Run(rec, r, func(resp http.ResponseWriter, req *http.Request) {
+		relay = callerRelayID(req)
+		account = callerAccountID(req)
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "relay1", relay)
+	assert.Equal(t, "", account)
+}
+
+func TestTokenVerificationMiddlewareRelayTokenOutsideWritePath(t *testing.T) {
+	os.Setenv("STREAMMARKER_DATA_ACCESS_RELAY_API_TOKENS", "ghi789:relay1")
+	defer os.Setenv("STREAMMARKER_DATA_ACCESS_RELAY_API_TOKENS", "")
+
+	h := NewTokenVerificationMiddleware()
+	h.Initialize()
+
+	for _, target := range []string{"GET /data-access/v1/relay/relay1", "POST /data-access/v1/relay/relay2/write", "GET /data-access/v1/relay/relay1/write"} {
+		parts := strings.SplitN(target, " ", 2)
+		r, _ := http.NewRequest(parts[0], parts[1], strings.NewReader(""))
+		r.Header.Add("X-API-KEY", "ghi789")
+		rec := httptest.NewRecorder()
+
+		h.Run(rec, r, DummyHandler)
+		assert.Equal(t, http.StatusForbidden, rec.Code, target)
+	}
+}
+
 func DummyHandler(resp http.ResponseWriter, req *http.Request) {
 }